@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/irmf/reflector.go/db"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	var cmd = &cobra.Command{
+		Use:   "db",
+		Short: "Manage the schema of the reflector db",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "migrate",
+		Short: "Create the db tables, or upgrade them to the schema this binary needs",
+		Args:  cobra.NoArgs,
+		Run:   dbMigrateCmd,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "status",
+		Short: "Print the db schema migrations as JSON, and when each was applied",
+		Long:  "Print the db schema migrations as JSON, and when each was applied. Exits with status 1 if some are not applied.",
+		Args:  cobra.NoArgs,
+		Run:   dbStatusCmd,
+	})
+	rootCmd.AddCommand(cmd)
+}
+
+func dbMigrateCmd(cmd *cobra.Command, args []string) {
+	sqlDB := migrationDB()
+	applied, err := sqlDB.Migrate()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("applied %d migrations, schema is at version %d", applied, db.SchemaVersion())
+}
+
+func dbStatusCmd(cmd *cobra.Command, args []string) {
+	statuses, err := migrationDB().MigrationStatus()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out, err := json.MarshalIndent(statuses, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(out))
+
+	for _, s := range statuses {
+		if s.AppliedAt == nil {
+			os.Exit(1)
+		}
+	}
+}
+
+// migrationDB connects to the MySQL db without checking its schema
+func migrationDB() *db.SQL {
+	if strings.HasPrefix(globalConfig.DBConn, "bolt:") {
+		log.Fatal("the embedded db has no schema to migrate")
+	}
+	sqlDB := &db.SQL{SkipSchemaCheck: true}
+	err := sqlDB.Connect(globalConfig.DBConn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return sqlDB
+}
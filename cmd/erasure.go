@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/irmf/reflector.go/store"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var erasureScrubParity int
+var erasureScrubWorkers int
+
+func init() {
+	var cmd = &cobra.Command{
+		Use:   "erasure-scrub SHARD_ORIGIN...",
+		Short: "Recreate the missing or corrupt shards of erasure coded blobs and print a JSON summary",
+		Long: "Check every shard of every blob stored across the shard origins ('s3:REGION:BUCKET' or 'disk:PATH'), " +
+			"in the same order as --erasure-shards, and recreate the shards that are missing or corrupt. " +
+			"Exits with status 1 if some blobs could not be recovered.",
+		Args: cobra.MinimumNArgs(2),
+		Run:  erasureScrubCmd,
+	}
+	cmd.Flags().IntVar(&erasureScrubParity, "parity", 2, "how many of the shard origins hold parity shards")
+	cmd.Flags().IntVar(&erasureScrubWorkers, "workers", 10, "how many blobs to check at once")
+	rootCmd.AddCommand(cmd)
+}
+
+func erasureScrubCmd(cmd *cobra.Command, args []string) {
+	summary, err := erasureStore(args, erasureScrubParity).Scrub(erasureScrubWorkers)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(out))
+
+	if summary.Unrecoverable > 0 {
+		os.Exit(1)
+	}
+}
+
+// erasureStore returns an erasure coded store with one shard in each origin
+func erasureStore(specs []string, parity int) *store.ErasureStore {
+	var stores []store.BlobStore
+	for _, spec := range specs {
+		stores = append(stores, originStore(spec))
+	}
+	s, err := store.NewErasureStore(stores, store.ErasureOpts{
+		DataShards:   len(stores) - parity,
+		ParityShards: parity,
+		Component:    "reflector",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return s
+}
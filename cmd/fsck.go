@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/irmf/reflector.go/store"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var fsckOpts store.FsckOpts
+
+func init() {
+	var cmd = &cobra.Command{
+		Use:   "fsck PATH",
+		Short: "Check the blobs in a disk store directory and print a JSON report",
+		Long: "Check that every file in a disk store directory is a blob named after its hash and stored in the " +
+			"right prefix subdirectory. Exits with status 1 if any problems were not fixed.",
+		Args: cobra.ExactArgs(1),
+		Run:  fsckCmd,
+	}
+	cmd.Flags().IntVar(&fsckOpts.PrefixLength, "prefix-length", 2, "length of the hash prefix used for subdirectories (0 = no subdirectories)")
+	cmd.Flags().BoolVar(&fsckOpts.Repair, "repair", false, "move misplaced blobs to the right subdirectory")
+	cmd.Flags().BoolVar(&fsckOpts.Delete, "delete", false, "delete bad files")
+	cmd.Flags().StringVar(&fsckOpts.QuarantineDir, "quarantine-dir", "", "move bad files to this directory instead of deleting them")
+	cmd.Flags().DurationVar(&fsckOpts.TempFileGrace, "temp-file-grace", time.Hour, "skip temp files modified more recently than this, since a running store may still be writing them")
+	cmd.Flags().IntVar(&fsckOpts.Workers, "workers", 0, "how many files to check at once (default is the number of CPUs)")
+	rootCmd.AddCommand(cmd)
+}
+
+func fsckCmd(cmd *cobra.Command, args []string) {
+	report, err := store.Fsck(args[0], fsckOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(out))
+
+	if report.Unresolved() > 0 {
+		os.Exit(1)
+	}
+}
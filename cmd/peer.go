@@ -6,7 +6,6 @@ import (
 	"strconv"
 	"syscall"
 
-	"github.com/irmf/reflector.go/db"
 	"github.com/irmf/reflector.go/peer"
 	"github.com/irmf/reflector.go/store"
 
@@ -29,12 +28,11 @@ func init() {
 func peerCmd(cmd *cobra.Command, args []string) {
 	var err error
 
-	s3 := store.NewS3Store(globalConfig.AwsID, globalConfig.AwsSecret, globalConfig.BucketRegion, globalConfig.BucketName)
+	s3 := newS3Store()
 	peerServer := peer.NewServer(s3)
 
 	if !peerNoDB {
-		db := new(db.SQL)
-		err = db.Connect(globalConfig.DBConn)
+		db, err := connectDB(false)
 		checkErr(err)
 
 		combo := store.NewDBBackedStore(s3, db)
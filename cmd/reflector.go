@@ -16,8 +16,9 @@ import (
 	"github.com/irmf/reflector.go/reflector"
 	"github.com/irmf/reflector.go/store"
 
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/cast"
 	"github.com/spf13/cobra"
 )
 
@@ -34,7 +35,42 @@ var (
 	useDB                 bool
 	cloudFrontEndpoint    string
 	reflectorCmdDiskCache string
-	reflectorCmdMemCache  int
+	reflectorCmdMemCache  string
+	diskCacheFsync        bool
+	diskCacheBackend      string
+	compressCache         bool
+	cachePolicy           string
+	cachePolicyHistory    int
+	writeBackDir          string
+	writeBackWorkers      int
+	verifyBlobs           bool
+	quarantineDir         string
+	replicateTo           []string
+	writeQuorum           int
+	coldTier              string
+	demoteAfterDays       int
+	erasureShards         []string
+	erasureParity         int
+	circuitBreaker        bool
+	breakerFallback       string
+	origins               []string
+	hedgeDelay            time.Duration
+	hedge                 bool
+	hedgePercentile       float64
+	hedgeAlternate        string
+	prefetchCount         int
+	prefetchWorkers       int
+
+	// set by setupStore if write-back is enabled
+	writeBackStore *store.WriteBackStore
+	// set by setupStore if replication is enabled
+	replicatedStore *store.ReplicatedStore
+	// set by setupStore if tiering is enabled
+	tieredStore *store.TieredStore
+	// set by wrapWithCache if prefetching is enabled
+	prefetchStore *store.PrefetchStore
+	// set by wrapWithCache if the disk cache keeps blobs in segments
+	segmentStore *store.SegmentStore
 )
 
 func init() {
@@ -47,6 +83,12 @@ func init() {
 	cmd.Flags().StringVar(&proxyPort, "proxy-port", "5567", "port of another reflector server where blobs are fetched from")
 	cmd.Flags().StringVar(&proxyProtocol, "proxy-protocol", "http3", "protocol used to fetch blobs from another reflector server (tcp/http3)")
 	cmd.Flags().StringVar(&cloudFrontEndpoint, "cloudfront-endpoint", "", "CloudFront edge endpoint for standard HTTP retrieval")
+	cmd.Flags().StringSliceVar(&origins, "origins", nil,
+		"fetch blobs from these origins, trying each in order. replaces --proxy-address and the S3 origin. "+
+			"each is 'http3:HOST:PORT', 'tcp:HOST:PORT', 'cloudfront:ENDPOINT', 's3' (from the config), "+
+			"'s3:REGION:BUCKET' or 'disk:PATH'. uploads go to the last one")
+	cmd.Flags().DurationVar(&hedgeDelay, "origins-hedge-delay", 0,
+		"with --origins, also ask the next origin if one hasn't answered after this long (0 = never)")
 	cmd.Flags().IntVar(&tcpPeerPort, "tcp-peer-port", 5567, "The port reflector will distribute content from")
 	cmd.Flags().IntVar(&http3PeerPort, "http3-peer-port", 5568, "The port reflector will distribute content from over HTTP3 protocol")
 	cmd.Flags().IntVar(&receiverPort, "receiver-port", 5566, "The port reflector will receive content from")
@@ -55,8 +97,48 @@ func init() {
 	cmd.Flags().BoolVar(&disableBlocklist, "disable-blocklist", false, "Disable blocklist watching/updating")
 	cmd.Flags().BoolVar(&useDB, "use-db", true, "whether to connect to the reflector db or not")
 	cmd.Flags().StringVar(&reflectorCmdDiskCache, "disk-cache", "",
-		"enable disk cache, setting max size and path where to store blobs. format is 'MAX_BLOBS:CACHE_PATH'")
-	cmd.Flags().IntVar(&reflectorCmdMemCache, "mem-cache", 0, "enable in-memory cache with a max size of this many blobs")
+		"enable disk cache, setting max size and path where to store blobs. format is 'MAX_SIZE:CACHE_PATH'. "+
+			"MAX_SIZE is a number of blobs, or a size in bytes with a unit (e.g. 500GB). "+
+			"CACHE_PATH can be a comma-separated list of paths (e.g. on different disks) to spread the blobs across")
+	cmd.Flags().BoolVar(&diskCacheFsync, "disk-cache-fsync", false, "flush disk cache writes to disk before acknowledging them")
+	cmd.Flags().StringVar(&diskCacheBackend, "disk-cache-backend", "files",
+		"how the disk cache stores blobs (files/segments). files keeps a file per blob, segments packs blobs into large files "+
+			"and keeps the index of all blobs in memory, about 150 bytes per blob (1M blobs take 150MB, 50M blobs take 7GB). "+
+			"segments is meant for caches of up to a few million blobs. use files for bigger caches")
+	cmd.Flags().BoolVar(&compressCache, "compress-cache", false, "compress blobs in the disk and memory caches when it makes them smaller")
+	cmd.Flags().StringVar(&reflectorCmdMemCache, "mem-cache", "",
+		"enable in-memory cache with a max size of this many blobs, or this many bytes if a unit is given (e.g. 2GB)")
+	cmd.Flags().StringVar(&cachePolicy, "cache-policy", "all",
+		"which blobs from the origin get cached on a miss (all/second-hit). second-hit only caches blobs requested twice recently")
+	cmd.Flags().IntVar(&cachePolicyHistory, "cache-policy-history", 100000,
+		"how many recent cache misses the second-hit policy remembers")
+	cmd.Flags().StringVar(&writeBackDir, "write-back-dir", "",
+		"enable write-back: uploads are acknowledged once queued in this dir and uploaded to the origin in the background")
+	cmd.Flags().IntVar(&writeBackWorkers, "write-back-workers", 4, "how many concurrent write-back uploads to the origin")
+	cmd.Flags().BoolVar(&verifyBlobs, "verify-blobs", false,
+		"check the hash of blobs read from the caches and the origin. corrupt cached blobs are deleted and fetched again")
+	cmd.Flags().StringVar(&quarantineDir, "quarantine-dir", "", "if set with --verify-blobs, corrupt cached blobs are copied here before they are deleted")
+	cmd.Flags().StringSliceVar(&replicateTo, "replicate-to", nil,
+		"also store blobs in these origins. each is 's3:REGION:BUCKET' (using the S3 settings from the config) or 'disk:PATH'")
+	cmd.Flags().IntVar(&writeQuorum, "write-quorum", 0,
+		"with --replicate-to, how many origins must store a blob before an upload succeeds (default is a majority)")
+	cmd.Flags().StringSliceVar(&erasureShards, "erasure-shards", nil,
+		"store blobs erasure coded across these origins ('s3:REGION:BUCKET' or 'disk:PATH') instead of in the S3 bucket. "+
+			"the order must not change once blobs are stored")
+	cmd.Flags().IntVar(&erasureParity, "erasure-parity", 2, "with --erasure-shards, how many of the origins hold parity shards")
+	cmd.Flags().BoolVar(&hedge, "hedge", false,
+		"send a second request for blobs that the origin is slower to return than usual, and use whichever finishes first")
+	cmd.Flags().Float64Var(&hedgePercentile, "hedge-percentile", 0.95, "with --hedge, send the second request once the first is slower than this share of recent requests")
+	cmd.Flags().StringVar(&hedgeAlternate, "hedge-alternate", "", "with --hedge, send the second request to this origin (same format as --origins) instead of the same one")
+	cmd.Flags().IntVar(&prefetchCount, "prefetch", 0,
+		"when a blob is requested, fetch this many of the blobs after it in its stream into the cache (0 = off). needs a cache")
+	cmd.Flags().IntVar(&prefetchWorkers, "prefetch-workers", 10, "with --prefetch, how many requests can be prefetched for at once")
+	cmd.Flags().BoolVar(&circuitBreaker, "circuit-breaker", false, "fail fast while the origin keeps failing instead of waiting for every request to time out")
+	cmd.Flags().StringVar(&breakerFallback, "circuit-breaker-fallback", "",
+		"with --circuit-breaker, read blobs from this origin (same format as --origins) while the origin is failing")
+	cmd.Flags().StringVar(&coldTier, "cold-tier", "",
+		"move blobs of streams that were not accessed recently to this origin ('s3:REGION:BUCKET' or 'disk:PATH'). requires the db")
+	cmd.Flags().IntVar(&demoteAfterDays, "demote-after-days", 30, "with --cold-tier, how long a stream must go unaccessed before it's moved")
 	rootCmd.AddCommand(cmd)
 }
 
@@ -64,8 +146,23 @@ func reflectorCmd(cmd *cobra.Command, args []string) {
 	log.Printf("reflector %s", meta.VersionString())
 
 	// the blocklist logic requires the db backed store to be the outer-most store
-	underlyingStore := setupStore()
-	outerStore := wrapWithCache(underlyingStore)
+	underlyingStore, sqlDB := setupStore()
+	outerStore := wrapWithCache(underlyingStore, sqlDB)
+	if replicatedStore != nil {
+		defer replicatedStore.Shutdown()
+	}
+	if tieredStore != nil {
+		defer tieredStore.Shutdown()
+	}
+	if prefetchStore != nil {
+		defer prefetchStore.Shutdown()
+	}
+	if segmentStore != nil {
+		defer segmentStore.Shutdown()
+	}
+	if writeBackStore != nil {
+		defer writeBackStore.Shutdown() // deferred first so it stops after the servers that write to it
+	}
 
 	if !disableUploads {
 		reflectorServer := reflector.NewServer(underlyingStore)
@@ -103,10 +200,36 @@ func reflectorCmd(cmd *cobra.Command, args []string) {
 	// deferred shutdowns happen now
 }
 
-func setupStore() store.BlobStore {
+func setupStore() (store.BlobStore, db.DB) {
 	var s store.BlobStore
 
-	if proxyAddress != "" {
+	var sqlDB db.DB
+	if useDB {
+		var err error
+		sqlDB, err = connectDB(true)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// these pick where blobs are stored, so only one can be used
+	if (len(origins) > 0 || proxyAddress != "") && len(erasureShards) > 0 {
+		log.Fatal("--erasure-shards can't be used with --origins or --proxy-address")
+	}
+	if len(origins) > 0 && proxyAddress != "" {
+		log.Fatal("--origins and --proxy-address can't be used together")
+	}
+
+	if len(origins) > 0 {
+		var originStores []store.BlobStore
+		for _, spec := range origins {
+			originStores = append(originStores, originStore(spec))
+		}
+		s = store.NewFallbackStore(originStores, store.FallbackOpts{
+			HedgeDelay: hedgeDelay,
+			Component:  "reflector",
+		})
+	} else if proxyAddress != "" {
 		switch proxyProtocol {
 		case "tcp":
 			s = peer.NewStore(peer.StoreOpts{
@@ -121,75 +244,302 @@ func setupStore() store.BlobStore {
 		default:
 			log.Fatalf("protocol is not recognized: %s", proxyProtocol)
 		}
+	} else if len(erasureShards) > 0 {
+		s = erasureStore(erasureShards, erasureParity)
+	} else if cloudFrontEndpoint != "" {
+		s = store.NewCloudFrontRWStore(store.NewCloudFrontROStore(cloudFrontEndpoint), newS3Store())
 	} else {
-		s3Store := store.NewS3Store(globalConfig.AwsID, globalConfig.AwsSecret, globalConfig.BucketRegion, globalConfig.BucketName)
-		if cloudFrontEndpoint != "" {
-			s = store.NewCloudFrontRWStore(store.NewCloudFrontROStore(cloudFrontEndpoint), s3Store)
-		} else {
-			s = s3Store
+		s = newS3Store()
+	}
+
+	if len(replicateTo) > 0 {
+		replicas := []store.BlobStore{s}
+		for _, spec := range replicateTo {
+			replicas = append(replicas, originStore(spec))
 		}
+		replicatedStore = store.NewReplicatedStore(replicas, store.ReplicatedOpts{
+			WriteQuorum: writeQuorum,
+			Component:   "reflector",
+		})
+		replicatedStore.Start()
+		s = replicatedStore
 	}
 
-	if useDB {
-		db := new(db.SQL)
-		db.TrackAccessTime = true
-		err := db.Connect(globalConfig.DBConn)
+	if coldTier != "" {
+		if sqlDB == nil {
+			log.Fatal("--cold-tier requires the db")
+		}
+		tieredStore = store.NewTieredStore(s, originStore(coldTier), sqlDB, store.TieredOpts{
+			DemoteAfter: time.Duration(demoteAfterDays) * 24 * time.Hour,
+			Component:   "reflector",
+		})
+		tieredStore.Start()
+		s = tieredStore
+	}
+
+	if writeBackDir != "" {
+		if sqlDB != nil {
+			// the db records blobs once they are uploaded, not when they are queued
+			s = store.NewDBBackedStore(s, sqlDB)
+		}
+		writeBackStore = store.NewWriteBackStore(s, store.WriteBackOpts{
+			Dir:       writeBackDir,
+			Workers:   writeBackWorkers,
+			Component: "reflector",
+		})
+		err := writeBackStore.Start()
 		if err != nil {
 			log.Fatal(err)
 		}
+		s = writeBackStore
+	}
 
-		s = store.NewDBBackedStore(s, db)
+	if sqlDB != nil && writeBackStore == nil {
+		s = store.NewDBBackedStore(s, sqlDB)
 	}
 
-	return s
+	return s, sqlDB
 }
 
-func wrapWithCache(s store.BlobStore) store.BlobStore {
+// originStore returns the origin described by a spec like 's3:REGION:BUCKET' or 'disk:PATH'. See the
+// --origins flag for all specs.
+func originStore(spec string) store.BlobStore {
+	kind := strings.SplitN(spec, ":", 2)[0]
+	rest := strings.TrimPrefix(spec, kind+":")
+	parts := strings.SplitN(spec, ":", 3)
+	switch {
+	case spec == "s3":
+		return newS3Store()
+	case kind == "s3" && len(parts) == 3:
+		opts := s3Opts()
+		opts.Region = parts[1]
+		opts.Bucket = parts[2]
+		return store.NewS3StoreWithOpts(opts)
+	case kind == "disk" && strings.HasPrefix(rest, "/"):
+		return store.NewDiskStore(rest, 2)
+	case kind == "tcp" && len(parts) == 3:
+		return peer.NewStore(peer.StoreOpts{Address: rest, Timeout: 30 * time.Second})
+	case kind == "http3" && len(parts) == 3:
+		return http3.NewStore(http3.StoreOpts{Address: rest, Timeout: 30 * time.Second})
+	case kind == "cloudfront" && rest != spec && rest != "":
+		return store.NewCloudFrontROStore(rest)
+	default:
+		log.Fatalf("origin spec is not recognized: '%s'", spec)
+	}
+	return nil
+}
+
+func wrapWithCache(s store.BlobStore, sqlDB db.DB) store.BlobStore {
 	wrapped := s
+	if circuitBreaker {
+		opts := store.CircuitBreakerOpts{Component: "reflector"}
+		if breakerFallback != "" {
+			opts.Fallback = originStore(breakerFallback)
+		}
+		wrapped = store.NewCircuitBreakerStore(wrapped, opts)
+	}
+	if hedge {
+		var alternate store.BlobStore
+		if hedgeAlternate != "" {
+			alternate = originStore(hedgeAlternate)
+		}
+		wrapped = store.NewHedgedStore(wrapped, alternate, store.HedgedOpts{
+			Percentile: hedgePercentile,
+			Component:  "reflector",
+		})
+	}
+	if verifyBlobs {
+		wrapped = store.NewVerifyingStore("reflector", wrapped, false, "")
+	}
 
-	diskCacheMaxSize, diskCachePath := diskCacheParams()
-	if diskCacheMaxSize > 0 {
-		err := os.MkdirAll(diskCachePath, os.ModePerm)
-		if err != nil {
-			log.Fatal(err)
+	diskCacheMaxSize, diskCachePaths := diskCacheParams()
+	if diskCacheMaxSize.set() {
+		for _, p := range diskCachePaths {
+			err := os.MkdirAll(p, os.ModePerm)
+			if err != nil {
+				log.Fatal(err)
+			}
 		}
-		wrapped = store.NewCachingStore(
+		wrapped = store.NewCachingStoreWithPolicy(
 			"reflector",
 			wrapped,
-			store.NewLRUStore("peer_server", store.NewDiskStore(diskCachePath, 2), diskCacheMaxSize),
+			verifyCache(compress(diskCacheMaxSize.lruStore("peer_server", diskCacheStore(diskCachePaths)))),
+			admissionPolicy(),
 		)
 	}
 
-	if reflectorCmdMemCache > 0 {
-		wrapped = store.NewCachingStore(
-			"reflector",
-			wrapped,
-			store.NewLRUStore("peer_server", store.NewMemStore(), reflectorCmdMemCache),
-		)
+	if reflectorCmdMemCache != "" {
+		memCacheMaxSize, err := parseCacheSize(reflectorCmdMemCache)
+		if err != nil {
+			log.Fatalf("--mem-cache: %s", err)
+		}
+		if memCacheMaxSize.set() {
+			wrapped = store.NewCachingStoreWithPolicy(
+				"reflector",
+				wrapped,
+				verifyCache(compress(memCacheMaxSize.lruStore("peer_server", store.NewMemStore()))),
+				admissionPolicy(),
+			)
+		}
+	}
+
+	if prefetchCount > 0 {
+		caching, ok := wrapped.(*store.CachingStore)
+		if !ok {
+			log.Fatal("--prefetch needs --disk-cache or --mem-cache")
+		}
+		opts := store.PrefetchOpts{Count: prefetchCount, Workers: prefetchWorkers}
+		if sqlDB != nil {
+			opts.Index = sqlDB
+		}
+		prefetchStore = store.NewPrefetchStore(caching, opts)
+		wrapped = prefetchStore
 	}
 
 	return wrapped
 }
 
-func diskCacheParams() (int, string) {
+// verifyCache wraps the cache so that corrupt blobs are deleted from it and fetched from the origin again
+func verifyCache(cache store.BlobStore) store.BlobStore {
+	if !verifyBlobs {
+		return cache
+	}
+	return store.NewVerifyingStore("peer_server", cache, true, quarantineDir)
+}
+
+// compress wraps the cache so blobs are compressed in it. It goes above the LRU, so the LRU limits the
+// compressed size.
+func compress(cache store.BlobStore) store.BlobStore {
+	if !compressCache {
+		return cache
+	}
+	return store.NewCompressedStore("peer_server", cache)
+}
+
+// admissionPolicy returns a new policy for each cache, so that caches don't share their history
+func admissionPolicy() store.AdmissionPolicy {
+	switch cachePolicy {
+	case "all":
+		return &store.AdmitAll{}
+	case "second-hit":
+		if cachePolicyHistory <= 0 {
+			log.Fatalf("--cache-policy-history must be more than 0")
+		}
+		return store.NewSecondHitPolicy(cachePolicyHistory)
+	default:
+		log.Fatalf("cache policy is not recognized: %s", cachePolicy)
+	}
+	return nil
+}
+
+func diskCacheParams() (cacheSize, []string) {
 	if reflectorCmdDiskCache == "" {
-		return 0, ""
+		return cacheSize{}, nil
 	}
 
 	parts := strings.Split(reflectorCmdDiskCache, ":")
 	if len(parts) != 2 {
-		log.Fatalf("--disk-cache must be a number, followed by ':', followed by a string")
+		log.Fatalf("--disk-cache must be a size, followed by ':', followed by a string")
 	}
 
-	maxSize := cast.ToInt(parts[0])
-	if maxSize <= 0 {
+	maxSize, err := parseCacheSize(parts[0])
+	if err != nil {
+		log.Fatalf("--disk-cache: %s", err)
+	}
+	if !maxSize.set() {
 		log.Fatalf("--disk-cache max size must be more than 0")
 	}
 
-	path := parts[1]
-	if len(path) == 0 || path[0] != '/' {
-		log.Fatalf("--disk-cache path must start with '/'")
+	paths := strings.Split(parts[1], ",")
+	for _, path := range paths {
+		if len(path) == 0 || path[0] != '/' {
+			log.Fatalf("--disk-cache paths must start with '/'")
+		}
+	}
+
+	return maxSize, paths
+}
+
+// diskCacheStore returns a disk store for the cache paths. Blobs are spread across the paths if there are several.
+func diskCacheStore(paths []string) store.BlobStore {
+	switch diskCacheBackend {
+	case "files":
+	case "segments":
+		if len(paths) != 1 {
+			log.Fatalf("--disk-cache-backend=segments only supports one disk cache path")
+		}
+		segmentStore = store.NewSegmentStore(paths[0], store.SegmentOpts{Fsync: diskCacheFsync})
+		err := segmentStore.Start()
+		if err != nil {
+			log.Fatalf("opening disk cache segments: %s", errors.FullTrace(err))
+		}
+		return segmentStore
+	default:
+		log.Fatalf("disk cache backend is not recognized: %s", diskCacheBackend)
+	}
+
+	if len(paths) == 1 {
+		diskStore := store.NewDiskStore(paths[0], 2)
+		diskStore.SetFsync(diskCacheFsync)
+		return diskStore
 	}
 
-	return maxSize, path
+	sharded := store.NewShardedDiskStore(paths, 2)
+	sharded.SetFsync(diskCacheFsync)
+	go func() {
+		moved, err := sharded.Rebalance()
+		if err != nil {
+			log.Errorf("rebalancing disk cache: %s", errors.FullTrace(err))
+		}
+		if moved > 0 {
+			log.Infof("rebalanced disk cache: moved %d blobs", moved)
+		}
+	}()
+	return sharded
+}
+
+// cacheSize is the max size of a cache, either as a number of blobs or as a number of bytes
+type cacheSize struct {
+	blobs int
+	bytes int64
+}
+
+func (c cacheSize) set() bool { return c.blobs > 0 || c.bytes > 0 }
+
+func (c cacheSize) lruStore(component string, s store.BlobStore) *store.LRUStore {
+	if c.bytes > 0 {
+		return store.NewSizedLRUStore(component, s, c.bytes)
+	}
+	return store.NewLRUStore(component, s, c.blobs)
+}
+
+var byteUnits = []struct {
+	suffix     string
+	multiplier int64
+}{ // longer suffixes first so "GB" is not matched as "B"
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// parseCacheSize parses a plain number as a number of blobs, and a number with a unit (e.g. 500GB) as a number of bytes
+func parseCacheSize(size string) (cacheSize, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	for _, u := range byteUnits {
+		if strings.HasSuffix(size, u.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(size, u.suffix)), 64)
+			if err != nil || n < 0 {
+				return cacheSize{}, errors.Err("invalid size '%s'", size)
+			}
+			return cacheSize{bytes: int64(n * float64(u.multiplier))}, nil
+		}
+	}
+
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 0 {
+		return cacheSize{}, errors.Err("size must be a number of blobs or a size with a unit like MB or GB, got '%s'", size)
+	}
+	return cacheSize{blobs: n}, nil
 }
@@ -9,8 +9,11 @@ import (
 	"github.com/lbryio/lbry.go/v2/dht"
 	"github.com/lbryio/lbry.go/v2/extras/errors"
 	"github.com/lbryio/lbry.go/v2/extras/util"
+	"github.com/irmf/reflector.go/db"
+	"github.com/irmf/reflector.go/store"
 	"github.com/irmf/reflector.go/updater"
 
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/johntdyer/slackrus"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -22,10 +25,20 @@ type Config struct {
 	AwsSecret    string `json:"aws_secret"`
 	BucketRegion string `json:"bucket_region"`
 	BucketName   string `json:"bucket_name"`
-	DBConn       string `json:"db_conn"`
+	DBConn       string `json:"db_conn"` // MySQL DSN, or 'bolt:PATH' to keep the db in a local file
 	SlackHookURL string `json:"slack_hook_url"`
 	UpdateBinURL string `json:"update_bin_url"`
 	UpdateCmd    string `json:"update_cmd"`
+
+	// for S3-compatible services like MinIO or Ceph RGW. see store.S3Opts
+	S3Endpoint           string `json:"s3_endpoint"`
+	S3PathStyle          bool   `json:"s3_path_style"`
+	S3StorageClass       string `json:"s3_storage_class"` // defaults to INTELLIGENT_TIERING. use STANDARD for most non-AWS services
+	S3KeyPrefix          string `json:"s3_key_prefix"`
+	S3PrefixLength       int    `json:"s3_prefix_length"`       // run s3-migrate-keys after changing this
+	S3LegacyKeyFallback  bool   `json:"s3_legacy_key_fallback"` // read blobs that s3-migrate-keys has not moved yet
+	S3CACert             string `json:"s3_ca_cert"`
+	S3InsecureSkipVerify bool   `json:"s3_insecure_skip_verify"`
 }
 
 var verbose []string
@@ -119,6 +132,44 @@ func preRun(cmd *cobra.Command, args []string) {
 	}
 }
 
+// newS3Store returns an S3 store configured from the global config
+func newS3Store() *store.S3Store {
+	return store.NewS3StoreWithOpts(s3Opts())
+}
+
+// s3Opts returns the S3 options from the global config
+func s3Opts() store.S3Opts {
+	storageClass := globalConfig.S3StorageClass
+	if storageClass == "" {
+		storageClass = s3.StorageClassIntelligentTiering
+	}
+	return store.S3Opts{
+		AwsID:              globalConfig.AwsID,
+		AwsSecret:          globalConfig.AwsSecret,
+		Region:             globalConfig.BucketRegion,
+		Bucket:             globalConfig.BucketName,
+		Endpoint:           globalConfig.S3Endpoint,
+		PathStyle:          globalConfig.S3PathStyle,
+		StorageClass:       storageClass,
+		KeyPrefix:          globalConfig.S3KeyPrefix,
+		PrefixLength:       globalConfig.S3PrefixLength,
+		LegacyKeyFallback:  globalConfig.S3LegacyKeyFallback,
+		CACertFile:         globalConfig.S3CACert,
+		InsecureSkipVerify: globalConfig.S3InsecureSkipVerify,
+	}
+}
+
+// connectDB connects to the db from the global config. A db_conn of 'bolt:PATH' uses an embedded db in
+// that file instead of MySQL.
+func connectDB(trackAccessTime bool) (db.DB, error) {
+	if strings.HasPrefix(globalConfig.DBConn, "bolt:") {
+		boltDB := &db.Bolt{TrackAccessTime: trackAccessTime}
+		return boltDB, boltDB.Connect(strings.TrimPrefix(globalConfig.DBConn, "bolt:"))
+	}
+	sqlDB := &db.SQL{TrackAccessTime: trackAccessTime}
+	return sqlDB, sqlDB.Connect(globalConfig.DBConn)
+}
+
 func checkErr(err error) {
 	if err != nil {
 		panic(err)
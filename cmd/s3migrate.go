@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var s3MigrateWorkers int
+var s3MigrateDryRun bool
+
+func init() {
+	var cmd = &cobra.Command{
+		Use:   "s3-migrate-keys",
+		Short: "Move the blobs in the S3 bucket to the key layout set by s3_prefix_length in the config",
+		Args:  cobra.NoArgs,
+		Run:   s3MigrateCmd,
+	}
+	cmd.Flags().IntVar(&s3MigrateWorkers, "workers", 10, "how many blobs to move at once")
+	cmd.Flags().BoolVar(&s3MigrateDryRun, "dry-run", false, "count the blobs that would be moved without moving them")
+	rootCmd.AddCommand(cmd)
+}
+
+func s3MigrateCmd(cmd *cobra.Command, args []string) {
+	summary, err := newS3Store().MigrateKeys(s3MigrateWorkers, s3MigrateDryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(out))
+}
@@ -10,7 +10,6 @@ import (
 	"github.com/lbryio/lbry.go/v2/dht"
 	"github.com/lbryio/lbry.go/v2/dht/bits"
 	"github.com/irmf/reflector.go/cluster"
-	"github.com/irmf/reflector.go/db"
 	"github.com/irmf/reflector.go/peer"
 	"github.com/irmf/reflector.go/prism"
 	"github.com/irmf/reflector.go/reflector"
@@ -52,10 +51,9 @@ func init() {
 }
 
 func startCmd(cmd *cobra.Command, args []string) {
-	db := new(db.SQL)
-	err := db.Connect(globalConfig.DBConn)
+	db, err := connectDB(false)
 	checkErr(err)
-	s3 := store.NewS3Store(globalConfig.AwsID, globalConfig.AwsSecret, globalConfig.BucketRegion, globalConfig.BucketName)
+	s3 := newS3Store()
 	comboStore := store.NewDBBackedStore(s3, db)
 
 	conf := prism.DefaultConf()
@@ -5,7 +5,6 @@ import (
 	"os/signal"
 	"syscall"
 
-	"github.com/irmf/reflector.go/db"
 	"github.com/irmf/reflector.go/reflector"
 	"github.com/irmf/reflector.go/store"
 
@@ -30,12 +29,11 @@ func init() {
 }
 
 func uploadCmd(cmd *cobra.Command, args []string) {
-	db := new(db.SQL)
-	err := db.Connect(globalConfig.DBConn)
+	db, err := connectDB(false)
 	checkErr(err)
 
 	st := store.NewDBBackedStore(
-		store.NewS3Store(globalConfig.AwsID, globalConfig.AwsSecret, globalConfig.BucketRegion, globalConfig.BucketName),
+		newS3Store(),
 		db)
 
 	uploader := reflector.NewUploader(db, st, uploadWorkers, uploadSkipExistsCheck, uploadDeleteBlobsAfterUpload)
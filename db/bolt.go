@@ -0,0 +1,664 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bolt implements the DB interface with an embedded key-value store in a single file, so edge nodes and
+// tests can run without a MySQL server. It keeps the same data as the SQL schema:
+//
+//	blob:          hash -> boltBlob
+//	stream:        sd hash -> boltStream
+//	stream_blob:   content hash + sd hash -> num, to find the streams of a content blob
+//	stream_access: last access time + stream id -> sd hash, to find streams by access time
+//	blocked:       hash -> nothing
+type Bolt struct {
+	db *bolt.DB
+
+	TrackAccessTime bool
+}
+
+var (
+	boltBlobBucket         = []byte("blob")
+	boltStreamBucket       = []byte("stream")
+	boltStreamBlobBucket   = []byte("stream_blob")
+	boltStreamAccessBucket = []byte("stream_access")
+	boltBlockedBucket      = []byte("blocked")
+)
+
+type boltBlob struct {
+	Stored bool `json:"stored"`
+	Length int  `json:"length"`
+}
+
+type boltStream struct {
+	ID   uint64 `json:"id"`
+	Hash string `json:"hash"`
+	// unix nanoseconds, 0 if never accessed
+	LastAccessedAt int64            `json:"last_accessed_at"`
+	Blobs          []boltStreamBlob `json:"blobs"`
+}
+
+type boltStreamBlob struct {
+	Hash string `json:"hash"`
+	Num  int    `json:"num"`
+}
+
+// Connect opens the db file, creating it if it doesn't exist
+func (b *Bolt) Connect(path string) error {
+	var err error
+	b.db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return errors.Err(err)
+	}
+
+	return errors.Err(b.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltBlobBucket, boltStreamBucket, boltStreamBlobBucket, boltStreamAccessBucket, boltBlockedBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+// Close closes the db file
+func (b *Bolt) Close() error {
+	if b.db == nil {
+		return nil
+	}
+	return errors.Err(b.db.Close())
+}
+
+// AddBlob adds a blob to the database.
+func (b *Bolt) AddBlob(hash string, length int, isStored bool) error {
+	if b.db == nil {
+		return errors.Err("not connected")
+	}
+	return errors.Err(b.db.Update(func(tx *bolt.Tx) error {
+		return b.putBlob(tx, hash, length, isStored)
+	}))
+}
+
+func (b *Bolt) putBlob(tx *bolt.Tx, hash string, length int, isStored bool) error {
+	if length <= 0 {
+		return errors.Err("length must be positive")
+	}
+
+	blob := boltBlob{Stored: isStored, Length: length}
+	existing, ok, err := getBlob(tx, hash)
+	if err != nil {
+		return err
+	}
+	if ok {
+		// same as the SQL upsert, only is_stored changes
+		blob = existing
+		blob.Stored = blob.Stored || isStored
+	}
+	return put(tx.Bucket(boltBlobBucket), []byte(hash), blob)
+}
+
+// AddSDBlob insert the SD blob and all the content blobs. The content blobs are marked as "not stored",
+// but they are tracked so reflector knows what it is missing.
+func (b *Bolt) AddSDBlob(sdHash string, sdBlobLength int, sdBlob SdBlob) error {
+	if b.db == nil {
+		return errors.Err("not connected")
+	}
+
+	return errors.Err(b.db.Update(func(tx *bolt.Tx) error {
+		err := b.putBlob(tx, sdHash, sdBlobLength, true)
+		if err != nil {
+			return err
+		}
+
+		stream, ok, err := getStream(tx, sdHash)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			id, err := tx.Bucket(boltStreamBucket).NextSequence()
+			if err != nil {
+				return err
+			}
+			stream = boltStream{ID: id, Hash: sdBlob.StreamHash}
+			err = setAccessTime(tx, sdHash, &stream, time.Now())
+			if err != nil {
+				return err
+			}
+		} else if b.TrackAccessTime {
+			err = setAccessTime(tx, sdHash, &stream, time.Now())
+			if err != nil {
+				return err
+			}
+		}
+
+		streamBlobs := tx.Bucket(boltStreamBlobBucket)
+		for _, contentBlob := range sdBlob.Blobs {
+			if contentBlob.BlobHash == "" {
+				// null terminator blob
+				continue
+			}
+
+			err := b.putBlob(tx, contentBlob.BlobHash, contentBlob.Length, false)
+			if err != nil {
+				return err
+			}
+
+			key := streamBlobKey(contentBlob.BlobHash, sdHash)
+			if streamBlobs.Get(key) != nil {
+				continue // already in the stream
+			}
+			err = streamBlobs.Put(key, encodeNum(contentBlob.BlobNum))
+			if err != nil {
+				return err
+			}
+			stream.Blobs = append(stream.Blobs, boltStreamBlob{Hash: contentBlob.BlobHash, Num: contentBlob.BlobNum})
+		}
+
+		return put(tx.Bucket(boltStreamBucket), []byte(sdHash), stream)
+	}))
+}
+
+// HasBlob checks if the database contains the blob information.
+func (b *Bolt) HasBlob(hash string) (bool, error) {
+	return b.HasBlobContext(context.Background(), hash)
+}
+
+// HasBlobContext is HasBlob with a context
+func (b *Bolt) HasBlobContext(ctx context.Context, hash string) (bool, error) {
+	exists, err := b.HasBlobsContext(ctx, []string{hash})
+	if err != nil {
+		return false, err
+	}
+	return exists[hash], nil
+}
+
+// HasBlobs checks if the database contains the set of blobs and returns a bool map.
+func (b *Bolt) HasBlobs(hashes []string) (map[string]bool, error) {
+	return b.HasBlobsContext(context.Background(), hashes)
+}
+
+// HasBlobsContext is HasBlobs with a context
+func (b *Bolt) HasBlobsContext(ctx context.Context, hashes []string) (map[string]bool, error) {
+	if b.db == nil {
+		return nil, errors.Err("not connected")
+	}
+
+	exists := make(map[string]bool)
+	var needsTouch []string
+	touchDeadline := time.Now().AddDate(0, 0, -1).UnixNano() // touch stream if last accessed before this time
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		for _, hash := range hashes {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			blob, ok, err := getBlob(tx, hash)
+			if err != nil {
+				return err
+			}
+			if !ok || !blob.Stored {
+				continue
+			}
+
+			exists[hash] = true
+			streams, err := streamsOf(tx, hash)
+			if err != nil {
+				return err
+			}
+			for sdHash, stream := range streams {
+				if b.TrackAccessTime && stream.LastAccessedAt < touchDeadline {
+					needsTouch = append(needsTouch, sdHash)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	err = b.touch(needsTouch)
+	if err != nil {
+		log.Errorf("touching streams: %s", errors.FullTrace(err))
+	}
+	return exists, nil
+}
+
+func (b *Bolt) touch(sdHashes []string) error {
+	if len(sdHashes) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	return errors.Err(b.db.Update(func(tx *bolt.Tx) error {
+		for _, sdHash := range sdHashes {
+			stream, ok, err := getStream(tx, sdHash)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			err = setAccessTime(tx, sdHash, &stream, now)
+			if err != nil {
+				return err
+			}
+			err = put(tx.Bucket(boltStreamBucket), []byte(sdHash), stream)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+// Delete will remove the blob from the db
+func (b *Bolt) Delete(hash string) error {
+	if b.db == nil {
+		return errors.Err("not connected")
+	}
+
+	return errors.Err(b.db.Update(func(tx *bolt.Tx) error {
+		streamBlobs := tx.Bucket(boltStreamBlobBucket)
+
+		// the stream of an sd blob goes with it
+		stream, ok, err := getStream(tx, hash)
+		if err != nil {
+			return err
+		}
+		if ok {
+			for _, blob := range stream.Blobs {
+				err = streamBlobs.Delete(streamBlobKey(blob.Hash, hash))
+				if err != nil {
+					return err
+				}
+			}
+			if stream.LastAccessedAt != 0 {
+				err = tx.Bucket(boltStreamAccessBucket).Delete(accessKey(stream.LastAccessedAt, stream.ID))
+				if err != nil {
+					return err
+				}
+			}
+			err = tx.Bucket(boltStreamBucket).Delete([]byte(hash))
+			if err != nil {
+				return err
+			}
+		}
+
+		// and a content blob is removed from its streams
+		var sdHashes []string
+		prefix := []byte(hash)
+		c := streamBlobs.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			sdHashes = append(sdHashes, string(k[len(prefix):]))
+		}
+		for _, sdHash := range sdHashes {
+			err = streamBlobs.Delete(streamBlobKey(hash, sdHash))
+			if err != nil {
+				return err
+			}
+			stream, ok, err := getStream(tx, sdHash)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			for i := range stream.Blobs {
+				if stream.Blobs[i].Hash == hash {
+					stream.Blobs = append(stream.Blobs[:i], stream.Blobs[i+1:]...)
+					break
+				}
+			}
+			err = put(tx.Bucket(boltStreamBucket), []byte(sdHash), stream)
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(boltBlobBucket).Delete([]byte(hash))
+	}))
+}
+
+// Block will mark a blob as blocked
+func (b *Bolt) Block(hash string) error {
+	if b.db == nil {
+		return errors.Err("not connected")
+	}
+	return errors.Err(b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBlockedBucket).Put([]byte(hash), []byte{})
+	}))
+}
+
+// GetBlocked will return a list of blocked hashes
+func (b *Bolt) GetBlocked() (map[string]bool, error) {
+	if b.db == nil {
+		return nil, errors.Err("not connected")
+	}
+
+	blocked := make(map[string]bool)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBlockedBucket).ForEach(func(k, _ []byte) error {
+			blocked[string(k)] = true
+			return nil
+		})
+	})
+	return blocked, errors.Err(err)
+}
+
+// MissingBlobsForKnownStream returns missing blobs for an existing stream
+// WARNING: if the stream does NOT exist, no blob hashes will be returned, which looks
+// like no blobs are missing
+func (b *Bolt) MissingBlobsForKnownStream(sdHash string) ([]string, error) {
+	if b.db == nil {
+		return nil, errors.Err("not connected")
+	}
+
+	var missingBlobs []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		stream, ok, err := getStream(tx, sdHash)
+		if err != nil || !ok {
+			return err
+		}
+		for _, sb := range stream.Blobs {
+			blob, ok, err := getBlob(tx, sb.Hash)
+			if err != nil {
+				return err
+			}
+			if ok && !blob.Stored {
+				missingBlobs = append(missingBlobs, sb.Hash)
+			}
+		}
+		return nil
+	})
+	return missingBlobs, errors.Err(err)
+}
+
+// NextBlobs returns the hashes of up to n content blobs that come after the blob in its stream, in order.
+// If the hash is an sd blob, the first n content blobs of its stream are returned.
+func (b *Bolt) NextBlobs(hash string, n int) ([]string, error) {
+	if b.db == nil {
+		return nil, errors.Err("not connected")
+	}
+
+	var next []boltStreamBlob
+	err := b.db.View(func(tx *bolt.Tx) error {
+		// the position of the blob in each stream it's in
+		positions := make(map[string]int)
+		if _, ok, err := getStream(tx, hash); err != nil {
+			return err
+		} else if ok {
+			positions[hash] = -1
+		}
+		prefix := []byte(hash)
+		c := tx.Bucket(boltStreamBlobBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			positions[string(k[len(prefix):])] = decodeNum(v)
+		}
+
+		for sdHash, num := range positions {
+			stream, ok, err := getStream(tx, sdHash)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			for _, sb := range stream.Blobs {
+				if sb.Num > num {
+					next = append(next, sb)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	sort.SliceStable(next, func(i, j int) bool { return next[i].Num < next[j].Num })
+	if len(next) > n {
+		next = next[:n]
+	}
+	hashes := make([]string, 0, len(next))
+	for _, sb := range next {
+		hashes = append(hashes, sb.Hash)
+	}
+	return hashes, nil
+}
+
+// StaleBlobs returns the stored blobs of up to limit streams that were last accessed before the given
+// time, starting after the cursor. See SQL.StaleBlobs.
+func (b *Bolt) StaleBlobs(before time.Time, after AccessCursor, limit int) ([]string, AccessCursor, error) {
+	if b.db == nil {
+		return nil, after, errors.Err("not connected")
+	}
+
+	next := after
+	var hashes []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var start []byte
+		if !after.LastAccessedAt.IsZero() {
+			start = accessKey(after.LastAccessedAt.UnixNano(), after.StreamID)
+		}
+		end := before.UnixNano()
+
+		c := tx.Bucket(boltStreamAccessBucket).Cursor()
+		k, v := c.First()
+		if start != nil {
+			k, v = c.Seek(start)
+			if bytes.Equal(k, start) {
+				k, v = c.Next()
+			}
+		}
+		for streams := 0; k != nil && streams < limit; k, v = c.Next() {
+			accessed := int64(binary.BigEndian.Uint64(k[:8]))
+			if accessed >= end {
+				break
+			}
+			streams++
+			next = AccessCursor{LastAccessedAt: time.Unix(0, accessed), StreamID: binary.BigEndian.Uint64(k[8:])}
+
+			stream, ok, err := getStream(tx, string(v))
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			hashes = append(hashes, string(v))
+			for _, sb := range stream.Blobs {
+				blob, ok, err := getBlob(tx, sb.Hash)
+				if err != nil {
+					return err
+				}
+				if ok && blob.Stored {
+					hashes = append(hashes, sb.Hash)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, after, errors.Err(err)
+	}
+	return hashes, next, nil
+}
+
+// GetHashRange gets the smallest and biggest hashes in the db
+func (b *Bolt) GetHashRange() (string, string, error) {
+	if b.db == nil {
+		return "", "", errors.Err("not connected")
+	}
+
+	var min, max string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBlobBucket).Cursor()
+		first, _ := c.First()
+		last, _ := c.Last()
+		if first == nil {
+			return errors.Err("there are no blobs")
+		}
+		min, max = string(first), string(last)
+		return nil
+	})
+	return min, max, errors.Err(err)
+}
+
+// GetStoredHashesInRange gets stored blobs with hashes in a given range, and sends the hashes into a channel
+func (b *Bolt) GetStoredHashesInRange(ctx context.Context, start, end bits.Bitmap) (ch chan bits.Bitmap, ech chan error) {
+	ch = make(chan bits.Bitmap)
+	ech = make(chan error)
+
+	go func() {
+		defer close(ch)
+		defer close(ech)
+
+		if b.db == nil {
+			ech <- errors.Err("not connected")
+			return
+		}
+
+		// read in batches so a slow reader doesn't keep a transaction open
+		from, to := []byte(start.Hex()), []byte(end.Hex())
+		for {
+			var batch []string
+			err := b.db.View(func(tx *bolt.Tx) error {
+				c := tx.Bucket(boltBlobBucket).Cursor()
+				for k, v := c.Seek(from); k != nil && bytes.Compare(k, to) <= 0 && len(batch) < 1000; k, v = c.Next() {
+					var blob boltBlob
+					err := json.Unmarshal(v, &blob)
+					if err != nil {
+						return err
+					}
+					if blob.Stored {
+						batch = append(batch, string(k))
+					}
+					from = append(append([]byte{}, k...), 0) // the next key after k
+				}
+				return nil
+			})
+			if err != nil {
+				ech <- errors.Err(err)
+				return
+			}
+			if len(batch) == 0 {
+				return
+			}
+
+			for _, hash := range batch {
+				select {
+				case <-ctx.Done():
+					return
+				case ch <- bits.FromHexP(hash):
+				}
+			}
+		}
+	}()
+
+	return
+}
+
+func getBlob(tx *bolt.Tx, hash string) (boltBlob, bool, error) {
+	var blob boltBlob
+	ok, err := get(tx.Bucket(boltBlobBucket), []byte(hash), &blob)
+	return blob, ok, err
+}
+
+func getStream(tx *bolt.Tx, sdHash string) (boltStream, bool, error) {
+	var stream boltStream
+	ok, err := get(tx.Bucket(boltStreamBucket), []byte(sdHash), &stream)
+	return stream, ok, err
+}
+
+// streamsOf returns the streams that the blob is the sd blob or a content blob of, by sd hash
+func streamsOf(tx *bolt.Tx, hash string) (map[string]boltStream, error) {
+	streams := make(map[string]boltStream)
+	stream, ok, err := getStream(tx, hash)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		streams[hash] = stream
+	}
+
+	prefix := []byte(hash)
+	c := tx.Bucket(boltStreamBlobBucket).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		sdHash := string(k[len(prefix):])
+		stream, ok, err := getStream(tx, sdHash)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			streams[sdHash] = stream
+		}
+	}
+	return streams, nil
+}
+
+// setAccessTime sets when the stream was last accessed and moves it in the access index. The stream itself
+// is not saved.
+func setAccessTime(tx *bolt.Tx, sdHash string, stream *boltStream, t time.Time) error {
+	access := tx.Bucket(boltStreamAccessBucket)
+	if stream.LastAccessedAt != 0 {
+		err := access.Delete(accessKey(stream.LastAccessedAt, stream.ID))
+		if err != nil {
+			return err
+		}
+	}
+	stream.LastAccessedAt = t.UnixNano()
+	return access.Put(accessKey(stream.LastAccessedAt, stream.ID), []byte(sdHash))
+}
+
+func get(bucket *bolt.Bucket, key []byte, v interface{}) (bool, error) {
+	b := bucket.Get(key)
+	if b == nil {
+		return false, nil
+	}
+	return true, errors.Err(json.Unmarshal(b, v))
+}
+
+func put(bucket *bolt.Bucket, key []byte, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return errors.Err(err)
+	}
+	return bucket.Put(key, b)
+}
+
+func streamBlobKey(hash, sdHash string) []byte {
+	return []byte(hash + sdHash)
+}
+
+// accessKey sorts by access time, then stream id
+func accessKey(accessed int64, streamID uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k[:8], uint64(accessed))
+	binary.BigEndian.PutUint64(k[8:], streamID)
+	return k
+}
+
+func encodeNum(num int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(int64(num)))
+	return b
+}
+
+func decodeNum(b []byte) int {
+	return int(int64(binary.BigEndian.Uint64(b)))
+}
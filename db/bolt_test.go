@@ -0,0 +1,138 @@
+package db
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/dht/bits"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testHash(c byte) string {
+	return strings.Repeat(string(c), 96)
+}
+
+func testSdBlob(streamHash string, hashes ...string) SdBlob {
+	sd := SdBlob{StreamHash: streamHash}
+	for i, h := range append(hashes, "") {
+		sd.Blobs = append(sd.Blobs, struct {
+			Length   int    `json:"length"`
+			BlobNum  int    `json:"blob_num"`
+			BlobHash string `json:"blob_hash,omitempty"`
+			IV       string `json:"iv"`
+		}{Length: 100, BlobNum: i, BlobHash: h})
+	}
+	return sd
+}
+
+func testBolt(t testing.TB) (*Bolt, func()) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	b := &Bolt{}
+	require.NoError(t, b.Connect(path.Join(tmpDir, "reflector.db")))
+	return b, func() {
+		_ = b.Close()
+		_ = os.RemoveAll(tmpDir)
+	}
+}
+
+func TestBolt_Streams(t *testing.T) {
+	b, cleanup := testBolt(t)
+	defer cleanup()
+
+	sdHash, blob1, blob2, blob3 := testHash('a'), testHash('1'), testHash('2'), testHash('3')
+	require.NoError(t, b.AddSDBlob(sdHash, 500, testSdBlob(testHash('f'), blob1, blob2, blob3)))
+	require.NoError(t, b.AddBlob(blob2, 100, true))
+
+	exists, err := b.HasBlobs([]string{sdHash, blob1, blob2, blob3})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{sdHash: true, blob2: true}, exists)
+
+	missing, err := b.MissingBlobsForKnownStream(sdHash)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{blob1, blob3}, missing)
+
+	next, err := b.NextBlobs(sdHash, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{blob1, blob2}, next)
+	next, err = b.NextBlobs(blob2, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{blob3}, next)
+
+	min, max, err := b.GetHashRange()
+	require.NoError(t, err)
+	assert.Equal(t, blob1, min)
+	assert.Equal(t, sdHash, max)
+
+	// deleting the sd blob deletes the stream, but not the content blobs
+	require.NoError(t, b.Delete(sdHash))
+	exists, err = b.HasBlobs([]string{sdHash, blob2})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{blob2: true}, exists)
+	missing, err = b.MissingBlobsForKnownStream(sdHash)
+	require.NoError(t, err)
+	assert.Empty(t, missing)
+}
+
+func TestBolt_Blocked(t *testing.T) {
+	b, cleanup := testBolt(t)
+	defer cleanup()
+
+	require.NoError(t, b.Block(testHash('a')))
+	require.NoError(t, b.Block(testHash('a')))
+	require.NoError(t, b.Block(testHash('b')))
+
+	blocked, err := b.GetBlocked()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{testHash('a'): true, testHash('b'): true}, blocked)
+}
+
+func TestBolt_StaleBlobs(t *testing.T) {
+	b, cleanup := testBolt(t)
+	defer cleanup()
+
+	require.NoError(t, b.AddSDBlob(testHash('a'), 500, testSdBlob(testHash('f'), testHash('1'))))
+	require.NoError(t, b.AddBlob(testHash('1'), 100, true))
+	require.NoError(t, b.AddSDBlob(testHash('b'), 500, testSdBlob(testHash('e'), testHash('2'))))
+
+	hashes, cursor, err := b.StaleBlobs(time.Now().Add(time.Hour), AccessCursor{}, 1)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{testHash('a'), testHash('1')}, hashes)
+
+	// content blobs that are not stored are left out
+	hashes, cursor, err = b.StaleBlobs(time.Now().Add(time.Hour), cursor, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{testHash('b')}, hashes)
+
+	hashes, _, err = b.StaleBlobs(time.Now().Add(time.Hour), cursor, 1)
+	require.NoError(t, err)
+	assert.Empty(t, hashes)
+
+	hashes, _, err = b.StaleBlobs(time.Now().Add(-time.Hour), AccessCursor{}, 10)
+	require.NoError(t, err)
+	assert.Empty(t, hashes)
+}
+
+func TestBolt_GetStoredHashesInRange(t *testing.T) {
+	b, cleanup := testBolt(t)
+	defer cleanup()
+
+	for _, c := range []byte("1234") {
+		require.NoError(t, b.AddBlob(testHash(c), 100, c != '3'))
+	}
+
+	ch, ech := b.GetStoredHashesInRange(context.Background(), bits.FromHexP(testHash('2')), bits.FromHexP(testHash('4')))
+	var hashes []string
+	for h := range ch {
+		hashes = append(hashes, h.Hex())
+	}
+	require.NoError(t, <-ech)
+	assert.Equal(t, []string{testHash('2'), testHash('4')}, hashes)
+}
@@ -3,6 +3,7 @@ package db
 import (
 	"context"
 	"database/sql"
+	"sort"
 	"time"
 
 	"github.com/lbryio/lbry.go/v2/dht/bits"
@@ -30,11 +31,35 @@ type SdBlob struct {
 	StreamHash        string `json:"stream_hash"`
 }
 
+// DB tracks which blobs and streams are stored, and which blobs are blocked. SQL keeps them in MySQL, and
+// Bolt keeps them in a local file for setups without a database server.
+type DB interface {
+	// AddBlob adds a blob. A blob that is already stored stays stored.
+	AddBlob(hash string, length int, isStored bool) error
+	// AddSDBlob adds the sd blob and its stream. The content blobs are added as not stored.
+	AddSDBlob(sdHash string, sdBlobLength int, sdBlob SdBlob) error
+	HasBlob(hash string) (bool, error)
+	HasBlobContext(ctx context.Context, hash string) (bool, error)
+	HasBlobs(hashes []string) (map[string]bool, error)
+	HasBlobsContext(ctx context.Context, hashes []string) (map[string]bool, error)
+	// Delete removes the blob, and its stream if it's an sd blob
+	Delete(hash string) error
+	Block(hash string) error
+	GetBlocked() (map[string]bool, error)
+	MissingBlobsForKnownStream(sdHash string) ([]string, error)
+	NextBlobs(hash string, n int) ([]string, error)
+	StaleBlobs(before time.Time, after AccessCursor, limit int) ([]string, AccessCursor, error)
+	GetHashRange() (string, string, error)
+	GetStoredHashesInRange(ctx context.Context, start, end bits.Bitmap) (ch chan bits.Bitmap, ech chan error)
+}
+
 // SQL implements the DB interface
 type SQL struct {
 	conn *sql.DB
 
 	TrackAccessTime bool
+	// connect even if the schema is not at the version this binary needs. only for running migrations
+	SkipSchemaCheck bool
 }
 
 func logQuery(query string, args ...interface{}) {
@@ -46,7 +71,7 @@ func logQuery(query string, args ...interface{}) {
 	}
 }
 
-// Connect will create a connection to the database
+// Connect will create a connection to the database. It fails if the schema needs to be migrated first.
 func (s *SQL) Connect(dsn string) error {
 	var err error
 	// interpolateParams is necessary. otherwise uploading a stream with thousands of blobs
@@ -60,7 +85,15 @@ func (s *SQL) Connect(dsn string) error {
 
 	s.conn.SetMaxIdleConns(12)
 
-	return errors.Err(s.conn.Ping())
+	err = s.conn.Ping()
+	if err != nil {
+		return errors.Err(err)
+	}
+
+	if s.SkipSchemaCheck {
+		return nil
+	}
+	return s.checkSchema()
 }
 
 // AddBlob adds a blob to the database.
@@ -69,17 +102,17 @@ func (s *SQL) AddBlob(hash string, length int, isStored bool) error {
 		return errors.Err("not connected")
 	}
 
-	_, err := s.insertBlob(hash, length, isStored)
+	_, err := insertBlob(s.conn, hash, length, isStored)
 	return err
 }
 
-func (s *SQL) insertBlob(hash string, length int, isStored bool) (int64, error) {
+func insertBlob(q querier, hash string, length int, isStored bool) (int64, error) {
 	if length <= 0 {
 		return 0, errors.Err("length must be positive")
 	}
 
 	args := []interface{}{hash, isStored, length}
-	blobID, err := s.exec(
+	blobID, err := exec(q,
 		"INSERT INTO blob_ (hash, is_stored, length) VALUES ("+qt.Qs(len(args))+") ON DUPLICATE KEY UPDATE is_stored = (is_stored or VALUES(is_stored))",
 		args...,
 	)
@@ -88,7 +121,7 @@ func (s *SQL) insertBlob(hash string, length int, isStored bool) (int64, error)
 	}
 
 	if blobID == 0 {
-		err = s.conn.QueryRow("SELECT id FROM blob_ WHERE hash = ?", hash).Scan(&blobID)
+		err = q.QueryRow("SELECT id FROM blob_ WHERE hash = ?", hash).Scan(&blobID)
 		if err != nil {
 			return 0, errors.Err(err)
 		}
@@ -100,9 +133,9 @@ func (s *SQL) insertBlob(hash string, length int, isStored bool) (int64, error)
 	return blobID, nil
 }
 
-func (s *SQL) insertStream(hash string, sdBlobID int64) (int64, error) {
+func (s *SQL) insertStream(q querier, hash string, sdBlobID int64) (int64, error) {
 	args := []interface{}{hash, sdBlobID, time.Now()}
-	streamID, err := s.exec(
+	streamID, err := exec(q,
 		"INSERT IGNORE INTO stream (hash, sd_blob_id, last_accessed_at) VALUES ("+qt.Qs(len(args))+")",
 		args...,
 	)
@@ -111,7 +144,7 @@ func (s *SQL) insertStream(hash string, sdBlobID int64) (int64, error) {
 	}
 
 	if streamID == 0 {
-		err = s.conn.QueryRow("SELECT id FROM stream WHERE sd_blob_id = ?", sdBlobID).Scan(&streamID)
+		err = q.QueryRow("SELECT id FROM stream WHERE sd_blob_id = ?", sdBlobID).Scan(&streamID)
 		if err != nil {
 			return 0, errors.Err(err)
 		}
@@ -120,7 +153,7 @@ func (s *SQL) insertStream(hash string, sdBlobID int64) (int64, error) {
 		}
 
 		if s.TrackAccessTime {
-			err := s.touch([]uint64{uint64(streamID)})
+			err := touch(q, []uint64{uint64(streamID)})
 			if err != nil {
 				return 0, errors.Err(err)
 			}
@@ -131,7 +164,12 @@ func (s *SQL) insertStream(hash string, sdBlobID int64) (int64, error) {
 
 // HasBlob checks if the database contains the blob information.
 func (s *SQL) HasBlob(hash string) (bool, error) {
-	exists, err := s.HasBlobs([]string{hash})
+	return s.HasBlobContext(context.Background(), hash)
+}
+
+// HasBlobContext is HasBlob with a context
+func (s *SQL) HasBlobContext(ctx context.Context, hash string) (bool, error) {
+	exists, err := s.HasBlobsContext(ctx, []string{hash})
 	if err != nil {
 		return false, err
 	}
@@ -140,12 +178,17 @@ func (s *SQL) HasBlob(hash string) (bool, error) {
 
 // HasBlobs checks if the database contains the set of blobs and returns a bool map.
 func (s *SQL) HasBlobs(hashes []string) (map[string]bool, error) {
-	exists, streamsNeedingTouch, err := s.hasBlobs(hashes)
-	s.touch(streamsNeedingTouch)
+	return s.HasBlobsContext(context.Background(), hashes)
+}
+
+// HasBlobsContext is HasBlobs with a context
+func (s *SQL) HasBlobsContext(ctx context.Context, hashes []string) (map[string]bool, error) {
+	exists, streamsNeedingTouch, err := s.hasBlobs(ctx, hashes)
+	touch(s.conn, streamsNeedingTouch)
 	return exists, err
 }
 
-func (s *SQL) touch(streamIDs []uint64) error {
+func touch(q querier, streamIDs []uint64) error {
 	if len(streamIDs) == 0 {
 		return nil
 	}
@@ -158,19 +201,19 @@ func (s *SQL) touch(streamIDs []uint64) error {
 	}
 
 	startTime := time.Now()
-	_, err := s.exec(query, args...)
+	_, err := exec(q, query, args...)
 	log.Debugf("stream access query touched %d streams and took %s", len(streamIDs), time.Since(startTime))
 	return errors.Err(err)
 }
 
-func (s *SQL) hasBlobs(hashes []string) (map[string]bool, []uint64, error) {
+func (s *SQL) hasBlobs(ctx context.Context, hashes []string) (map[string]bool, []uint64, error) {
 	if s.conn == nil {
 		return nil, nil, errors.Err("not connected")
 	}
 
 	var (
 		hash           string
-		streamID       uint64
+		streamID       null.Uint64
 		lastAccessedAt null.Time
 	)
 
@@ -189,24 +232,32 @@ func (s *SQL) hasBlobs(hashes []string) (map[string]bool, []uint64, error) {
 		log.Debugf("getting hashes[%d:%d] of %d", doneIndex, sliceEnd, len(hashes))
 		batch := hashes[doneIndex:sliceEnd]
 
-		// TODO: this query doesn't work for SD blobs, which are not in the stream_blob table
-
+		// a stored blob exists whether or not it's in a stream. the streams it's in are returned so they can
+		// be touched. the first part finds the streams of content blobs, and returns a row without a stream
+		// for blobs that are not content blobs. the second part finds the streams of sd blobs
 		query := `SELECT b.hash, s.id, s.last_accessed_at
 FROM blob_ b
 LEFT JOIN stream_blob sb ON b.id = sb.blob_id
-INNER JOIN stream s on (sb.stream_id = s.id or s.sd_blob_id = b.id)
-WHERE b.is_stored = ? and b.hash IN (` + qt.Qs(len(batch)) + `)`
-		args := make([]interface{}, len(batch)+1)
-		args[0] = true
-		for i := range batch {
-			args[i+1] = batch[i]
+LEFT JOIN stream s ON sb.stream_id = s.id
+WHERE b.is_stored = ? AND b.hash IN (` + qt.Qs(len(batch)) + `)
+UNION ALL
+SELECT b.hash, s.id, s.last_accessed_at
+FROM blob_ b
+INNER JOIN stream s ON s.sd_blob_id = b.id
+WHERE b.is_stored = ? AND b.hash IN (` + qt.Qs(len(batch)) + `)`
+		args := make([]interface{}, 0, 2*len(batch)+2)
+		for i := 0; i < 2; i++ {
+			args = append(args, true)
+			for _, h := range batch {
+				args = append(args, h)
+			}
 		}
 
 		logQuery(query, args...)
 
 		err := func() error {
 			startTime := time.Now()
-			rows, err := s.conn.Query(query, args...)
+			rows, err := s.conn.QueryContext(ctx, query, args...)
 			log.Debugf("hashes query took %s", time.Since(startTime))
 			if err != nil {
 				return errors.Err(err)
@@ -219,8 +270,8 @@ WHERE b.is_stored = ? and b.hash IN (` + qt.Qs(len(batch)) + `)`
 					return errors.Err(err)
 				}
 				exists[hash] = true
-				if s.TrackAccessTime && (!lastAccessedAt.Valid || lastAccessedAt.Time.Before(touchDeadline)) {
-					needsTouch = append(needsTouch, streamID)
+				if s.TrackAccessTime && streamID.Valid && (!lastAccessedAt.Valid || lastAccessedAt.Time.Before(touchDeadline)) {
+					needsTouch = append(needsTouch, streamID.Uint64)
 				}
 			}
 
@@ -240,6 +291,82 @@ WHERE b.is_stored = ? and b.hash IN (` + qt.Qs(len(batch)) + `)`
 	return exists, needsTouch, nil
 }
 
+// AccessCursor is a position in the list of streams ordered by last access time
+type AccessCursor struct {
+	LastAccessedAt time.Time
+	StreamID       uint64
+}
+
+// StaleBlobs returns the stored blobs of up to limit streams that were last accessed before the given
+// time, starting after the cursor. Streams that were never accessed since access tracking was enabled are
+// skipped. It also returns the cursor to pass to the next call, which is the same as after if there are
+// no more streams.
+func (s *SQL) StaleBlobs(before time.Time, after AccessCursor, limit int) ([]string, AccessCursor, error) {
+	if s.conn == nil {
+		return nil, after, errors.Err("not connected")
+	}
+
+	query := `SELECT id, last_accessed_at FROM stream
+WHERE last_accessed_at < ? AND (last_accessed_at > ? OR (last_accessed_at = ? AND id > ?))
+ORDER BY last_accessed_at, id
+LIMIT ?`
+	args := []interface{}{before, after.LastAccessedAt, after.LastAccessedAt, after.StreamID, limit}
+	logQuery(query, args...)
+
+	rows, err := s.conn.Query(query, args...)
+	if err != nil {
+		return nil, after, errors.Err(err)
+	}
+	defer closeRows(rows)
+
+	next := after
+	var streamIDs []interface{}
+	for rows.Next() {
+		err := rows.Scan(&next.StreamID, &next.LastAccessedAt)
+		if err != nil {
+			return nil, after, errors.Err(err)
+		}
+		streamIDs = append(streamIDs, next.StreamID)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, after, errors.Err(err)
+	}
+	if len(streamIDs) == 0 {
+		return nil, after, nil
+	}
+
+	query = `SELECT b.hash FROM blob_ b INNER JOIN stream_blob sb ON sb.blob_id = b.id
+WHERE b.is_stored = 1 AND sb.stream_id IN (` + qt.Qs(len(streamIDs)) + `)
+UNION
+SELECT b.hash FROM blob_ b INNER JOIN stream s ON s.sd_blob_id = b.id
+WHERE s.id IN (` + qt.Qs(len(streamIDs)) + `)`
+	args = append(append([]interface{}{}, streamIDs...), streamIDs...)
+	logQuery(query, args...)
+
+	hashRows, err := s.conn.Query(query, args...)
+	if err != nil {
+		return nil, after, errors.Err(err)
+	}
+	defer closeRows(hashRows)
+
+	var hashes []string
+	var hash string
+	for hashRows.Next() {
+		err := hashRows.Scan(&hash)
+		if err != nil {
+			return nil, after, errors.Err(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	err = hashRows.Err()
+	if err != nil {
+		return nil, after, errors.Err(err)
+	}
+
+	return hashes, next, nil
+}
+
 // Delete will remove the blob from the db
 func (s *SQL) Delete(hash string) error {
 	_, err := s.exec("DELETE FROM stream WHERE sd_blob_id = (SELECT id FROM blob_ WHERE hash = ?)", hash)
@@ -333,45 +460,155 @@ func (s *SQL) MissingBlobsForKnownStream(sdHash string) ([]string, error) {
 	return missingBlobs, errors.Err(err)
 }
 
-// AddSDBlob insert the SD blob and all the content blobs. The content blobs are marked as "not stored",
-// but they are tracked so reflector knows what it is missing.
-func (s *SQL) AddSDBlob(sdHash string, sdBlobLength int, sdBlob SdBlob) error {
+// NextBlobs returns the hashes of up to n content blobs that come after the blob in its stream, in order.
+// If the hash is an sd blob, the first n content blobs of its stream are returned.
+func (s *SQL) NextBlobs(hash string, n int) ([]string, error) {
 	if s.conn == nil {
-		return errors.Err("not connected")
+		return nil, errors.Err("not connected")
 	}
 
-	sdBlobID, err := s.insertBlob(sdHash, sdBlobLength, true)
+	query := `
+		SELECT b.hash FROM stream_blob sb
+		INNER JOIN blob_ b ON b.id = sb.blob_id
+		INNER JOIN (
+			SELECT sb2.stream_id, sb2.num FROM stream_blob sb2
+			INNER JOIN blob_ b2 ON b2.id = sb2.blob_id AND b2.hash = ?
+			UNION
+			SELECT s.id, -1 FROM stream s
+			INNER JOIN blob_ sdb ON sdb.id = s.sd_blob_id AND sdb.hash = ?
+		) cur ON cur.stream_id = sb.stream_id AND sb.num > cur.num
+		ORDER BY sb.num
+		LIMIT ?
+	`
+	args := []interface{}{hash, hash, n}
+
+	logQuery(query, args...)
+
+	rows, err := s.conn.Query(query, args...)
 	if err != nil {
-		return err
+		return nil, errors.Err(err)
 	}
+	defer closeRows(rows)
 
-	streamID, err := s.insertStream(sdBlob.StreamHash, sdBlobID)
-	if err != nil {
-		return err
+	var hashes []string
+	var next string
+	for rows.Next() {
+		err := rows.Scan(&next)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		hashes = append(hashes, next)
 	}
+	return hashes, errors.Err(rows.Err())
+}
 
-	// insert content blobs and connect them to stream
-	for _, contentBlob := range sdBlob.Blobs {
-		if contentBlob.BlobHash == "" {
-			// null terminator blob
-			continue
+// AddSDBlob insert the SD blob and all the content blobs. The content blobs are marked as "not stored",
+// but they are tracked so reflector knows what it is missing. Either everything is inserted or nothing is.
+func (s *SQL) AddSDBlob(sdHash string, sdBlobLength int, sdBlob SdBlob) error {
+	if s.conn == nil {
+		return errors.Err("not connected")
+	}
+
+	return withTxRetry(s.conn, func(tx *sql.Tx) error {
+		sdBlobID, err := insertBlob(tx, sdHash, sdBlobLength, true)
+		if err != nil {
+			return err
 		}
 
-		blobID, err := s.insertBlob(contentBlob.BlobHash, contentBlob.Length, false)
+		streamID, err := s.insertStream(tx, sdBlob.StreamHash, sdBlobID)
 		if err != nil {
 			return err
 		}
 
-		args := []interface{}{streamID, blobID, contentBlob.BlobNum}
-		_, err = s.exec(
-			"INSERT IGNORE INTO stream_blob (stream_id, blob_id, num) VALUES ("+qt.Qs(len(args))+")",
-			args...,
-		)
+		// insert content blobs and connect them to stream
+		var contentBlobs []streamBlob
+		for _, contentBlob := range sdBlob.Blobs {
+			if contentBlob.BlobHash == "" {
+				// null terminator blob
+				continue
+			}
+			if contentBlob.Length <= 0 {
+				return errors.Err("length of blob %d must be positive", contentBlob.BlobNum)
+			}
+			contentBlobs = append(contentBlobs, streamBlob{hash: contentBlob.BlobHash, length: contentBlob.Length, num: contentBlob.BlobNum})
+		}
+		// the same order in every transaction, so concurrent inserts of streams that share blobs don't deadlock
+		sort.Slice(contentBlobs, func(i, j int) bool { return contentBlobs[i].hash < contentBlobs[j].hash })
+
+		for start := 0; start < len(contentBlobs); start += insertBatchSize {
+			end := start + insertBatchSize
+			if end > len(contentBlobs) {
+				end = len(contentBlobs)
+			}
+			err := insertStreamBlobs(tx, streamID, contentBlobs[start:end])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// how many rows to insert with one statement
+const insertBatchSize = 1000
+
+type streamBlob struct {
+	hash   string
+	length int
+	num    int
+}
+
+// insertStreamBlobs inserts the content blobs as not stored and connects them to the stream
+func insertStreamBlobs(q querier, streamID int64, blobs []streamBlob) error {
+	args := make([]interface{}, 0, 3*len(blobs))
+	for _, b := range blobs {
+		args = append(args, b.hash, false, b.length)
+	}
+	_, err := exec(q,
+		"INSERT INTO blob_ (hash, is_stored, length) VALUES "+qt.Placeholders(false, 3*len(blobs), 1, 3)+" ON DUPLICATE KEY UPDATE is_stored = (is_stored or VALUES(is_stored))",
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+
+	args = args[:0]
+	for _, b := range blobs {
+		args = append(args, b.hash)
+	}
+	query := "SELECT id, hash FROM blob_ WHERE hash IN (" + qt.Qs(len(blobs)) + ")"
+	logQuery(query, args...)
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return errors.Err(err)
+	}
+	defer closeRows(rows)
+
+	ids := make(map[string]int64, len(blobs))
+	var id int64
+	var hash string
+	for rows.Next() {
+		err := rows.Scan(&id, &hash)
 		if err != nil {
 			return errors.Err(err)
 		}
+		ids[hash] = id
+	}
+	err = rows.Err()
+	if err != nil {
+		return errors.Err(err)
+	}
+
+	args = args[:0]
+	for _, b := range blobs {
+		id, ok := ids[b.hash]
+		if !ok {
+			return errors.Err("blob %s is missing after INSERTing it", b.hash)
+		}
+		args = append(args, streamID, id, b.num)
 	}
-	return nil
+	_, err = exec(q, "INSERT IGNORE INTO stream_blob (stream_id, blob_id, num) VALUES "+qt.Placeholders(false, 3*len(blobs), 1, 3), args...)
+	return err
 }
 
 // GetHashRange gets the smallest and biggest hashes in the db
@@ -480,6 +717,20 @@ func withTx(dbOrTx interface{}, f txFunc) (err error) {
 	return f(tx)
 }
 
+// withTxRetry runs f in a new transaction like withTx, and runs it again in another one if MySQL picked the
+// transaction as the victim of a deadlock and rolled it back
+func withTxRetry(db *sql.DB, f txFunc) error {
+	attempt, maxAttempts := 0, 3
+	for {
+		attempt++
+		err := withTx(db, f)
+		if !isDeadlockError(err) || attempt >= maxAttempts {
+			return err
+		}
+		log.Debugf("retrying deadlocked transaction, attempt %d: %s", attempt, err.Error())
+	}
+}
+
 func closeRows(rows *sql.Rows) {
 	if rows != nil {
 		err := rows.Close()
@@ -489,12 +740,23 @@ func closeRows(rows *sql.Rows) {
 	}
 }
 
+// querier runs queries on the db or in a transaction
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 func (s *SQL) exec(query string, args ...interface{}) (int64, error) {
+	return exec(s.conn, query, args...)
+}
+
+func exec(q querier, query string, args ...interface{}) (int64, error) {
 	logQuery(query, args...)
 	attempt, maxAttempts := 0, 3
 Retry:
 	attempt++
-	result, err := s.conn.Exec(query, args...)
+	result, err := q.Exec(query, args...)
 	if isLockTimeoutError(err) {
 		if attempt <= maxAttempts {
 			//Error 1205: Lock wait timeout exceeded; try restarting transaction
@@ -516,47 +778,19 @@ func isLockTimeoutError(err error) bool {
 	return ok && e != nil && e.Number == 1205
 }
 
+// isDeadlockError checks for error 1213: Deadlock found when trying to get lock; try restarting transaction
+func isDeadlockError(err error) bool {
+	e, ok := errors.Unwrap(err).(*mysql.MySQLError)
+	return ok && e != nil && e.Number == 1213
+}
+
 /*  SQL schema
 
+the schema is created and upgraded by the migrations in migrations.go. run `prism db migrate`
+
 in prod, set tx_isolation to READ-COMMITTED to improve db performance
 make sure you use latin1 or utf8 charset, NOT utf8mb4. that's a waste of space.
 
 todo: could add UNIQUE KEY (stream_hash, num) to stream_blob ...
 
-CREATE TABLE blob_ (
-  id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT UNIQUE,
-  hash char(96) NOT NULL,
-  is_stored TINYINT(1) NOT NULL DEFAULT 0,
-  length bigint(20) unsigned DEFAULT NULL,
-  PRIMARY KEY (id),
-  UNIQUE KEY blob_hash_idx (hash)
-);
-
-CREATE TABLE stream (
-  id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT UNIQUE,
-  hash char(96) NOT NULL,
-  sd_blob_id BIGINT UNSIGNED NOT NULL,
-  last_accessed_at TIMESTAMP NULL DEFAULT NULL,
-  PRIMARY KEY (id),
-  UNIQUE KEY stream_hash_idx (hash),
-  KEY stream_sd_blob_id_idx (sd_blob_id),
-  KEY last_accessed_at_idx (last_accessed_at),
-  FOREIGN KEY (sd_blob_id) REFERENCES blob_ (id) ON DELETE RESTRICT ON UPDATE CASCADE
-);
-
-CREATE TABLE stream_blob (
-  stream_id BIGINT UNSIGNED NOT NULL,
-  blob_id BIGINT UNSIGNED NOT NULL,
-  num int NOT NULL,
-  PRIMARY KEY (stream_id, blob_id),
-  KEY stream_blob_blob_id_idx (blob_id),
-  FOREIGN KEY (stream_id) REFERENCES stream (id) ON DELETE CASCADE ON UPDATE CASCADE,
-  FOREIGN KEY (blob_id) REFERENCES blob_ (id) ON DELETE CASCADE ON UPDATE CASCADE
-);
-
-CREATE TABLE blocked (
-  hash char(96) NOT NULL,
-  PRIMARY KEY (hash)
-);
-
 */
@@ -0,0 +1,308 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the SQL tests need a MySQL database that they can empty, e.g. "user:pass@tcp(localhost:3306)/reflector_test".
+// its name must end in _test, so a real db is not emptied by mistake
+const testDSNEnv = "REFLECTOR_TEST_DB_DSN"
+
+// testDB is a db to run the same test against each implementation
+type testDB struct {
+	DB
+	setTrackAccessTime func(bool)
+	// ageStreams makes all streams look like they were last accessed at t
+	ageStreams func(t time.Time)
+}
+
+// testSQL connects to the db in REFLECTOR_TEST_DB_DSN without checking its schema, or returns nil if it's not set
+func testSQL(t testing.TB) *SQL {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		return nil
+	}
+
+	cfg, err := mysql.ParseDSN(dsn)
+	require.NoError(t, err)
+	if !strings.HasSuffix(cfg.DBName, "_test") {
+		t.Fatalf("%s points to db %q, but the tests only empty dbs whose name ends in _test", testDSNEnv, cfg.DBName)
+	}
+
+	s := &SQL{SkipSchemaCheck: true}
+	require.NoError(t, s.Connect(dsn))
+	return s
+}
+
+func testDBs(t testing.TB) (map[string]testDB, func()) {
+	s := testSQL(t)
+	b, cleanup := testBolt(t)
+	dbs := map[string]testDB{
+		"bolt": {
+			DB:                 b,
+			setTrackAccessTime: func(track bool) { b.TrackAccessTime = track },
+			ageStreams: func(at time.Time) {
+				require.NoError(t, b.db.Update(func(tx *bolt.Tx) error {
+					var sdHashes []string
+					err := tx.Bucket(boltStreamBucket).ForEach(func(k, _ []byte) error {
+						sdHashes = append(sdHashes, string(k))
+						return nil
+					})
+					if err != nil {
+						return err
+					}
+					for _, sdHash := range sdHashes {
+						stream, _, err := getStream(tx, sdHash)
+						if err != nil {
+							return err
+						}
+						err = setAccessTime(tx, sdHash, &stream, at)
+						if err != nil {
+							return err
+						}
+						err = put(tx.Bucket(boltStreamBucket), []byte(sdHash), stream)
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				}))
+			},
+		},
+	}
+
+	if s == nil {
+		t.Logf("%s is not set, only testing bolt", testDSNEnv)
+		return dbs, cleanup
+	}
+
+	_, err := s.Migrate()
+	require.NoError(t, err)
+	for _, table := range []string{"stream_blob", "stream", "blob_", "blocked"} {
+		_, err := s.exec("DELETE FROM " + table)
+		require.NoError(t, err)
+	}
+	dbs["sql"] = testDB{
+		DB:                 s,
+		setTrackAccessTime: func(track bool) { s.TrackAccessTime = track },
+		ageStreams: func(at time.Time) {
+			_, err := s.exec("UPDATE stream SET last_accessed_at = ?", at)
+			require.NoError(t, err)
+		},
+	}
+	return dbs, func() {
+		cleanup()
+		_ = s.conn.Close()
+	}
+}
+
+func TestDB_HasBlobs(t *testing.T) {
+	dbs, cleanup := testDBs(t)
+	defer cleanup()
+
+	for name, d := range dbs {
+		t.Run(name, func(t *testing.T) {
+			standalone, notStored := testHash('1'), testHash('2')
+			require.NoError(t, d.AddBlob(standalone, 100, true))
+			require.NoError(t, d.AddBlob(notStored, 100, false))
+
+			sdHash, stored, missing := testHash('a'), testHash('3'), testHash('4')
+			require.NoError(t, d.AddSDBlob(sdHash, 500, testSdBlob(testHash('f'), stored, missing)))
+			require.NoError(t, d.AddBlob(stored, 100, true))
+
+			emptySdHash := testHash('b') // a stream without content blobs
+			require.NoError(t, d.AddSDBlob(emptySdHash, 500, testSdBlob(testHash('e'))))
+
+			exists, err := d.HasBlobs([]string{standalone, notStored, sdHash, stored, missing, emptySdHash, testHash('9')})
+			require.NoError(t, err)
+			assert.Equal(t, map[string]bool{standalone: true, sdHash: true, stored: true, emptySdHash: true}, exists)
+
+			has, err := d.HasBlob(standalone)
+			require.NoError(t, err)
+			assert.True(t, has)
+			has, err = d.HasBlob(missing)
+			require.NoError(t, err)
+			assert.False(t, has)
+		})
+	}
+}
+
+func TestDB_HasBlobsTouchesStreams(t *testing.T) {
+	dbs, cleanup := testDBs(t)
+	defer cleanup()
+
+	for name, d := range dbs {
+		t.Run(name, func(t *testing.T) {
+			sdHash1, blob1 := testHash('a'), testHash('1')
+			require.NoError(t, d.AddSDBlob(sdHash1, 500, testSdBlob(testHash('f'), blob1)))
+			require.NoError(t, d.AddBlob(blob1, 100, true))
+			sdHash2 := testHash('b')
+			require.NoError(t, d.AddSDBlob(sdHash2, 500, testSdBlob(testHash('e'))))
+			standalone := testHash('2')
+			require.NoError(t, d.AddBlob(standalone, 100, true))
+
+			d.setTrackAccessTime(true)
+			defer d.setTrackAccessTime(false)
+			stale := func() []string {
+				hashes, _, err := d.StaleBlobs(time.Now().Add(-time.Hour), AccessCursor{}, 10)
+				require.NoError(t, err)
+				return hashes
+			}
+
+			d.ageStreams(time.Now().AddDate(0, 0, -2))
+			require.ElementsMatch(t, []string{sdHash1, blob1, sdHash2}, stale())
+
+			// a content blob touches its stream
+			_, err := d.HasBlobs([]string{blob1, standalone})
+			require.NoError(t, err)
+			assert.ElementsMatch(t, []string{sdHash2}, stale())
+
+			// and so does an sd blob
+			_, err = d.HasBlobs([]string{sdHash2})
+			require.NoError(t, err)
+			assert.Empty(t, stale())
+		})
+	}
+}
+
+func TestDB_AddSDBlobIsAtomic(t *testing.T) {
+	dbs, cleanup := testDBs(t)
+	defer cleanup()
+
+	for name, d := range dbs {
+		t.Run(name, func(t *testing.T) {
+			sdHash, blob1, blob2 := testHash('a'), testHash('1'), testHash('2')
+			sd := testSdBlob(testHash('f'), blob1, blob2)
+			sd.Blobs[1].Length = 0
+			assert.Error(t, d.AddSDBlob(sdHash, 500, sd))
+
+			exists, err := d.HasBlobs([]string{sdHash})
+			require.NoError(t, err)
+			assert.Empty(t, exists, "the sd blob should not be added if its content blobs are not")
+			next, err := d.NextBlobs(sdHash, 10)
+			require.NoError(t, err)
+			assert.Empty(t, next)
+			_, _, err = d.GetHashRange()
+			assert.Error(t, err, "no blobs should be added")
+		})
+	}
+}
+
+func TestIsDeadlockError(t *testing.T) {
+	deadlock := &mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock; try restarting transaction"}
+	assert.True(t, isDeadlockError(deadlock))
+	assert.True(t, isDeadlockError(errors.Err(deadlock)))
+	assert.True(t, isDeadlockError(errors.Prefix("inserting stream", deadlock)))
+	assert.False(t, isDeadlockError(errors.Err(&mysql.MySQLError{Number: 1205})))
+	assert.False(t, isDeadlockError(nil))
+}
+
+func BenchmarkDB_AddSDBlob(b *testing.B) {
+	dbs, cleanup := testDBs(b)
+	defer cleanup()
+
+	// a big stream, with hashes that are unique across iterations
+	streams := 0
+	sd := func() (string, SdBlob) {
+		streams++
+		hashes := make([]string, 5000)
+		for j := range hashes {
+			hashes[j] = fmt.Sprintf("%048x%048x", streams, j)
+		}
+		return fmt.Sprintf("%048x%048x", streams, len(hashes)), testSdBlob(fmt.Sprintf("%096x", streams), hashes...)
+	}
+	// queries is nil if the db doesn't count them
+	bench := func(b *testing.B, addSDBlob func(string, int, SdBlob) error, queries func() int64) {
+		var total int64
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			sdHash, sdBlob := sd()
+			var before int64
+			if queries != nil {
+				before = queries()
+			}
+			b.StartTimer()
+			require.NoError(b, addSDBlob(sdHash, 500, sdBlob))
+			if queries != nil {
+				b.StopTimer()
+				total += queries() - before
+				b.StartTimer()
+			}
+		}
+		if queries != nil {
+			b.ReportMetric(float64(total)/float64(b.N), "queries/op")
+		}
+	}
+
+	// the sql cases need REFLECTOR_TEST_DB_DSN. per_row is how streams were inserted before the content blobs
+	// were batched, for comparison
+	for name, d := range dbs {
+		b.Run(name, func(b *testing.B) {
+			var queries func() int64
+			if s, ok := d.DB.(*SQL); ok {
+				queries = func() int64 { return sqlQuestions(b, s) }
+			}
+			bench(b, d.AddSDBlob, queries)
+		})
+	}
+	if d, ok := dbs["sql"]; ok {
+		s := d.DB.(*SQL)
+		b.Run("sql_per_row", func(b *testing.B) {
+			bench(b, func(sdHash string, sdBlobLength int, sdBlob SdBlob) error {
+				return addSDBlobPerRow(s, sdHash, sdBlobLength, sdBlob)
+			}, func() int64 { return sqlQuestions(b, s) })
+		})
+	}
+}
+
+// sqlQuestions returns how many statements the MySQL server has run. it counts the statements of all
+// clients, so the test db should not be busy
+func sqlQuestions(t testing.TB, s *SQL) int64 {
+	var name string
+	var questions int64
+	require.NoError(t, s.conn.QueryRow("SHOW GLOBAL STATUS LIKE 'Questions'").Scan(&name, &questions))
+	return questions - 1 // the SHOW itself
+}
+
+// addSDBlobPerRow inserts a stream the way AddSDBlob did before its content blobs were inserted in batches,
+// with two statements per content blob. it's only kept as a baseline for BenchmarkDB_AddSDBlob
+func addSDBlobPerRow(s *SQL, sdHash string, sdBlobLength int, sdBlob SdBlob) error {
+	sdBlobID, err := insertBlob(s.conn, sdHash, sdBlobLength, true)
+	if err != nil {
+		return err
+	}
+
+	streamID, err := s.insertStream(s.conn, sdBlob.StreamHash, sdBlobID)
+	if err != nil {
+		return err
+	}
+
+	for _, contentBlob := range sdBlob.Blobs {
+		if contentBlob.BlobHash == "" {
+			continue
+		}
+
+		blobID, err := insertBlob(s.conn, contentBlob.BlobHash, contentBlob.Length, false)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.exec("INSERT IGNORE INTO stream_blob (stream_id, blob_id, num) VALUES (?, ?, ?)", streamID, blobID, contentBlob.BlobNum)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
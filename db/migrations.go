@@ -0,0 +1,257 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// migration upgrades the schema from the previous version to this one
+type migration struct {
+	version    int
+	name       string
+	statements []string
+}
+
+// migrations are applied in order. Never change a migration that was released, add a new one instead.
+// MySQL commits DDL statements right away, so a migration that fails halfway is not rolled back. Write
+// statements that can run again, e.g. with IF NOT EXISTS.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create tables",
+		// IF NOT EXISTS so that databases that were set up by hand before migrations existed are adopted
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS blob_ (
+  id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT UNIQUE,
+  hash char(96) NOT NULL,
+  is_stored TINYINT(1) NOT NULL DEFAULT 0,
+  length bigint(20) unsigned DEFAULT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY blob_hash_idx (hash)
+)`,
+			`CREATE TABLE IF NOT EXISTS stream (
+  id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT UNIQUE,
+  hash char(96) NOT NULL,
+  sd_blob_id BIGINT UNSIGNED NOT NULL,
+  last_accessed_at TIMESTAMP NULL DEFAULT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY stream_hash_idx (hash),
+  KEY stream_sd_blob_id_idx (sd_blob_id),
+  KEY last_accessed_at_idx (last_accessed_at),
+  FOREIGN KEY (sd_blob_id) REFERENCES blob_ (id) ON DELETE RESTRICT ON UPDATE CASCADE
+)`,
+			`CREATE TABLE IF NOT EXISTS stream_blob (
+  stream_id BIGINT UNSIGNED NOT NULL,
+  blob_id BIGINT UNSIGNED NOT NULL,
+  num int NOT NULL,
+  PRIMARY KEY (stream_id, blob_id),
+  KEY stream_blob_blob_id_idx (blob_id),
+  FOREIGN KEY (stream_id) REFERENCES stream (id) ON DELETE CASCADE ON UPDATE CASCADE,
+  FOREIGN KEY (blob_id) REFERENCES blob_ (id) ON DELETE CASCADE ON UPDATE CASCADE
+)`,
+			`CREATE TABLE IF NOT EXISTS blocked (
+  hash char(96) NOT NULL,
+  PRIMARY KEY (hash)
+)`,
+		},
+	},
+}
+
+// SchemaVersion is the schema version this binary works with
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// MigrationStatus is a migration and when it was applied
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at"` // nil if it was not applied yet
+}
+
+const createMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migration (
+  version int NOT NULL,
+  name varchar(255) NOT NULL,
+  applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (version)
+)`
+
+const (
+	// held while migrations are applied, so that binaries that migrate at the same time don't both apply them
+	migrateLock = "reflector_migrate"
+	// how long to wait for another binary to finish migrating
+	migrateLockTimeout = 10 * time.Minute
+)
+
+// Migrate applies the migrations that were not applied yet, and returns how many it applied
+func (s *SQL) Migrate() (int, error) {
+	if s.conn == nil {
+		return 0, errors.Err("not connected")
+	}
+
+	unlock, err := s.lock(migrateLock, migrateLockTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	_, err = s.exec(createMigrationsTable)
+	if err != nil {
+		return 0, err
+	}
+
+	current, err := s.currentVersion()
+	if err != nil {
+		return 0, err
+	}
+	if current > SchemaVersion() {
+		return 0, errors.Err("schema version %d is newer than this binary supports (%d)", current, SchemaVersion())
+	}
+
+	applied := 0
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		log.Infof("applying migration %d: %s", m.version, m.name)
+		for _, statement := range m.statements {
+			_, err := s.exec(statement)
+			if err != nil {
+				return applied, errors.Prefix("migration "+m.name, err)
+			}
+		}
+		_, err = s.exec("INSERT INTO schema_migration (version, name) VALUES (?, ?)", m.version, m.name)
+		if err != nil {
+			return applied, err
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// lock takes a MySQL named lock, and returns a function that releases it. The lock belongs to a connection,
+// so that connection is kept out of the pool until the lock is released
+func (s *SQL) lock(name string, timeout time.Duration) (func(), error) {
+	ctx := context.Background()
+	conn, err := s.conn.Conn(ctx)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	var locked sql.NullInt64
+	query := "SELECT GET_LOCK(?, ?)"
+	args := []interface{}{name, int(timeout.Seconds())}
+	logQuery(query, args...)
+	err = conn.QueryRowContext(ctx, query, args...).Scan(&locked)
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.Err(err)
+	}
+	if locked.Int64 != 1 {
+		_ = conn.Close()
+		return nil, errors.Err("timed out after %s waiting for lock %s", timeout, name)
+	}
+
+	return func() {
+		var released sql.NullInt64
+		err := conn.QueryRowContext(ctx, "SELECT RELEASE_LOCK(?)", name).Scan(&released)
+		if err != nil {
+			log.Errorf("releasing lock %s: %s", name, err.Error())
+		}
+		_ = conn.Close()
+	}, nil
+}
+
+// MigrationStatus lists all migrations and when they were applied
+func (s *SQL) MigrationStatus() ([]MigrationStatus, error) {
+	if s.conn == nil {
+		return nil, errors.Err("not connected")
+	}
+
+	appliedAt := make(map[int]time.Time)
+	exists, err := s.migrationsTableExists()
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		query := "SELECT version, applied_at FROM schema_migration"
+		logQuery(query)
+		rows, err := s.conn.Query(query)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		defer closeRows(rows)
+
+		var version int
+		var at time.Time
+		for rows.Next() {
+			err := rows.Scan(&version, &at)
+			if err != nil {
+				return nil, errors.Err(err)
+			}
+			appliedAt[version] = at
+		}
+		err = rows.Err()
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+	}
+
+	statuses := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		statuses[i] = MigrationStatus{Version: m.version, Name: m.name}
+		if at, ok := appliedAt[m.version]; ok {
+			statuses[i].AppliedAt = &at
+		}
+	}
+	return statuses, nil
+}
+
+// checkSchema returns an error if the schema version is not the one this binary works with
+func (s *SQL) checkSchema() error {
+	current, err := s.currentVersion()
+	if err != nil {
+		return err
+	}
+	if current < SchemaVersion() {
+		return errors.Err("db schema is at version %d but this binary needs version %d. run `prism db migrate`", current, SchemaVersion())
+	}
+	if current > SchemaVersion() {
+		return errors.Err("db schema is at version %d, which is newer than this binary supports (%d). upgrade the binary", current, SchemaVersion())
+	}
+	return nil
+}
+
+// currentVersion returns the version of the last applied migration, or 0 if none were applied
+func (s *SQL) currentVersion() (int, error) {
+	exists, err := s.migrationsTableExists()
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	query := "SELECT MAX(version) FROM schema_migration"
+	logQuery(query)
+	err = s.conn.QueryRow(query).Scan(&version)
+	if err != nil {
+		return 0, errors.Err(err)
+	}
+	return int(version.Int64), nil
+}
+
+func (s *SQL) migrationsTableExists() (bool, error) {
+	var count int
+	query := "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = 'schema_migration'"
+	logQuery(query)
+	err := s.conn.QueryRow(query).Scan(&count)
+	if err != nil {
+		return false, errors.Err(err)
+	}
+	return count > 0, nil
+}
@@ -0,0 +1,117 @@
+package db
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrations_Versions(t *testing.T) {
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.version, "migration versions must be consecutive, starting at 1")
+		assert.NotEmpty(t, m.name)
+		assert.NotEmpty(t, m.statements)
+	}
+	assert.Equal(t, len(migrations), SchemaVersion())
+}
+
+// the schema that was created by hand before there were migrations
+var legacySchema = []string{
+	`CREATE TABLE blob_ (
+  id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT UNIQUE,
+  hash char(96) NOT NULL,
+  is_stored TINYINT(1) NOT NULL DEFAULT 0,
+  length bigint(20) unsigned DEFAULT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY blob_hash_idx (hash)
+)`,
+	`CREATE TABLE stream (
+  id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT UNIQUE,
+  hash char(96) NOT NULL,
+  sd_blob_id BIGINT UNSIGNED NOT NULL,
+  last_accessed_at TIMESTAMP NULL DEFAULT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY stream_hash_idx (hash),
+  KEY stream_sd_blob_id_idx (sd_blob_id),
+  KEY last_accessed_at_idx (last_accessed_at),
+  FOREIGN KEY (sd_blob_id) REFERENCES blob_ (id) ON DELETE RESTRICT ON UPDATE CASCADE
+)`,
+	`CREATE TABLE stream_blob (
+  stream_id BIGINT UNSIGNED NOT NULL,
+  blob_id BIGINT UNSIGNED NOT NULL,
+  num int NOT NULL,
+  PRIMARY KEY (stream_id, blob_id),
+  KEY stream_blob_blob_id_idx (blob_id),
+  FOREIGN KEY (stream_id) REFERENCES stream (id) ON DELETE CASCADE ON UPDATE CASCADE,
+  FOREIGN KEY (blob_id) REFERENCES blob_ (id) ON DELETE CASCADE ON UPDATE CASCADE
+)`,
+	`CREATE TABLE blocked (
+  hash char(96) NOT NULL,
+  PRIMARY KEY (hash)
+)`,
+}
+
+// dropTables empties the test db
+func dropTables(t *testing.T, s *SQL) {
+	for _, table := range []string{"stream_blob", "stream", "blob_", "blocked", "schema_migration"} {
+		_, err := s.exec("DROP TABLE IF EXISTS " + table)
+		require.NoError(t, err)
+	}
+}
+
+func TestSQL_Migrate(t *testing.T) {
+	s := testSQL(t)
+	if s == nil {
+		t.Skipf("%s is not set", testDSNEnv)
+	}
+	defer s.conn.Close()
+
+	t.Run("empty", func(t *testing.T) {
+		dropTables(t, s)
+		applied, err := s.Migrate()
+		require.NoError(t, err)
+		assert.Equal(t, len(migrations), applied)
+		require.NoError(t, s.checkSchema())
+
+		applied, err = s.Migrate()
+		require.NoError(t, err)
+		assert.Equal(t, 0, applied, "migrations should only be applied once")
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		dropTables(t, s)
+		for _, statement := range legacySchema {
+			_, err := s.exec(statement)
+			require.NoError(t, err)
+		}
+		require.NoError(t, s.AddBlob(testHash('1'), 100, true))
+		assert.Error(t, s.checkSchema(), "a db without migrations should need them")
+
+		applied, err := s.Migrate()
+		require.NoError(t, err)
+		assert.Equal(t, len(migrations), applied)
+		require.NoError(t, s.checkSchema())
+		has, err := s.HasBlob(testHash('1'))
+		require.NoError(t, err)
+		assert.True(t, has, "the blobs in a legacy db should be kept")
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		dropTables(t, s)
+		var wg sync.WaitGroup
+		applied := make([]int, 3)
+		for i := range applied {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var err error
+				applied[i], err = s.Migrate()
+				assert.NoError(t, err)
+			}(i)
+		}
+		wg.Wait()
+		assert.ElementsMatch(t, []int{len(migrations), 0, 0}, applied, "only one of them should apply the migrations")
+	})
+}
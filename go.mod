@@ -24,6 +24,8 @@ require (
 	github.com/irmf/chainquery v1.9.1-0.20210213022256-c00cc8714fb6
 	github.com/johntdyer/slackrus v0.0.0-20180518184837-f7aae3243a07
 	github.com/karrick/godirwalk v1.16.1
+	github.com/klauspost/cpuid v1.3.1 // indirect
+	github.com/klauspost/reedsolomon v1.9.3
 	github.com/lbryio/lbry.go/v2 v2.6.1-0.20200901175808-73382bb02128
 	github.com/lbryio/types v0.0.0-20201019032447-f0b4476ef386
 	github.com/lucas-clemente/quic-go v0.18.1
@@ -39,6 +41,7 @@ require (
 	github.com/volatiletech/inflect v0.0.1 // indirect
 	github.com/volatiletech/null v8.0.0+incompatible
 	github.com/volatiletech/sqlboiler v3.7.1+incompatible // indirect
+	go.etcd.io/bbolt v1.3.5
 	go.uber.org/atomic v1.5.1
 	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 	golang.org/x/lint v0.0.0-20200302205851-738671d3881b // indirect
@@ -70,6 +70,24 @@ const (
 	LabelCacheType = "cache_type"
 	LabelComponent = "component"
 	LabelSource    = "source"
+	LabelPolicy    = "policy"
+	LabelAdmitted  = "admitted"
+	LabelResult    = "result"
+	LabelDir       = "dir"
+	LabelReplica   = "replica"
+	LabelMove      = "move"
+	LabelOrigin    = "origin"
+
+	MovePromote = "promote" // from the cold tier to the hot tier
+	MoveDemote  = "demote"  // from the hot tier to the cold tier
+
+	PrefetchFetched = "fetched" // fetched from the origin into the cache
+	PrefetchCached  = "cached"  // already in the cache
+	PrefetchFailed  = "failed"
+	PrefetchDropped = "dropped" // not prefetched because too many prefetches were running
+
+	ResultHit  = "hit"
+	ResultMiss = "miss"
 
 	errConnReset         = "conn_reset"
 	errReadConnReset     = "read_conn_reset"
@@ -90,6 +108,8 @@ const (
 	errZeroByteBlob      = "zero_byte_blob"
 	errInvalidCharacter  = "invalid_character"
 	errBlobNotFound      = "blob_not_found"
+	errBlobCorrupt       = "blob_corrupt"
+	errCircuitOpen       = "circuit_open"
 	errNoErr             = "no_error"
 	errQuicProto         = "quic_protocol_violation"
 	errOther             = "other"
@@ -149,6 +169,158 @@ var (
 		Name:      "evict_total",
 		Help:      "Count of blobs evicted from cache",
 	}, []string{LabelCacheType, LabelComponent})
+	// compare hit ratios of cache admission policies with hit / (hit + miss)
+	CachePolicyRequestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "policy_requests_total",
+		Help:      "Total number of cache hits and misses by admission policy",
+	}, []string{LabelCacheType, LabelComponent, LabelPolicy, LabelResult})
+	CacheAdmissionCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "admission_total",
+		Help:      "Total number of origin blobs the admission policy admitted to or rejected from the cache",
+	}, []string{LabelCacheType, LabelComponent, LabelPolicy, LabelAdmitted})
+	CacheLRUBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "lru_bytes",
+		Help:      "Total size of blobs tracked by the LRU cache",
+	}, []string{LabelCacheType, LabelComponent})
+	WriteBackQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "write_back_queue_depth",
+		Help:      "How many blobs are waiting to be uploaded to the origin",
+	}, []string{LabelCacheType, LabelComponent})
+	WriteBackOldestAge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "write_back_oldest_age_seconds",
+		Help:      "How long the oldest blob in the write-back queue has been waiting to be uploaded",
+	}, []string{LabelCacheType, LabelComponent})
+	WriteBackErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "write_back_error_total",
+		Help:      "Total number of failed uploads from the write-back queue to the origin",
+	}, []string{LabelCacheType, LabelComponent})
+	WriteBackParked = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "write_back_parked",
+		Help:      "How many queued blobs stopped being retried after failing to upload too many times",
+	}, []string{LabelCacheType, LabelComponent})
+	DiskShardOffline = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "disk_shard_offline",
+		Help:      "1 if the disk shard directory failed and is not being used, 0 otherwise",
+	}, []string{LabelDir})
+	ReplicaMissingBlobs = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "replica_missing_blobs",
+		Help:      "How many blobs are known to be missing from the replica and waiting to be repaired",
+	}, []string{LabelComponent, LabelReplica})
+	ReplicaRepairQueueSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "replica_repair_queue_size",
+		Help:      "How many blobs are waiting to be copied to the replicas that are missing them",
+	}, []string{LabelComponent})
+	ReplicaRepairCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "replica_repair_total",
+		Help:      "Total number of blobs copied to a replica that was missing them",
+	}, []string{LabelComponent, LabelReplica})
+	TierMoveCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "tier_move_total",
+		Help:      "Total number of blobs moved between the hot and cold storage tiers",
+	}, []string{LabelComponent, LabelMove})
+	ErasureReconstructCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "erasure_reconstruct_total",
+		Help:      "Total number of erasure coded blobs that had missing or corrupt shards and were reconstructed",
+	}, []string{LabelCacheType, LabelComponent})
+	CompressionInputBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "compression_input_bytes_total",
+		Help:      "Total size of blobs stored through a compressed store, before compression",
+	}, []string{LabelCacheType, LabelComponent})
+	CompressionOutputBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "compression_output_bytes_total",
+		Help:      "Total size of blobs stored through a compressed store, after compression. Divide by the input bytes for the compression ratio",
+	}, []string{LabelCacheType, LabelComponent})
+	CompressionSkippedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "compression_skipped_total",
+		Help:      "Total number of blobs stored uncompressed because compression would not make them smaller",
+	}, []string{LabelCacheType, LabelComponent})
+	CircuitBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "circuit_breaker_state",
+		Help:      "State of the circuit breaker in front of an origin: 0 closed, 1 half-open, 2 open",
+	}, []string{LabelCacheType, LabelComponent})
+	CircuitBreakerRejectCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "circuit_breaker_reject_total",
+		Help:      "Total number of requests not sent to an origin because its circuit breaker was open",
+	}, []string{LabelCacheType, LabelComponent})
+	OriginServedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "origin_served_total",
+		Help:      "Total number of blobs served by each origin of a fallback store",
+	}, []string{LabelComponent, LabelOrigin})
+	HedgedRequestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "hedged_request_total",
+		Help:      "Total number of extra origin requests sent because the first one was slow",
+	}, []string{LabelCacheType, LabelComponent})
+	HedgeWonCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "hedge_won_total",
+		Help:      "Total number of hedged requests that finished before the request they hedged",
+	}, []string{LabelCacheType, LabelComponent})
+	OriginLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "origin_latency_seconds",
+		Help:      "How long blob requests to an origin take",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12), // 5ms to ~10s
+	}, []string{LabelComponent, LabelOrigin})
+	PrefetchCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "prefetch_total",
+		Help:      "Total number of prefetches by result. dropped counts requests, the other results count blobs",
+	}, []string{LabelCacheType, LabelComponent, LabelResult})
+	PrefetchHitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "prefetch_hit_total",
+		Help:      "Total number of prefetched blobs that were requested afterwards",
+	}, []string{LabelCacheType, LabelComponent})
+	BlobCorruptionCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: subsystemCache,
+		Name:      "corrupt_blob_total",
+		Help:      "Total number of blobs read from a store whose contents did not match their hash",
+	}, []string{LabelCacheType, LabelComponent})
 	CacheRetrievalSpeed = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: ns,
 		Name:      "speed_mbps",
@@ -257,6 +429,10 @@ func TrackError(direction string, e error) (shouldLog bool) { // shouldLog is a
 		errType = errHashMismatch
 	} else if strings.Contains(err.Error(), "blob not found") {
 		errType = errBlobNotFound
+	} else if strings.Contains(err.Error(), "blob is corrupt") {
+		errType = errBlobCorrupt
+	} else if strings.Contains(err.Error(), "circuit breaker is open") {
+		errType = errCircuitOpen
 	} else if strings.Contains(err.Error(), "0-byte blob received") {
 		errType = errZeroByteBlob
 	} else if strings.Contains(err.Error(), "PROTOCOL_VIOLATION: tried to retire connection") {
@@ -2,6 +2,7 @@ package peer
 
 import (
 	"bufio"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"io"
@@ -30,11 +31,16 @@ type Client struct {
 
 // Connect connects to a specific clients and errors if it cannot be contacted.
 func (c *Client) Connect(address string) error {
+	return c.ConnectContext(context.Background(), address)
+}
+
+// ConnectContext is Connect with a context. The context only applies to dialing.
+func (c *Client) ConnectContext(ctx context.Context, address string) error {
 	var err error
 	if c.Timeout == 0 {
 		c.Timeout = 5 * time.Second
 	}
-	c.conn, err = net.Dial("tcp4", address)
+	c.conn, err = (&net.Dialer{}).DialContext(ctx, "tcp4", address)
 	if err != nil {
 		return err
 	}
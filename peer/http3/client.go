@@ -2,6 +2,7 @@ package http3
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -60,7 +61,12 @@ func (c *Client) GetStream(sdHash string, blobCache store.BlobStore) (stream.Str
 
 // HasBlob checks if the blob is available
 func (c *Client) HasBlob(hash string) (bool, error) {
-	resp, err := c.conn.Get(fmt.Sprintf("https://%s/has/%s", c.ServerAddr, hash))
+	return c.HasBlobContext(context.Background(), hash)
+}
+
+// HasBlobContext is HasBlob with a context
+func (c *Client) HasBlobContext(ctx context.Context, hash string) (bool, error) {
+	resp, err := c.get(ctx, fmt.Sprintf("https://%s/has/%s", c.ServerAddr, hash))
 	if err != nil {
 		return false, errors.Err(err)
 	}
@@ -76,7 +82,12 @@ func (c *Client) HasBlob(hash string) (bool, error) {
 
 // GetBlob gets a blob
 func (c *Client) GetBlob(hash string) (stream.Blob, error) {
-	resp, err := c.conn.Get(fmt.Sprintf("https://%s/get/%s", c.ServerAddr, hash))
+	return c.GetBlobContext(context.Background(), hash)
+}
+
+// GetBlobContext is GetBlob with a context
+func (c *Client) GetBlobContext(ctx context.Context, hash string) (stream.Blob, error) {
+	resp, err := c.get(ctx, fmt.Sprintf("https://%s/get/%s", c.ServerAddr, hash))
 	if err != nil {
 		return nil, errors.Err(err)
 	}
@@ -105,6 +116,14 @@ func (c *Client) GetBlob(hash string) (stream.Blob, error) {
 	return blob, nil
 }
 
+func (c *Client) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.conn.Do(req)
+}
+
 // buffer pool to reduce GC
 // https://www.captaincodeman.com/2017/06/02/golang-buffer-pool-gotcha
 var buffers = sync.Pool{
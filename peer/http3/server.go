@@ -8,8 +8,10 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"math/big"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/irmf/reflector.go/internal/metrics"
@@ -71,7 +73,7 @@ func (s *Server) Start(address string) error {
 	r.HandleFunc("/get/{hash}", func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		requestedBlob := vars["hash"]
-		blob, err := s.store.Get(requestedBlob)
+		blob, size, err := store.GetReaderContext(r.Context(), s.store, requestedBlob)
 		if err != nil {
 			if errors.Is(err, store.ErrBlobNotFound) {
 				http.Error(w, err.Error(), http.StatusNotFound)
@@ -83,18 +85,21 @@ func (s *Server) Start(address string) error {
 			return
 		}
 
-		_, err = w.Write(blob)
+		defer blob.Close()
+
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		written, err := io.Copy(w, blob)
 		if err != nil {
 			s.logError(err)
 		}
-		metrics.MtrOutBytesUdp.Add(float64(len(blob)))
+		metrics.MtrOutBytesUdp.Add(float64(written))
 		metrics.BlobDownloadCount.Inc()
 		metrics.Http3DownloadCount.Inc()
 	})
 	r.HandleFunc("/has/{hash}", func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		requestedBlob := vars["hash"]
-		blobExists, err := s.store.Has(requestedBlob)
+		blobExists, err := store.HasContext(r.Context(), s.store, requestedBlob)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			s.logError(err)
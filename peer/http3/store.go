@@ -1,6 +1,7 @@
 package http3
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"net/http"
@@ -59,22 +60,32 @@ func (p *Store) Name() string { return "http3" }
 
 // Has asks the peer if they have a hash
 func (p *Store) Has(hash string) (bool, error) {
+	return p.HasContext(context.Background(), hash)
+}
+
+// HasContext is Has with a context
+func (p *Store) HasContext(ctx context.Context, hash string) (bool, error) {
 	c, err := p.getClient()
 	if err != nil {
 		return false, err
 	}
 	defer c.Close()
-	return c.HasBlob(hash)
+	return c.HasBlobContext(ctx, hash)
 }
 
 // Get downloads the blob from the peer
 func (p *Store) Get(hash string) (stream.Blob, error) {
+	return p.GetContext(context.Background(), hash)
+}
+
+// GetContext is Get with a context
+func (p *Store) GetContext(ctx context.Context, hash string) (stream.Blob, error) {
 	c, err := p.getClient()
 	if err != nil {
 		return nil, err
 	}
 	defer c.Close()
-	return c.GetBlob(hash)
+	return c.GetBlobContext(ctx, hash)
 }
 
 // Put is not supported
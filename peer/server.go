@@ -2,6 +2,8 @@ package peer
 
 import (
 	"bufio"
+	"context"
+	"crypto/sha512"
 	"encoding/hex"
 	"encoding/json"
 	ee "errors"
@@ -103,12 +105,24 @@ func (s *Server) handleConnection(conn net.Conn) {
 		}
 	}()
 
+	// cancel in-flight store requests if the server shuts down
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.grp.Ch():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	timeoutDuration := 1 * time.Minute
 	buf := bufio.NewReader(conn)
 
 	for {
 		var request []byte
 		var response []byte
+		var blob io.ReadCloser
 
 		err := conn.SetReadDeadline(time.Now().Add(timeoutDuration))
 		if err != nil {
@@ -128,7 +142,11 @@ func (s *Server) handleConnection(conn net.Conn) {
 			log.Error(errors.FullTrace(err))
 		}
 
-		response, err = s.handleCompositeRequest(request)
+		reqCtx, reqCancel := context.WithCancel(ctx)
+		stopWatching := watchForDisconnect(conn, buf, reqCancel)
+		response, blob, err = s.handleCompositeRequest(reqCtx, request)
+		stopWatching()
+		reqCancel()
 		if err != nil {
 			log.Error(errors.FullTrace(err))
 			return
@@ -139,15 +157,12 @@ func (s *Server) handleConnection(conn net.Conn) {
 			log.Error(errors.FullTrace(err))
 		}
 
-		n, err := conn.Write(response)
+		err = writeResponse(conn, response, blob)
 		if err != nil {
 			if !strings.Contains(err.Error(), "connection reset by peer") { // means the other side closed the connection using TCP reset
 				s.logError(err)
 			}
 			return
-		} else if n != len(response) {
-			log.Errorln(io.ErrShortWrite)
-			return
 		}
 
 		err = conn.SetWriteDeadline(time.Time{})
@@ -218,15 +233,17 @@ func (s *Server) handleAvailabilityRequest(data []byte) ([]byte, error) {
 //	return append(response, blob...), nil
 //}
 
-func (s *Server) handleCompositeRequest(data []byte) ([]byte, error) {
+// handleCompositeRequest returns the response and, if a blob was requested and found, a reader for the blob
+// that should be sent right after the response. The caller must close the blob reader.
+func (s *Server) handleCompositeRequest(ctx context.Context, data []byte) ([]byte, io.ReadCloser, error) {
 	var request compositeRequest
 	err := json.Unmarshal(data, &request)
 	if err != nil {
 		var je *json.SyntaxError
 		if ee.As(err, &je) {
-			return nil, errors.Err("invalid json at offset %d in data %s", je.Offset, hex.EncodeToString(data))
+			return nil, nil, errors.Err("invalid json at offset %d in data %s", je.Offset, hex.EncodeToString(data))
 		}
-		return nil, errors.Err(err)
+		return nil, nil, errors.Err(err)
 	}
 
 	response := compositeResponse{
@@ -236,9 +253,9 @@ func (s *Server) handleCompositeRequest(data []byte) ([]byte, error) {
 	if len(request.RequestedBlobs) > 0 {
 		var availableBlobs []string
 		for _, blobHash := range request.RequestedBlobs {
-			exists, err := s.store.Has(blobHash)
+			exists, err := store.HasContext(ctx, s.store, blobHash)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			if exists {
 				availableBlobs = append(availableBlobs, blobHash)
@@ -252,27 +269,29 @@ func (s *Server) handleCompositeRequest(data []byte) ([]byte, error) {
 		response.BlobDataPaymentRate = paymentRateTooLow
 	}
 
-	var blob []byte
+	var blob io.ReadCloser
 	if request.RequestedBlob != "" {
 		if len(request.RequestedBlob) != stream.BlobHashHexLength {
-			return nil, errors.Err("Invalid blob hash length")
+			return nil, nil, errors.Err("Invalid blob hash length")
 		}
 
 		log.Debugln("Sending blob " + request.RequestedBlob[:8])
 
-		blob, err = s.store.Get(request.RequestedBlob)
+		var blobHash string
+		var size int64
+		blob, blobHash, size, err = s.getBlob(ctx, request.RequestedBlob)
 		if errors.Is(err, store.ErrBlobNotFound) {
 			response.IncomingBlob = incomingBlob{
 				Error: err.Error(),
 			}
 		} else if err != nil {
-			return nil, err
+			return nil, nil, err
 		} else {
 			response.IncomingBlob = incomingBlob{
-				BlobHash: reflector.BlobHash(blob),
-				Length:   len(blob),
+				BlobHash: blobHash,
+				Length:   int(size),
 			}
-			metrics.MtrOutBytesTcp.Add(float64(len(blob)))
+			metrics.MtrOutBytesTcp.Add(float64(size))
 			metrics.BlobDownloadCount.Inc()
 			metrics.PeerDownloadCount.Inc()
 		}
@@ -280,10 +299,101 @@ func (s *Server) handleCompositeRequest(data []byte) ([]byte, error) {
 
 	respData, err := json.Marshal(response)
 	if err != nil {
-		return nil, err
+		if blob != nil {
+			_ = blob.Close()
+		}
+		return nil, nil, err
+	}
+
+	return respData, blob, nil
+}
+
+// getBlob returns a reader for the blob, and the hash and size of the bytes it will read. The client checks
+// the hash, so it must be the hash of what is sent. A VerifyingStore only returns blobs that match their hash,
+// otherwise the blob is read and hashed once before it is streamed, so it's never buffered whole.
+func (s *Server) getBlob(ctx context.Context, hash string) (io.ReadCloser, string, int64, error) {
+	if _, ok := s.store.(*store.VerifyingStore); ok {
+		rc, size, err := store.GetReaderContext(ctx, s.store, hash)
+		return rc, hash, size, err
+	}
+
+	blobHash, size, err := hashBlob(ctx, s.store, hash)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	rc, _, err := store.GetReaderContext(ctx, s.store, hash)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	// what's sent must match the header, even if the blob changed in between
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rc, size), rc}, blobHash, size, nil
+}
+
+// hashBlob reads the blob and returns its hash and size
+func hashBlob(ctx context.Context, s store.BlobStore, hash string) (string, int64, error) {
+	rc, _, err := store.GetReaderContext(ctx, s, hash)
+	if err != nil {
+		return "", 0, err
+	}
+	defer rc.Close()
+
+	h := sha512.New384()
+	size, err := io.Copy(h, io.LimitReader(rc, stream.MaxBlobSize+1))
+	if err != nil {
+		return "", 0, errors.Err(err)
+	}
+	if size > stream.MaxBlobSize {
+		return "", 0, errors.Err("blob %s is bigger than the max blob size", hash[:8])
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// watchForDisconnect calls cancel if the client closes the connection while a request is being handled.
+// The returned function stops watching. It must be called before buf is read from again.
+func watchForDisconnect(conn net.Conn, buf *bufio.Reader, cancel context.CancelFunc) func() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := buf.Peek(1) // any pipelined request stays buffered for the next read
+		if err != nil {
+			var ne net.Error
+			if ee.As(err, &ne) && ne.Timeout() {
+				return // stopped watching
+			}
+			cancel()
+		}
+	}()
+	return func() {
+		err := conn.SetReadDeadline(time.Now()) // unblock the Peek
+		if err != nil {
+			log.Error(errors.FullTrace(err))
+		}
+		<-done
+	}
+}
+
+// writeResponse writes the response followed by the blob, if there is one. It closes the blob reader.
+func writeResponse(w io.Writer, response []byte, blob io.ReadCloser) error {
+	if blob != nil {
+		defer blob.Close()
+	}
+
+	n, err := w.Write(response)
+	if err != nil {
+		return err
+	} else if n != len(response) {
+		return errors.Err(io.ErrShortWrite)
+	}
+
+	if blob == nil {
+		return nil
 	}
 
-	return append(respData, blob...), nil
+	_, err = io.Copy(w, blob)
+	return err
 }
 
 func (s *Server) logError(e error) {
@@ -2,9 +2,14 @@ package peer
 
 import (
 	"bytes"
+	"context"
+	"strings"
 	"testing"
 
+	"github.com/irmf/reflector.go/reflector"
 	"github.com/irmf/reflector.go/store"
+
+	"github.com/lbryio/lbry.go/v2/stream"
 )
 
 var blobs = map[string][]byte{
@@ -75,3 +80,88 @@ func TestAvailabilityRequest_WithBlobs(t *testing.T) {
 		}
 	}
 }
+
+func TestCompositeRequest_StreamsBlob(t *testing.T) {
+	st := store.NewMemStore()
+	blob := []byte("this is a blob of stuff")
+	hash := reflector.BlobHash(blob)
+	err := st.Put(hash, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(st)
+
+	response, rc, err := s.handleCompositeRequest(context.Background(), []byte(`{"requested_blob":"`+hash+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc == nil {
+		t.Fatal("expected a blob reader")
+	}
+
+	var out bytes.Buffer
+	err = writeResponse(&out, response, rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := append(response, blob...)
+	if !bytes.Equal(out.Bytes(), expected) {
+		t.Errorf("Response did not match expected response.\nExpected: %s\nGot: %s", string(expected), out.String())
+	}
+	if !bytes.Contains(response, []byte(`"length":23`)) {
+		t.Errorf("Response does not have the blob length. Got %s", string(response))
+	}
+}
+
+func TestCompositeRequest_SendsHashOfBlob(t *testing.T) {
+	st := store.NewMemStore()
+	hash := strings.Repeat("a", stream.BlobHashHexLength)
+	blob := []byte("this is not the blob with that hash")
+	err := st.Put(hash, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(st)
+
+	response, rc, err := s.handleCompositeRequest(context.Background(), []byte(`{"requested_blob":"`+hash+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+
+	if bytes.Contains(response, []byte(hash)) {
+		t.Errorf("Response should have the hash of the blob that is sent, not the requested hash. Got %s", string(response))
+	}
+	if !bytes.Contains(response, []byte(reflector.BlobHash(blob))) {
+		t.Errorf("Response does not have the hash of the blob. Got %s", string(response))
+	}
+}
+
+func TestCompositeRequest_VerifyingStore(t *testing.T) {
+	st := store.NewMemStore()
+	blob := []byte("this is a blob of stuff")
+	hash := reflector.BlobHash(blob)
+	err := st.Put(hash, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(store.NewVerifyingStore("test", st, false, ""))
+
+	response, rc, err := s.handleCompositeRequest(context.Background(), []byte(`{"requested_blob":"`+hash+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	err = writeResponse(&out, response, rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), append(response, blob...)) {
+		t.Errorf("Response did not match expected response. Got: %s", out.String())
+	}
+	if !bytes.Contains(response, []byte(hash)) {
+		t.Errorf("Response does not have the hash of the blob. Got %s", string(response))
+	}
+}
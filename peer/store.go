@@ -1,6 +1,7 @@
 package peer
 
 import (
+	"context"
 	"time"
 
 	"github.com/lbryio/lbry.go/v2/extras/errors"
@@ -24,9 +25,9 @@ func NewStore(opts StoreOpts) *Store {
 	return &Store{opts: opts}
 }
 
-func (p *Store) getClient() (*Client, error) {
+func (p *Store) getClient(ctx context.Context) (*Client, error) {
 	c := &Client{Timeout: p.opts.Timeout}
-	err := c.Connect(p.opts.Address)
+	err := c.ConnectContext(ctx, p.opts.Address)
 	return c, errors.Prefix("connection error", err)
 }
 
@@ -34,22 +35,58 @@ func (p *Store) Name() string { return "peer" }
 
 // Has asks the peer if they have a hash
 func (p *Store) Has(hash string) (bool, error) {
-	c, err := p.getClient()
+	return p.HasContext(context.Background(), hash)
+}
+
+// HasContext is Has with a context
+func (p *Store) HasContext(ctx context.Context, hash string) (bool, error) {
+	c, err := p.getClient(ctx)
 	if err != nil {
 		return false, err
 	}
 	defer c.Close()
-	return c.HasBlob(hash)
+	defer closeOnDone(ctx, c)()
+
+	has, err := c.HasBlob(hash)
+	if ctx.Err() != nil {
+		return false, errors.Err(ctx.Err())
+	}
+	return has, err
 }
 
 // Get downloads the blob from the peer
 func (p *Store) Get(hash string) (stream.Blob, error) {
-	c, err := p.getClient()
+	return p.GetContext(context.Background(), hash)
+}
+
+// GetContext is Get with a context
+func (p *Store) GetContext(ctx context.Context, hash string) (stream.Blob, error) {
+	c, err := p.getClient(ctx)
 	if err != nil {
 		return nil, err
 	}
 	defer c.Close()
-	return c.GetBlob(hash)
+	defer closeOnDone(ctx, c)()
+
+	blob, err := c.GetBlob(hash)
+	if ctx.Err() != nil {
+		return nil, errors.Err(ctx.Err())
+	}
+	return blob, err
+}
+
+// closeOnDone closes the client connection if ctx is done before the returned function is called.
+// Closing the connection unblocks any pending reads or writes.
+func closeOnDone(ctx context.Context, c *Client) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = c.conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
 }
 
 // Put is not supported
@@ -32,7 +32,7 @@ type Config struct {
 	// limit the range of hashes to announce. useful for testing
 	HashRange *bits.Range
 
-	DB    *db.SQL
+	DB    db.DB
 	Blobs store.BlobStore
 }
 
@@ -47,7 +47,7 @@ func DefaultConf() *Config {
 type Prism struct {
 	conf *Config
 
-	db        *db.SQL
+	db        db.DB
 	dht       *dht.DHT
 	peer      *peer.Server
 	reflector *reflector.Server
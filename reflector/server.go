@@ -2,7 +2,6 @@ package reflector
 
 import (
 	"bufio"
-	"crypto/sha512"
 	"encoding/hex"
 	"encoding/json"
 	"io"
@@ -400,8 +399,7 @@ func (s *Server) quitting() bool {
 
 // BlobHash returns the sha512 hash hex encoded string of the blob byte slice.
 func BlobHash(blob []byte) string {
-	hashBytes := sha512.Sum384(blob)
-	return hex.EncodeToString(hashBytes[:])
+	return store.BlobHash(blob)
 }
 
 func IsValidJSON(b []byte) bool {
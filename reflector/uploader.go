@@ -29,7 +29,7 @@ type Summary struct {
 }
 
 type Uploader struct {
-	db                     *db.SQL
+	db                     db.DB
 	store                  *store.DBBackedStore // could just be store.BlobStore interface
 	workers                int
 	skipExistsCheck        bool
@@ -40,7 +40,7 @@ type Uploader struct {
 	count Summary
 }
 
-func NewUploader(db *db.SQL, store *store.DBBackedStore, workers int, skipExistsCheck, deleteBlobsAfterUpload bool) *Uploader {
+func NewUploader(db db.DB, store *store.DBBackedStore, workers int, skipExistsCheck, deleteBlobsAfterUpload bool) *Uploader {
 	return &Uploader{
 		db:                     db,
 		store:                  store,
@@ -0,0 +1,57 @@
+package store
+
+import (
+	golru "github.com/hashicorp/golang-lru"
+)
+
+// AdmissionPolicy decides whether a blob fetched from the origin on a cache miss should be stored in the cache.
+// Implementations must be safe for concurrent use.
+type AdmissionPolicy interface {
+	// Name of the policy (useful for metrics)
+	Name() string
+	// Admit is called on every cache miss and returns true if the blob should be cached.
+	Admit(hash string) bool
+}
+
+// AdmitAll caches every blob fetched from the origin.
+type AdmitAll struct{}
+
+const nameAdmitAll = "all"
+
+// Name is the policy name
+func (a *AdmitAll) Name() string { return nameAdmitAll }
+
+// Admit always returns true
+func (a *AdmitAll) Admit(_ string) bool { return true }
+
+// SecondHitPolicy only caches a blob the second time it misses within the recent history. A blob
+// that is requested once, like the long tail fetched by a crawler, never displaces the hot set.
+// This is the same idea as the A1out queue of the 2Q algorithm.
+type SecondHitPolicy struct {
+	// hashes that missed once and have not been admitted yet
+	history *golru.Cache
+}
+
+// NewSecondHitPolicy makes a policy that remembers the last historySize cache misses.
+func NewSecondHitPolicy(historySize int) *SecondHitPolicy {
+	history, err := golru.New(historySize)
+	if err != nil {
+		panic(err)
+	}
+	return &SecondHitPolicy{history: history}
+}
+
+const nameSecondHit = "second-hit"
+
+// Name is the policy name
+func (s *SecondHitPolicy) Name() string { return nameSecondHit }
+
+// Admit returns true if the hash missed recently, and remembers it otherwise
+func (s *SecondHitPolicy) Admit(hash string) bool {
+	if s.history.Contains(hash) {
+		s.history.Remove(hash)
+		return true
+	}
+	s.history.Add(hash, nil)
+	return false
+}
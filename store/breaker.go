@@ -0,0 +1,279 @@
+package store
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/irmf/reflector.go/internal/metrics"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrCircuitOpen is returned instead of calling an origin that is failing
+var ErrCircuitOpen = errors.Base("circuit breaker is open")
+
+// CircuitBreakerStore stops calling an origin that keeps failing, so requests fail fast instead of each
+// waiting for a timeout. Once too many of the recent requests failed or were too slow, the circuit opens
+// and requests fail with ErrCircuitOpen, or are read from the fallback store if there is one. After
+// OpenTimeout, one request at a time is let through as a probe. The circuit closes again when a probe
+// succeeds.
+type CircuitBreakerStore struct {
+	origin BlobStore
+	opts   CircuitBreakerOpts
+
+	mu       sync.Mutex
+	state    int
+	openedAt time.Time
+	probing  bool
+	// outcomes of the last Window requests while the circuit was closed, true for failures
+	results  []bool
+	next     int
+	failures int
+}
+
+// CircuitBreakerOpts allows to set options for a new CircuitBreakerStore.
+type CircuitBreakerOpts struct {
+	// how many recent requests to look at
+	Window int
+	// the circuit opens when this many of the recent requests failed
+	MaxFailures int
+	// requests that take longer than this count as failed even if they succeed. 0 = no limit
+	SlowThreshold time.Duration
+	// how long the circuit stays open before a probe is let through
+	OpenTimeout time.Duration
+	// if set, reads go here while the circuit is open. writes always fail fast
+	Fallback BlobStore
+	// used as the component label in metrics
+	Component string
+}
+
+// breaker states, as reported in metrics.CircuitBreakerState
+const (
+	breakerClosed   = 0
+	breakerHalfOpen = 1
+	breakerOpen     = 2
+)
+
+// NewCircuitBreakerStore returns a store that calls origin until it fails too often
+func NewCircuitBreakerStore(origin BlobStore, opts CircuitBreakerOpts) *CircuitBreakerStore {
+	if opts.Window <= 0 {
+		opts.Window = 20
+	}
+	if opts.MaxFailures <= 0 || opts.MaxFailures > opts.Window {
+		opts.MaxFailures = opts.Window / 4
+		if opts.MaxFailures == 0 {
+			opts.MaxFailures = 1
+		}
+	}
+	if opts.OpenTimeout <= 0 {
+		opts.OpenTimeout = 30 * time.Second
+	}
+	c := &CircuitBreakerStore{
+		origin:  origin,
+		opts:    opts,
+		results: make([]bool, opts.Window),
+	}
+	metrics.CircuitBreakerState.With(c.labels()).Set(breakerClosed)
+	return c
+}
+
+// Name is the cache type name
+func (c *CircuitBreakerStore) Name() string { return "breaker_" + c.origin.Name() }
+
+// Has checks the origin, or the fallback if the circuit is open
+func (c *CircuitBreakerStore) Has(hash string) (bool, error) {
+	return c.HasContext(context.Background(), hash)
+}
+
+// HasContext is Has with a context
+func (c *CircuitBreakerStore) HasContext(ctx context.Context, hash string) (bool, error) {
+	var has bool
+	err := c.call(func() error {
+		var err error
+		has, err = HasContext(ctx, c.origin, hash)
+		return err
+	})
+	if c.useFallback(err) {
+		return HasContext(ctx, c.opts.Fallback, hash)
+	}
+	return has, err
+}
+
+// Get gets the blob from the origin, or from the fallback if the circuit is open
+func (c *CircuitBreakerStore) Get(hash string) (stream.Blob, error) {
+	return c.GetContext(context.Background(), hash)
+}
+
+// GetContext is Get with a context
+func (c *CircuitBreakerStore) GetContext(ctx context.Context, hash string) (stream.Blob, error) {
+	var blob stream.Blob
+	err := c.call(func() error {
+		var err error
+		blob, err = GetContext(ctx, c.origin, hash)
+		return err
+	})
+	if c.useFallback(err) {
+		return GetContext(ctx, c.opts.Fallback, hash)
+	}
+	return blob, err
+}
+
+// GetReader returns a reader for the blob from the origin, or from the fallback if the circuit is open.
+// Only errors that happen before the reader is returned are counted.
+func (c *CircuitBreakerStore) GetReader(hash string) (io.ReadCloser, int64, error) {
+	return c.GetReaderContext(context.Background(), hash)
+}
+
+// GetReaderContext is GetReader with a context
+func (c *CircuitBreakerStore) GetReaderContext(ctx context.Context, hash string) (io.ReadCloser, int64, error) {
+	var rc io.ReadCloser
+	var size int64
+	err := c.call(func() error {
+		var err error
+		rc, size, err = GetReaderContext(ctx, c.origin, hash)
+		return err
+	})
+	if c.useFallback(err) {
+		return GetReaderContext(ctx, c.opts.Fallback, hash)
+	}
+	return rc, size, err
+}
+
+// Put stores the blob in the origin
+func (c *CircuitBreakerStore) Put(hash string, blob stream.Blob) error {
+	return c.call(func() error { return c.origin.Put(hash, blob) })
+}
+
+// PutSD stores the sd blob in the origin
+func (c *CircuitBreakerStore) PutSD(hash string, blob stream.Blob) error {
+	return c.call(func() error { return c.origin.PutSD(hash, blob) })
+}
+
+// PutReader stores the blob read from r in the origin
+func (c *CircuitBreakerStore) PutReader(hash string, r io.Reader) error {
+	return c.call(func() error { return PutReader(c.origin, hash, r) })
+}
+
+// Delete deletes the blob from the origin
+func (c *CircuitBreakerStore) Delete(hash string) error {
+	return c.call(func() error { return c.origin.Delete(hash) })
+}
+
+func (c *CircuitBreakerStore) useFallback(err error) bool {
+	return c.opts.Fallback != nil && errors.Is(err, ErrCircuitOpen)
+}
+
+// call runs fn if the circuit allows it, and records the outcome
+func (c *CircuitBreakerStore) call(fn func() error) error {
+	probe, ok := c.allow()
+	if !ok {
+		metrics.CircuitBreakerRejectCount.With(c.labels()).Inc()
+		return errors.Err(ErrCircuitOpen)
+	}
+
+	start := time.Now()
+	err := fn()
+	c.record(probe, err, time.Since(start))
+	return err
+}
+
+// allow returns whether a request may go to the origin, and whether it's a probe
+func (c *CircuitBreakerStore) allow() (probe bool, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == breakerOpen && time.Since(c.openedAt) >= c.opts.OpenTimeout {
+		c.setState(breakerHalfOpen)
+	}
+
+	switch c.state {
+	case breakerClosed:
+		return false, true
+	case breakerHalfOpen:
+		if c.probing {
+			return false, false
+		}
+		c.probing = true
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+func (c *CircuitBreakerStore) record(probe bool, err error, took time.Duration) {
+	// missing blobs are a normal answer, and cancelled requests say nothing about the origin
+	cancelled := errors.Is(err, context.Canceled)
+	failed := err != nil && !errors.Is(err, ErrBlobNotFound) && !cancelled
+	if c.opts.SlowThreshold > 0 && took > c.opts.SlowThreshold {
+		failed = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if probe {
+		c.probing = false
+		if cancelled {
+			return // stays half-open, the next request is the probe
+		}
+		if failed {
+			c.open(err, took)
+		} else {
+			c.close()
+		}
+		return
+	}
+	if c.state != breakerClosed || cancelled {
+		return // started before the circuit opened, or says nothing about the origin
+	}
+
+	if c.results[c.next] {
+		c.failures--
+	}
+	c.results[c.next] = failed
+	if failed {
+		c.failures++
+	}
+	c.next = (c.next + 1) % len(c.results)
+
+	if c.failures >= c.opts.MaxFailures {
+		c.open(err, took)
+	}
+}
+
+// open opens the circuit. must be called with the lock held
+func (c *CircuitBreakerStore) open(err error, took time.Duration) {
+	if c.state != breakerOpen {
+		reason := "too slow (" + took.String() + ")"
+		if err != nil {
+			reason = err.Error()
+		}
+		log.Warnf("circuit breaker for %s is open for %s, last failure: %s", c.origin.Name(), c.opts.OpenTimeout, reason)
+	}
+	c.openedAt = time.Now()
+	c.setState(breakerOpen)
+}
+
+// close closes the circuit and forgets past failures. must be called with the lock held
+func (c *CircuitBreakerStore) close() {
+	log.Infof("circuit breaker for %s is closed", c.origin.Name())
+	for i := range c.results {
+		c.results[i] = false
+	}
+	c.failures = 0
+	c.setState(breakerClosed)
+}
+
+func (c *CircuitBreakerStore) setState(state int) {
+	c.state = state
+	metrics.CircuitBreakerState.With(c.labels()).Set(float64(state))
+}
+
+func (c *CircuitBreakerStore) labels() map[string]string {
+	return metrics.CacheLabels(c.origin.Name(), c.opts.Component)
+}
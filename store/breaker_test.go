@@ -0,0 +1,135 @@
+package store
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreakerStore_Opens(t *testing.T) {
+	origin := &flakyStore{MemStore: NewMemStore(), failures: 3}
+	c := NewCircuitBreakerStore(origin, CircuitBreakerOpts{Window: 10, MaxFailures: 3, OpenTimeout: 50 * time.Millisecond})
+
+	for i := 0; i < 3; i++ {
+		err := c.Put("hash", []byte("blob"))
+		require.Error(t, err)
+		assert.False(t, errors.Is(err, ErrCircuitOpen))
+	}
+
+	// the origin works again, but the circuit is open
+	err := c.Put("hash", []byte("blob"))
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+	_, err = c.Get("hash")
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, c.Put("hash", []byte("blob")), "the probe should go through and close the circuit")
+	blob, err := c.Get("hash")
+	require.NoError(t, err)
+	assert.EqualValues(t, "blob", blob)
+}
+
+func TestCircuitBreakerStore_NotFoundIsNotAFailure(t *testing.T) {
+	c := NewCircuitBreakerStore(NewMemStore(), CircuitBreakerOpts{Window: 2, MaxFailures: 1})
+	for i := 0; i < 5; i++ {
+		_, err := c.Get("nonexistent")
+		assert.True(t, errors.Is(err, ErrBlobNotFound))
+	}
+}
+
+func TestCircuitBreakerStore_GetReaderContextCancelled(t *testing.T) {
+	c := NewCircuitBreakerStore(&waitingStore{MemStore: NewMemStore()}, CircuitBreakerOpts{Window: 2, MaxFailures: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	_, _, err := c.GetReaderContext(ctx, "hash")
+	assert.True(t, errors.Is(err, context.Canceled), "the cancellation should reach the origin")
+
+	_, _, err = c.GetReaderContext(context.Background(), "nonexistent")
+	assert.False(t, errors.Is(err, ErrCircuitOpen), "a cancelled request is not a failure")
+}
+
+func TestCircuitBreakerStore_CancelledProbe(t *testing.T) {
+	origin := &waitingStore{MemStore: NewMemStore()}
+	c := NewCircuitBreakerStore(origin, CircuitBreakerOpts{Window: 2, MaxFailures: 1, OpenTimeout: time.Millisecond})
+	c.mu.Lock()
+	c.open(errors.Err("origin is down"), 0)
+	c.mu.Unlock()
+	time.Sleep(2 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // the client of the probe went away
+	_, _, err := c.GetReaderContext(ctx, "hash")
+	assert.True(t, errors.Is(err, context.Canceled))
+
+	c.mu.Lock()
+	state, probing := c.state, c.probing
+	c.mu.Unlock()
+	assert.Equal(t, breakerHalfOpen, state, "a cancelled probe should not close the circuit")
+	assert.False(t, probing, "the next request should be let through as a probe")
+}
+
+// waitingStore answers GetReaderContext only once the context is done, except for "nonexistent"
+type waitingStore struct {
+	*MemStore
+}
+
+func (w *waitingStore) GetReaderContext(ctx context.Context, hash string) (io.ReadCloser, int64, error) {
+	if hash == "nonexistent" {
+		return nil, 0, errors.Err(ErrBlobNotFound)
+	}
+	<-ctx.Done()
+	return nil, 0, errors.Err(ctx.Err())
+}
+
+func TestCircuitBreakerStore_Fallback(t *testing.T) {
+	slow := NewSlowBlobStore(20 * time.Millisecond)
+	fallback := NewMemStore()
+	require.NoError(t, slow.Put("hash", []byte("from the origin")))
+	require.NoError(t, fallback.Put("hash", []byte("from the fallback")))
+
+	c := NewCircuitBreakerStore(slow, CircuitBreakerOpts{
+		Window:        4,
+		MaxFailures:   1,
+		SlowThreshold: 10 * time.Millisecond,
+		OpenTimeout:   time.Minute,
+		Fallback:      fallback,
+	})
+
+	blob, err := c.Get("hash")
+	require.NoError(t, err)
+	assert.EqualValues(t, "from the origin", blob, "a slow response still counts")
+
+	blob, err = c.Get("hash")
+	require.NoError(t, err)
+	assert.EqualValues(t, "from the fallback", blob)
+
+	err = c.Put("other", []byte("blob"))
+	assert.True(t, errors.Is(err, ErrCircuitOpen), "writes should not go to the fallback")
+}
+
+func TestCircuitBreakerStore_OneProbeAtATime(t *testing.T) {
+	origin := &flakyStore{MemStore: NewMemStore(), failures: 1}
+	c := NewCircuitBreakerStore(origin, CircuitBreakerOpts{Window: 2, MaxFailures: 1, OpenTimeout: time.Millisecond})
+	require.Error(t, c.Put("hash", []byte("blob")))
+	time.Sleep(2 * time.Millisecond)
+
+	probe, ok := c.allow()
+	assert.True(t, probe && ok)
+	_, ok = c.allow()
+	assert.False(t, ok, "only one probe should be let through")
+
+	c.record(true, errors.Err("still failing"), 0)
+	_, ok = c.allow()
+	assert.False(t, ok, "a failed probe should open the circuit again")
+}
@@ -1,6 +1,11 @@
 package store
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strconv"
 	"time"
 
 	"github.com/lbryio/lbry.go/v2/extras/errors"
@@ -15,14 +20,23 @@ import (
 type CachingStore struct {
 	origin, cache BlobStore
 	component     string
+	// decides which origin blobs are cached on a miss
+	policy AdmissionPolicy
 }
 
 // NewCachingStore makes a new caching disk store and returns a pointer to it.
 func NewCachingStore(component string, origin, cache BlobStore) *CachingStore {
+	return NewCachingStoreWithPolicy(component, origin, cache, &AdmitAll{})
+}
+
+// NewCachingStoreWithPolicy makes a new caching store that uses the policy to decide which blobs
+// fetched from the origin get cached. Blobs that are Put are always cached.
+func NewCachingStoreWithPolicy(component string, origin, cache BlobStore, policy AdmissionPolicy) *CachingStore {
 	return &CachingStore{
 		component: component,
 		origin:    WithSingleFlight(component, origin),
 		cache:     cache,
+		policy:    policy,
 	}
 }
 
@@ -33,40 +47,91 @@ func (c *CachingStore) Name() string { return nameCaching }
 
 // Has checks the cache and then the origin for a hash. It returns true if either store has it.
 func (c *CachingStore) Has(hash string) (bool, error) {
-	has, err := c.cache.Has(hash)
+	return c.HasContext(context.Background(), hash)
+}
+
+// HasContext is Has with a context
+func (c *CachingStore) HasContext(ctx context.Context, hash string) (bool, error) {
+	has, err := HasContext(ctx, c.cache, hash)
 	if has || err != nil {
 		return has, err
 	}
-	return c.origin.Has(hash)
+	return HasContext(ctx, c.origin, hash)
 }
 
 // Get tries to get the blob from the cache first, falling back to the origin. If the blob comes
 // from the origin, it is also stored in the cache.
 func (c *CachingStore) Get(hash string) (stream.Blob, error) {
+	return c.GetContext(context.Background(), hash)
+}
+
+// GetContext is Get with a context. Only the origin request is affected by the context.
+func (c *CachingStore) GetContext(ctx context.Context, hash string) (stream.Blob, error) {
 	start := time.Now()
 	blob, err := c.cache.Get(hash)
-	if err == nil || !errors.Is(err, ErrBlobNotFound) {
+	err = c.dropCorrupt(hash, err)
+	if err != nil && !errors.Is(err, ErrBlobNotFound) {
+		return nil, err
+	}
+	if err == nil {
 		metrics.CacheHitCount.With(metrics.CacheLabels(c.cache.Name(), c.component)).Inc()
+		c.trackPolicy(metrics.ResultHit)
 		rate := float64(len(blob)) / 1024 / 1024 / time.Since(start).Seconds()
 		metrics.CacheRetrievalSpeed.With(map[string]string{
 			metrics.LabelCacheType: c.cache.Name(),
 			metrics.LabelComponent: c.component,
 			metrics.LabelSource:    "cache",
 		}).Set(rate)
-		return blob, err
+		return blob, nil
 	}
 
 	metrics.CacheMissCount.With(metrics.CacheLabels(c.cache.Name(), c.component)).Inc()
+	c.trackPolicy(metrics.ResultMiss)
 
-	blob, err = c.origin.Get(hash)
+	blob, err = GetContext(ctx, c.origin, hash)
 	if err != nil {
 		return nil, err
 	}
 
-	err = c.cache.Put(hash, blob)
+	err = c.admit(hash, blob)
 	return blob, err
 }
 
+// GetReader streams the blob from the cache if it's there. On a cache miss, the blob is fetched from the
+// origin and stored in the cache before it is returned.
+func (c *CachingStore) GetReader(hash string) (io.ReadCloser, int64, error) {
+	return c.GetReaderContext(context.Background(), hash)
+}
+
+// GetReaderContext is GetReader with a context. Only the origin request is affected by the context.
+func (c *CachingStore) GetReaderContext(ctx context.Context, hash string) (io.ReadCloser, int64, error) {
+	rc, size, err := GetReader(c.cache, hash)
+	err = c.dropCorrupt(hash, err)
+	if err != nil && !errors.Is(err, ErrBlobNotFound) {
+		return nil, 0, err
+	}
+	if err == nil {
+		metrics.CacheHitCount.With(metrics.CacheLabels(c.cache.Name(), c.component)).Inc()
+		c.trackPolicy(metrics.ResultHit)
+		return rc, size, nil
+	}
+
+	metrics.CacheMissCount.With(metrics.CacheLabels(c.cache.Name(), c.component)).Inc()
+	c.trackPolicy(metrics.ResultMiss)
+
+	blob, err := GetContext(ctx, c.origin, hash)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	err = c.admit(hash, blob)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(blob)), int64(len(blob)), nil
+}
+
 // Put stores the blob in the origin and the cache
 func (c *CachingStore) Put(hash string, blob stream.Blob) error {
 	err := c.origin.Put(hash, blob)
@@ -76,6 +141,27 @@ func (c *CachingStore) Put(hash string, blob stream.Blob) error {
 	return c.cache.Put(hash, blob)
 }
 
+// PutReader streams the blob into the cache, and then from the cache into the origin
+func (c *CachingStore) PutReader(hash string, r io.Reader) error {
+	err := PutReader(c.cache, hash, r)
+	if err != nil {
+		return err
+	}
+
+	rc, _, err := GetReader(c.cache, hash)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	err = PutReader(c.origin, hash, rc)
+	if err != nil {
+		_ = c.cache.Delete(hash) // the cache should not have blobs that the origin rejected
+		return err
+	}
+	return nil
+}
+
 // PutSD stores the sd blob in the origin and the cache
 func (c *CachingStore) PutSD(hash string, blob stream.Blob) error {
 	err := c.origin.PutSD(hash, blob)
@@ -93,3 +179,40 @@ func (c *CachingStore) Delete(hash string) error {
 	}
 	return c.cache.Delete(hash)
 }
+
+// dropCorrupt deletes a corrupt blob from the cache, so it gets fetched from the origin again. It turns
+// ErrBlobCorrupt into ErrBlobNotFound and returns other errors unchanged.
+func (c *CachingStore) dropCorrupt(hash string, err error) error {
+	if !errors.Is(err, ErrBlobCorrupt) {
+		return err
+	}
+	delErr := c.cache.Delete(hash)
+	if delErr != nil {
+		return delErr
+	}
+	return errors.Err(ErrBlobNotFound)
+}
+
+// admit stores a blob fetched from the origin in the cache if the admission policy allows it
+func (c *CachingStore) admit(hash string, blob stream.Blob) error {
+	admitted := c.policy.Admit(hash)
+	metrics.CacheAdmissionCount.With(map[string]string{
+		metrics.LabelCacheType: c.cache.Name(),
+		metrics.LabelComponent: c.component,
+		metrics.LabelPolicy:    c.policy.Name(),
+		metrics.LabelAdmitted:  strconv.FormatBool(admitted),
+	}).Inc()
+	if !admitted {
+		return nil
+	}
+	return c.cache.Put(hash, blob)
+}
+
+func (c *CachingStore) trackPolicy(result string) {
+	metrics.CachePolicyRequestCount.With(map[string]string{
+		metrics.LabelCacheType: c.cache.Name(),
+		metrics.LabelComponent: c.component,
+		metrics.LabelPolicy:    c.policy.Name(),
+		metrics.LabelResult:    result,
+	}).Inc()
+}
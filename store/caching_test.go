@@ -2,10 +2,13 @@ package store
 
 import (
 	"bytes"
+	"context"
+	"io/ioutil"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/lbryio/lbry.go/v2/extras/errors"
 	"github.com/lbryio/lbry.go/v2/stream"
 )
 
@@ -76,6 +79,177 @@ func TestCachingStore_CacheMiss(t *testing.T) {
 	}
 }
 
+func TestCachingStore_GetReader(t *testing.T) {
+	origin := NewMemStore()
+	cache := NewMemStore()
+	s := NewCachingStore("test", origin, cache)
+
+	b := []byte("this is a blob of stuff")
+	hash := "hash"
+	err := origin.Put(hash, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ { // first is a cache miss, second is a hit
+		rc, size, err := s.GetReader(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != int64(len(b)) {
+			t.Errorf("expected GetReader() to return size %d, got %d", len(b), size)
+		}
+		if !bytes.Equal(b, res) {
+			t.Errorf("expected GetReader() to return %s, got %s", string(b), string(res))
+		}
+	}
+
+	has, err := cache.Has(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !has {
+		t.Errorf("GetReader() did not copy blob to cache")
+	}
+}
+
+func TestCachingStore_CorruptCache(t *testing.T) {
+	origin := NewMemStore()
+	cache := &corruptStore{MemStore: NewMemStore()}
+	s := NewCachingStore("test", origin, cache)
+
+	b := []byte("this is a blob of stuff")
+	hash := "hash"
+	err := origin.Put(hash, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, get := range []func() ([]byte, error){
+		func() ([]byte, error) { return s.Get(hash) },
+		func() ([]byte, error) {
+			rc, _, err := s.GetReader(hash)
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return ioutil.ReadAll(rc)
+		},
+	} {
+		err = cache.MemStore.Put(hash, []byte("corrupt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.corrupt = true
+
+		res, err := get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, res) {
+			t.Errorf("expected the blob from the origin, got %s", string(res))
+		}
+		cached, err := cache.MemStore.Get(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, cached) {
+			t.Errorf("expected the corrupt blob to be replaced in the cache, got %s", string(cached))
+		}
+	}
+}
+
+// corruptStore reports its blobs as corrupt until a blob is put in it
+type corruptStore struct {
+	*MemStore
+	corrupt bool
+}
+
+func (c *corruptStore) Get(hash string) (stream.Blob, error) {
+	if c.corrupt {
+		return nil, errors.Err(ErrBlobCorrupt)
+	}
+	return c.MemStore.Get(hash)
+}
+
+func (c *corruptStore) Put(hash string, blob stream.Blob) error {
+	c.corrupt = false
+	return c.MemStore.Put(hash, blob)
+}
+
+func TestCachingStore_PutReader(t *testing.T) {
+	origin := NewMemStore()
+	cache := NewMemStore()
+	s := NewCachingStore("test", origin, cache)
+
+	b := []byte("this is a blob of stuff")
+	hash := "hash"
+
+	err := s.PutReader(hash, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, st := range []BlobStore{origin, cache} {
+		res, err := st.Get(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, res) {
+			t.Errorf("expected %s store to have %s, got %s", st.Name(), string(b), string(res))
+		}
+	}
+}
+
+func TestCachingStore_SecondHitPolicy(t *testing.T) {
+	origin := NewMemStore()
+	cache := NewMemStore()
+	s := NewCachingStoreWithPolicy("test", origin, cache, NewSecondHitPolicy(10))
+
+	b := []byte("this is a blob of stuff")
+	hash := "hash"
+	err := origin.Put(hash, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []bool{false, true} {
+		res, err := s.Get(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, res) {
+			t.Errorf("expected Get() to return %s, got %s", string(b), string(res))
+		}
+
+		has, err := cache.Has(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if has != expected {
+			t.Errorf("after Get() #%d, expected blob in cache to be %t, got %t", i+1, expected, has)
+		}
+	}
+
+	// puts are always cached
+	err = s.Put("hash2", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	has, err := cache.Has("hash2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !has {
+		t.Errorf("failed to store blob in cache")
+	}
+}
+
 func TestCachingStore_ThunderingHerd(t *testing.T) {
 	storeDelay := 100 * time.Millisecond
 	origin := NewSlowBlobStore(storeDelay)
@@ -127,6 +301,49 @@ func TestCachingStore_ThunderingHerd(t *testing.T) {
 	}
 }
 
+func TestCachingStore_GetContextCancelled(t *testing.T) {
+	storeDelay := 100 * time.Millisecond
+	origin := NewSlowBlobStore(storeDelay)
+	cache := NewMemStore()
+	s := NewCachingStore("test", origin, cache)
+
+	b := []byte("this is a blob of stuff")
+	hash := "hash"
+	err := origin.Put(hash, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = s.GetContext(ctx, hash)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected GetContext() to return %s, got %v", context.DeadlineExceeded, err)
+	}
+	if time.Since(start) >= storeDelay {
+		t.Errorf("GetContext() waited for the origin after the context was done")
+	}
+
+	has, err := cache.Has(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has {
+		t.Errorf("cancelled GetContext() should not cache the blob")
+	}
+
+	// a later request with a live context must not be affected by the cancelled one
+	res, err := s.Get(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, res) {
+		t.Errorf("expected Get() to return %s, got %s", string(b), string(res))
+	}
+}
+
 // SlowBlobStore adds a delay to each request
 type SlowBlobStore struct {
 	mem   *MemStore
@@ -153,6 +370,15 @@ func (s *SlowBlobStore) Get(hash string) (stream.Blob, error) {
 	return s.mem.Get(hash)
 }
 
+func (s *SlowBlobStore) GetContext(ctx context.Context, hash string) (stream.Blob, error) {
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return s.mem.Get(hash)
+}
+
 func (s *SlowBlobStore) Put(hash string, blob stream.Blob) error {
 	time.Sleep(s.delay)
 	return s.mem.Put(hash, blob)
@@ -1,6 +1,8 @@
 package store
 
 import (
+	"bytes"
+	"context"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -32,70 +34,119 @@ func (c *CloudFrontROStore) Name() string { return nameCloudFrontRO }
 
 // Has checks if the hash is in the store.
 func (c *CloudFrontROStore) Has(hash string) (bool, error) {
-	status, body, err := c.cfRequest(http.MethodHead, hash)
+	return c.HasContext(context.Background(), hash)
+}
+
+// HasContext is Has with a context
+func (c *CloudFrontROStore) HasContext(ctx context.Context, hash string) (bool, error) {
+	res, err := c.cfRequest(ctx, http.MethodHead, hash)
 	if err != nil {
 		return false, err
 	}
-	defer body.Close()
+	defer res.Body.Close()
 
-	switch status {
+	switch res.StatusCode {
 	case http.StatusNotFound, http.StatusForbidden:
 		return false, nil
 	case http.StatusOK:
 		return true, nil
 	default:
-		return false, errors.Err("unexpected status %d", status)
+		return false, errors.Err("unexpected status %d", res.StatusCode)
 	}
 }
 
 // Get gets the blob from Cloudfront.
 func (c *CloudFrontROStore) Get(hash string) (stream.Blob, error) {
+	return c.GetContext(context.Background(), hash)
+}
+
+// GetContext is Get with a context
+func (c *CloudFrontROStore) GetContext(ctx context.Context, hash string) (stream.Blob, error) {
 	log.Debugf("Getting %s from S3", hash[:8])
 	defer func(t time.Time) {
 		log.Debugf("Getting %s from S3 took %s", hash[:8], time.Since(t).String())
 	}(time.Now())
 
-	status, body, err := c.cfRequest(http.MethodGet, hash)
+	res, err := c.cfRequest(ctx, http.MethodGet, hash)
 	if err != nil {
 		return nil, err
 	}
-	defer body.Close()
+	defer res.Body.Close()
 
-	switch status {
+	switch res.StatusCode {
 	case http.StatusNotFound, http.StatusForbidden:
 		return nil, errors.Err(ErrBlobNotFound)
 	case http.StatusOK:
-		b, err := ioutil.ReadAll(body)
+		b, err := ioutil.ReadAll(res.Body)
 		if err != nil {
 			return nil, errors.Err(err)
 		}
 		metrics.MtrInBytesS3.Add(float64(len(b)))
 		return b, nil
 	default:
-		return nil, errors.Err("unexpected status %d", status)
+		return nil, errors.Err("unexpected status %d", res.StatusCode)
 	}
 }
 
-func (c *CloudFrontROStore) cfRequest(method, hash string) (int, io.ReadCloser, error) {
+// GetReader returns a reader for the blob body from Cloudfront and its size.
+func (c *CloudFrontROStore) GetReader(hash string) (io.ReadCloser, int64, error) {
+	return c.GetReaderContext(context.Background(), hash)
+}
+
+// GetReaderContext is GetReader with a context
+func (c *CloudFrontROStore) GetReaderContext(ctx context.Context, hash string) (io.ReadCloser, int64, error) {
+	res, err := c.cfRequest(ctx, http.MethodGet, hash)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusNotFound, http.StatusForbidden:
+		res.Body.Close()
+		return nil, 0, errors.Err(ErrBlobNotFound)
+	case http.StatusOK:
+		if res.ContentLength < 0 {
+			// size is unknown, so the body has to be read to find it
+			defer res.Body.Close()
+			b, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				return nil, 0, errors.Err(err)
+			}
+			metrics.MtrInBytesS3.Add(float64(len(b)))
+			return ioutil.NopCloser(bytes.NewReader(b)), int64(len(b)), nil
+		}
+		metrics.MtrInBytesS3.Add(float64(res.ContentLength))
+		return res.Body, res.ContentLength, nil
+	default:
+		res.Body.Close()
+		return nil, 0, errors.Err("unexpected status %d", res.StatusCode)
+	}
+}
+
+func (c *CloudFrontROStore) cfRequest(ctx context.Context, method, hash string) (*http.Response, error) {
 	url := c.endpoint + hash
-	req, err := http.NewRequest(method, url, nil)
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
 	if err != nil {
-		return 0, nil, errors.Err(err)
+		return nil, errors.Err(err)
 	}
 	req.Header.Add("User-Agent", "reflector.go/"+meta.Version)
 
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return 0, nil, errors.Err(err)
+		return nil, errors.Err(err)
 	}
 
-	return res.StatusCode, res.Body, nil
+	return res, nil
 }
 
 func (c *CloudFrontROStore) Put(_ string, _ stream.Blob) error {
 	panic("CloudFrontROStore cannot do writes. Use CloudFrontRWStore")
 }
 
+func (c *CloudFrontROStore) PutReader(_ string, _ io.Reader) error {
+	panic("CloudFrontROStore cannot do writes. Use CloudFrontRWStore")
+}
+
 func (c *CloudFrontROStore) PutSD(_ string, _ stream.Blob) error {
 	panic("CloudFrontROStore cannot do writes. Use CloudFrontRWStore")
 }
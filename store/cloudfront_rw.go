@@ -1,6 +1,9 @@
 package store
 
 import (
+	"context"
+	"io"
+
 	"github.com/lbryio/lbry.go/v2/stream"
 )
 
@@ -29,16 +32,41 @@ func (c *CloudFrontRWStore) Has(hash string) (bool, error) {
 	return c.cf.Has(hash)
 }
 
+// HasContext is Has with a context
+func (c *CloudFrontRWStore) HasContext(ctx context.Context, hash string) (bool, error) {
+	return c.cf.HasContext(ctx, hash)
+}
+
 // Get gets the blob from Cloudfront.
 func (c *CloudFrontRWStore) Get(hash string) (stream.Blob, error) {
 	return c.cf.Get(hash)
 }
 
+// GetContext is Get with a context
+func (c *CloudFrontRWStore) GetContext(ctx context.Context, hash string) (stream.Blob, error) {
+	return c.cf.GetContext(ctx, hash)
+}
+
+// GetReader gets a reader for the blob from Cloudfront.
+func (c *CloudFrontRWStore) GetReader(hash string) (io.ReadCloser, int64, error) {
+	return c.cf.GetReader(hash)
+}
+
+// GetReaderContext is GetReader with a context
+func (c *CloudFrontRWStore) GetReaderContext(ctx context.Context, hash string) (io.ReadCloser, int64, error) {
+	return c.cf.GetReaderContext(ctx, hash)
+}
+
 // Put stores the blob on S3
 func (c *CloudFrontRWStore) Put(hash string, blob stream.Blob) error {
 	return c.s3.Put(hash, blob)
 }
 
+// PutReader stores the blob read from r on S3
+func (c *CloudFrontRWStore) PutReader(hash string, r io.Reader) error {
+	return c.s3.PutReader(hash, r)
+}
+
 // PutSD stores the sd blob on S3
 func (c *CloudFrontRWStore) PutSD(hash string, blob stream.Blob) error {
 	return c.s3.PutSD(hash, blob)
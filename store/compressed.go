@@ -0,0 +1,152 @@
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/irmf/reflector.go/internal/metrics"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+)
+
+// CompressedStore compresses blobs before they go into the underlying store, when that makes them smaller.
+// SD blobs are JSON and usually shrink a lot, while encrypted content blobs usually don't shrink at all and
+// are stored as they are.
+//
+// Compressed blobs start with a header naming the encoding. Blobs without the header are read as they are,
+// so a store that already has uncompressed blobs in it can be wrapped without migrating it.
+type CompressedStore struct {
+	BlobStore
+
+	component string
+}
+
+// compressed blobs start with compressionMagic followed by one byte for the encoding. a blob that doesn't
+// compress but happens to start with compressionMagic is stored with the encodingRaw header.
+var compressionMagic = []byte{0xfd, 'r', 'f', 'z'}
+
+const (
+	encodingRaw   = 0
+	encodingFlate = 1
+
+	compressionHeaderSize = 5
+	// for bigger blobs, only the start is compressed at first, to quickly skip blobs that don't compress
+	compressionSampleSize = 64 * 1024
+)
+
+// NewCompressedStore returns a store that compresses blobs stored in s
+func NewCompressedStore(component string, s BlobStore) *CompressedStore {
+	return &CompressedStore{BlobStore: s, component: component}
+}
+
+// Name is the cache type name
+func (c *CompressedStore) Name() string { return "compressed_" + c.BlobStore.Name() }
+
+// Get gets the blob and decompresses it if needed
+func (c *CompressedStore) Get(hash string) (stream.Blob, error) {
+	blob, err := c.BlobStore.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	return decodeBlob(blob)
+}
+
+// Put compresses the blob if that makes it smaller, then stores it
+func (c *CompressedStore) Put(hash string, blob stream.Blob) error {
+	encoded, err := c.encode(blob)
+	if err != nil {
+		return err
+	}
+	return c.BlobStore.Put(hash, encoded)
+}
+
+// PutSD compresses the sd blob if that makes it smaller, then stores it
+func (c *CompressedStore) PutSD(hash string, blob stream.Blob) error {
+	encoded, err := c.encode(blob)
+	if err != nil {
+		return err
+	}
+	return c.BlobStore.PutSD(hash, encoded)
+}
+
+func (c *CompressedStore) encode(blob stream.Blob) ([]byte, error) {
+	labels := metrics.CacheLabels(c.BlobStore.Name(), c.component)
+	metrics.CompressionInputBytes.With(labels).Add(float64(len(blob)))
+
+	var encoded []byte
+	if len(blob) <= compressionSampleSize || compresses(blob[:compressionSampleSize]) {
+		compressed, err := deflate(blob)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed)+compressionHeaderSize < len(blob) {
+			encoded = withHeader(encodingFlate, compressed)
+		}
+	}
+
+	if encoded == nil {
+		metrics.CompressionSkippedCount.With(labels).Inc()
+		encoded = blob
+		if bytes.HasPrefix(blob, compressionMagic) {
+			encoded = withHeader(encodingRaw, blob)
+		}
+	}
+
+	metrics.CompressionOutputBytes.With(labels).Add(float64(len(encoded)))
+	return encoded, nil
+}
+
+// compresses returns true if the sample gets smaller when it's compressed
+func compresses(sample []byte) bool {
+	compressed, err := deflate(sample)
+	return err == nil && len(compressed) < len(sample)
+}
+
+func deflate(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func withHeader(encoding byte, b []byte) []byte {
+	encoded := make([]byte, 0, compressionHeaderSize+len(b))
+	encoded = append(encoded, compressionMagic...)
+	encoded = append(encoded, encoding)
+	return append(encoded, b...)
+}
+
+// decodeBlob returns the blob as it was before it was stored by a CompressedStore
+func decodeBlob(b []byte) ([]byte, error) {
+	if len(b) < compressionHeaderSize || !bytes.HasPrefix(b, compressionMagic) {
+		return b, nil
+	}
+
+	switch b[len(compressionMagic)] {
+	case encodingRaw:
+		return b[compressionHeaderSize:], nil
+	case encodingFlate:
+		r := flate.NewReader(bytes.NewReader(b[compressionHeaderSize:]))
+		defer r.Close()
+		blob, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, errors.Err(ErrBlobCorrupt)
+		}
+		return blob, nil
+	default:
+		return nil, errors.Prefix(fmt.Sprintf("unknown blob encoding %d", b[len(compressionMagic)]), ErrBlobCorrupt)
+	}
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressedStore_Compressible(t *testing.T) {
+	mem := NewMemStore()
+	c := NewCompressedStore("test", mem)
+
+	sd := bytes.Repeat([]byte(`{"blob_hash": "abcdef", "blob_num": 1, "iv": "0123456789", "length": 2097152},`), 100)
+	hash := BlobHash(sd)
+	require.NoError(t, c.PutSD(hash, sd))
+
+	stored, err := mem.Get(hash)
+	require.NoError(t, err)
+	assert.True(t, len(stored) < len(sd)/10, "sd blob should be compressed")
+
+	read, err := c.Get(hash)
+	require.NoError(t, err)
+	assert.EqualValues(t, sd, read)
+}
+
+func TestCompressedStore_Incompressible(t *testing.T) {
+	mem := NewMemStore()
+	c := NewCompressedStore("test", mem)
+
+	blob := make([]byte, 2*compressionSampleSize)
+	_, err := rand.Read(blob)
+	require.NoError(t, err)
+	hash := BlobHash(blob)
+	require.NoError(t, c.Put(hash, blob))
+
+	stored, err := mem.Get(hash)
+	require.NoError(t, err)
+	assert.EqualValues(t, blob, stored, "blob that doesn't compress should be stored as it is")
+
+	// a blob that looks like it has a header must still come back as it was
+	tricky := append(append([]byte{}, compressionMagic...), encodingFlate, 1, 2, 3)
+	require.NoError(t, c.Put(BlobHash(tricky), tricky))
+	read, err := c.Get(BlobHash(tricky))
+	require.NoError(t, err)
+	assert.EqualValues(t, tricky, read)
+
+	// blobs stored before compression was enabled can be read
+	old := []byte("stored without compression")
+	require.NoError(t, mem.Put(BlobHash(old), old))
+	read, err = c.Get(BlobHash(old))
+	require.NoError(t, err)
+	assert.EqualValues(t, old, read)
+}
+
+func TestCompressedStore_Corrupt(t *testing.T) {
+	mem := NewMemStore()
+	v := NewVerifyingStore("test", NewCompressedStore("test", mem), true, "")
+
+	blob := bytes.Repeat([]byte("this is a blob of stuff"), 100)
+	hash := BlobHash(blob)
+	require.NoError(t, v.Put(hash, blob))
+
+	stored, err := mem.Get(hash)
+	require.NoError(t, err)
+	require.NoError(t, mem.Put(hash, stored[:len(stored)/2]))
+
+	_, err = v.Get(hash)
+	assert.True(t, errors.Is(err, ErrBlobNotFound), "corrupt blob should be reported as missing")
+	has, err := mem.Has(hash)
+	require.NoError(t, err)
+	assert.False(t, has, "corrupt blob should be deleted")
+}
+
+func TestCompressedStore_UnknownEncoding(t *testing.T) {
+	mem := NewMemStore()
+	c := NewCompressedStore("test", mem)
+	require.NoError(t, mem.Put("hash", withHeader(0xff, []byte("this is a blob of stuff"))))
+
+	_, err := c.Get("hash")
+	assert.True(t, errors.Is(err, ErrBlobCorrupt), "an unknown encoding should be reported as a corrupt blob")
+
+	// so a cache with a corrupt entry refetches the blob from the origin
+	origin := NewMemStore()
+	require.NoError(t, origin.Put("hash", []byte("this is a blob of stuff")))
+	blob, err := NewCachingStore("test", origin, c).Get("hash")
+	require.NoError(t, err)
+	assert.EqualValues(t, "this is a blob of stuff", blob)
+}
+
+func TestCompressedStore_Fsck(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	c := NewCompressedStore("test", NewDiskStore(tmpDir, 2))
+	blob := bytes.Repeat([]byte("this is a blob of stuff"), 100)
+	require.NoError(t, c.Put(BlobHash(blob), blob))
+
+	report, err := Fsck(tmpDir, FsckOpts{PrefixLength: 2})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.OK, "compressed blobs should pass the hash check")
+}
@@ -1,7 +1,9 @@
 package store
 
 import (
+	"context"
 	"encoding/json"
+	"io"
 	"sync"
 
 	"github.com/irmf/reflector.go/db"
@@ -15,13 +17,13 @@ import (
 // DBBackedStore is a store that's backed by a DB. The DB contains data about what's in the store.
 type DBBackedStore struct {
 	blobs     BlobStore
-	db        *db.SQL
+	db        db.DB
 	blockedMu sync.RWMutex
 	blocked   map[string]bool
 }
 
 // NewDBBackedStore returns an initialized store pointer.
-func NewDBBackedStore(blobs BlobStore, db *db.SQL) *DBBackedStore {
+func NewDBBackedStore(blobs BlobStore, db db.DB) *DBBackedStore {
 	return &DBBackedStore{blobs: blobs, db: db}
 }
 
@@ -32,12 +34,22 @@ func (d *DBBackedStore) Name() string { return nameDBBacked }
 
 // Has returns true if the blob is in the store
 func (d *DBBackedStore) Has(hash string) (bool, error) {
-	return d.db.HasBlob(hash)
+	return d.HasContext(context.Background(), hash)
+}
+
+// HasContext is Has with a context
+func (d *DBBackedStore) HasContext(ctx context.Context, hash string) (bool, error) {
+	return d.db.HasBlobContext(ctx, hash)
 }
 
 // Get gets the blob
 func (d *DBBackedStore) Get(hash string) (stream.Blob, error) {
-	has, err := d.db.HasBlob(hash)
+	return d.GetContext(context.Background(), hash)
+}
+
+// GetContext is Get with a context
+func (d *DBBackedStore) GetContext(ctx context.Context, hash string) (stream.Blob, error) {
+	has, err := d.db.HasBlobContext(ctx, hash)
 	if err != nil {
 		return nil, err
 	}
@@ -45,7 +57,25 @@ func (d *DBBackedStore) Get(hash string) (stream.Blob, error) {
 		return nil, ErrBlobNotFound
 	}
 
-	return d.blobs.Get(hash)
+	return GetContext(ctx, d.blobs, hash)
+}
+
+// GetReader streams the blob from the underlying store if it supports it
+func (d *DBBackedStore) GetReader(hash string) (io.ReadCloser, int64, error) {
+	return d.GetReaderContext(context.Background(), hash)
+}
+
+// GetReaderContext is GetReader with a context
+func (d *DBBackedStore) GetReaderContext(ctx context.Context, hash string) (io.ReadCloser, int64, error) {
+	has, err := d.db.HasBlobContext(ctx, hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !has {
+		return nil, 0, ErrBlobNotFound
+	}
+
+	return GetReaderContext(ctx, d.blobs, hash)
 }
 
 // Put stores the blob in the S3 store and stores the blob information in the DB.
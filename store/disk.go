@@ -1,13 +1,20 @@
 package store
 
 import (
+	"bytes"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/lbryio/lbry.go/v2/extras/errors"
 	"github.com/lbryio/lbry.go/v2/stream"
 	"github.com/irmf/reflector.go/store/speedwalk"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // DiskStore stores blobs on a local disk
@@ -17,6 +24,11 @@ type DiskStore struct {
 	// store files in subdirectories based on the first N chars in the filename. 0 = don't create subdirectories.
 	prefixLength int
 
+	// fsync blobs and their directory before a write returns
+	fsync bool
+
+	// initMu guards initialized, so the temp files are removed before any write starts
+	initMu sync.Mutex
 	// true if initOnce ran, false otherwise
 	initialized bool
 }
@@ -31,6 +43,13 @@ func NewDiskStore(dir string, prefixLength int) *DiskStore {
 
 const nameDisk = "disk"
 
+// tempFilePrefix marks blobs that are still being written. Hashes are hex, so they never start with it.
+const tempFilePrefix = ".tmp-"
+
+// SetFsync sets whether writes are flushed to disk before they return. This is slower, but blobs
+// survive a power loss as soon as Put returns.
+func (d *DiskStore) SetFsync(fsync bool) { d.fsync = fsync }
+
 // Name is the cache type name
 func (d *DiskStore) Name() string { return nameDisk }
 
@@ -66,23 +85,105 @@ func (d *DiskStore) Get(hash string) (stream.Blob, error) {
 		return nil, errors.Err(err)
 	}
 
+	d.touch(hash)
 	return blob, nil
 }
 
 // Put stores the blob on disk
 func (d *DiskStore) Put(hash string, blob stream.Blob) error {
+	return d.PutReader(hash, bytes.NewReader(blob))
+}
+
+// GetReader returns a reader for the blob file and its size, or an error if the blob doesn't exist.
+func (d *DiskStore) GetReader(hash string) (io.ReadCloser, int64, error) {
+	f, size, err := d.open(hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+// GetRange returns a reader for part of the blob file
+func (d *DiskStore) GetRange(hash string, offset, length int64) (io.ReadCloser, error) {
+	f, _, err := d.open(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		_ = f.Close()
+		return nil, errors.Err(err)
+	}
+	return limitReadCloser(f, length), nil
+}
+
+// open opens the blob file for reading and returns its size
+func (d *DiskStore) open(hash string) (*os.File, int64, error) {
+	err := d.initOnce()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	f, err := os.Open(d.path(hash))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, errors.Err(ErrBlobNotFound)
+		}
+		return nil, 0, errors.Err(err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, errors.Err(err)
+	}
+
+	d.touch(hash)
+	return f, fi.Size(), nil
+}
+
+// PutReader stores the blob read from r on disk. The blob is written to a temp file that is renamed once
+// it's complete, so a crash or a full disk never leaves a partial blob behind.
+func (d *DiskStore) PutReader(hash string, r io.Reader) error {
 	err := d.initOnce()
 	if err != nil {
 		return err
 	}
 
-	err = d.ensureDirExists(d.dir(hash))
+	dir := d.dir(hash)
+	err = d.ensureDirExists(dir)
 	if err != nil {
 		return err
 	}
 
-	err = ioutil.WriteFile(d.path(hash), blob, 0644)
-	return errors.Err(err)
+	f, err := ioutil.TempFile(dir, tempFilePrefix+hash+"-*")
+	if err != nil {
+		return errors.Err(err)
+	}
+
+	_, err = io.Copy(f, r)
+	if err == nil && d.fsync {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644) // TempFile creates files with 0600
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), d.path(hash))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return errors.Err(err)
+	}
+
+	if d.fsync {
+		return syncDir(dir)
+	}
+	return nil
 }
 
 // PutSD stores the sd blob on the disk
@@ -116,7 +217,106 @@ func (d *DiskStore) list() ([]string, error) {
 		return nil, err
 	}
 
-	return speedwalk.AllFiles(d.blobDir, true)
+	files, err := speedwalk.AllFiles(d.blobDir, true)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := files[:0]
+	for _, name := range files {
+		if !isTempFile(name) {
+			hashes = append(hashes, name)
+		}
+	}
+	return hashes, nil
+}
+
+// listPrefix returns the hashes of the blobs in the blobDir that start with prefix
+func (d *DiskStore) listPrefix(prefix string) ([]string, error) {
+	err := d.initOnce()
+	if err != nil {
+		return nil, err
+	}
+
+	if d.prefixLength <= 0 {
+		return readNames(d.blobDir, prefix)
+	}
+	if len(prefix) >= d.prefixLength {
+		return readNames(path.Join(d.blobDir, prefix[:d.prefixLength]), prefix)
+	}
+
+	dirs, err := readNames(d.blobDir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var hashes []string
+	for _, dir := range dirs {
+		h, err := readNames(path.Join(d.blobDir, dir), "")
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, h...)
+	}
+	return hashes, nil
+}
+
+// readNames returns the names in dir that start with prefix, except temp files. A missing dir is empty.
+// Names are read in batches, so only the matching ones are kept in memory.
+func readNames(dir, prefix string) ([]string, error) {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer f.Close()
+
+	var names []string
+	for {
+		batch, err := f.Readdirnames(1000)
+		for _, name := range batch {
+			if strings.HasPrefix(name, prefix) && !isTempFile(name) {
+				names = append(names, name)
+			}
+		}
+		if err == io.EOF {
+			return names, nil
+		} else if err != nil {
+			return nil, errors.Err(err)
+		}
+	}
+}
+
+// listInfo returns the hashes, sizes, and access times of blobs that already exist in the blobDir
+func (d *DiskStore) listInfo() ([]blobInfo, error) {
+	err := d.initOnce()
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := speedwalk.AllFileInfos(d.blobDir)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := make([]blobInfo, 0, len(infos))
+	for _, fi := range infos {
+		if !isTempFile(fi.Name()) {
+			blobs = append(blobs, blobInfo{hash: fi.Name(), size: fi.Size(), accessed: atime(fi)})
+		}
+	}
+	return blobs, nil
+}
+
+// touch updates the access and modification times of the blob file. Filesystems are often mounted
+// with noatime or relatime, so reading the file is not enough to record the access. The times are
+// used to restore the LRU order after a restart.
+func (d *DiskStore) touch(hash string) {
+	now := time.Now()
+	err := os.Chtimes(d.path(hash), now, now)
+	if err != nil && !os.IsNotExist(err) {
+		log.Debugf("touching %s: %s", hash, err.Error())
+	}
 }
 
 func (d *DiskStore) dir(hash string) string {
@@ -135,6 +335,8 @@ func (d *DiskStore) ensureDirExists(dir string) error {
 }
 
 func (d *DiskStore) initOnce() error {
+	d.initMu.Lock()
+	defer d.initMu.Unlock()
 	if d.initialized {
 		return nil
 	}
@@ -144,6 +346,48 @@ func (d *DiskStore) initOnce() error {
 		return err
 	}
 
+	err = d.removeTempFiles()
+	if err != nil {
+		return err
+	}
+
 	d.initialized = true
 	return nil
 }
+
+// removeTempFiles removes blobs that were being written when the process last stopped
+func (d *DiskStore) removeTempFiles() error {
+	files, err := speedwalk.AllFiles(d.blobDir, false)
+	if err != nil {
+		return errors.Err(err)
+	}
+
+	for _, f := range files {
+		if !isTempFile(path.Base(f)) {
+			continue
+		}
+		err = os.Remove(f)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Err(err)
+		}
+		log.Debugf("removed partially written blob %s", f)
+	}
+	return nil
+}
+
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, tempFilePrefix)
+}
+
+// syncDir flushes a directory to disk, so that renames in it are durable
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return errors.Err(err)
+	}
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return errors.Err(err)
+}
@@ -1,11 +1,17 @@
 package store
 
 import (
+	"bytes"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/lbryio/lbry.go/v2/extras/errors"
 
@@ -43,3 +49,112 @@ func TestDiskStore_GetNonexistentBlob(t *testing.T) {
 	assert.Nil(t, blob)
 	assert.True(t, errors.Is(err, ErrBlobNotFound))
 }
+
+func TestDiskStore_PutReaderGetReader(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	d := NewDiskStore(tmpDir, 2)
+
+	hash := "1234567890"
+	data := []byte("oyuntyausntoyaunpdoyruoyduanrstjwfjyuwf")
+
+	err = d.PutReader(hash, bytes.NewReader(data))
+	require.NoError(t, err)
+
+	rc, size, err := d.GetReader(hash)
+	require.NoError(t, err)
+	defer rc.Close()
+	assert.EqualValues(t, len(data), size)
+
+	blob, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.EqualValues(t, data, blob)
+
+	_, _, err = d.GetReader("nonexistent")
+	assert.True(t, errors.Is(err, ErrBlobNotFound))
+}
+
+func TestDiskStore_GetTouchesFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	d := NewDiskStore(tmpDir, 2)
+
+	hash := "hash"
+	require.NoError(t, d.Put(hash, []byte("this is a blob of stuff")))
+	old := time.Now().Add(-24 * time.Hour)
+	require.NoError(t, os.Chtimes(d.path(hash), old, old))
+
+	_, err = d.Get(hash)
+	require.NoError(t, err)
+
+	fi, err := os.Stat(d.path(hash))
+	require.NoError(t, err)
+	assert.True(t, atime(fi).After(old), "Get should update the access time")
+}
+
+func TestDiskStore_PartialWrite(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	d := NewDiskStore(tmpDir, 2)
+
+	hash := "1234567890"
+	r := io.MultiReader(bytes.NewReader([]byte("the start of a blob")), iotest.ErrReader(errors.Err("disk full")))
+	err = d.PutReader(hash, r)
+	require.Error(t, err)
+
+	has, err := d.Has(hash)
+	require.NoError(t, err)
+	assert.False(t, has, "a failed write should not leave a blob behind")
+
+	files, err := ioutil.ReadDir(path.Join(tmpDir, hash[:2]))
+	require.NoError(t, err)
+	assert.Empty(t, files, "temp file should be removed")
+}
+
+func TestDiskStore_RemovesTempFilesOnInit(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	// a write that was interrupted by a crash
+	tempFile := path.Join(tmpDir, "12", tempFilePrefix+"1234567890-123")
+	require.NoError(t, os.MkdirAll(filepath.Dir(tempFile), 0755))
+	require.NoError(t, ioutil.WriteFile(tempFile, []byte("the start of a blob"), 0644))
+
+	d := NewDiskStore(tmpDir, 2)
+	d.SetFsync(true)
+	require.NoError(t, d.Put("1234567890", []byte("a whole blob")))
+
+	_, err = os.Stat(tempFile)
+	assert.True(t, os.IsNotExist(err), "temp file should be removed")
+
+	hashes, err := d.list()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1234567890"}, hashes)
+}
+
+func TestDiskStore_ConcurrentFirstPuts(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	d := NewDiskStore(tmpDir, 2)
+
+	// the first calls all initialize the store. none of them should remove another one's temp file
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hash := strconv.Itoa(1000000 + i)
+			assert.NoError(t, d.Put(hash, []byte("blob "+hash)))
+		}(i)
+	}
+	wg.Wait()
+
+	hashes, err := d.list()
+	require.NoError(t, err)
+	assert.Len(t, hashes, 20)
+}
@@ -0,0 +1,439 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"sync"
+
+	"github.com/irmf/reflector.go/internal/metrics"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/klauspost/reedsolomon"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErasureStore splits each blob into data shards plus parity shards with Reed-Solomon coding, and stores
+// shard i in store i. A blob can be read as long as any DataShards of its shards are intact, so it survives
+// losing up to ParityShards stores while using much less space than full replicas.
+type ErasureStore struct {
+	stores []BlobStore
+	opts   ErasureOpts
+	enc    reedsolomon.Encoder
+}
+
+// ErasureOpts allows to set options for a new ErasureStore.
+type ErasureOpts struct {
+	DataShards   int
+	ParityShards int
+	// used as the component label in metrics
+	Component string
+}
+
+// every shard starts with a header, so shards can be checked and the blob can be put back together
+// without any other metadata:
+// version (1 byte), shard index (1 byte), blob size (4 bytes), crc32 of the shard data (4 bytes)
+const (
+	erasureVersion    = 1
+	erasureHeaderSize = 10
+)
+
+// NewErasureStore returns a store that spreads blobs over stores. There must be exactly
+// DataShards+ParityShards stores, and their order must not change once blobs are stored.
+func NewErasureStore(stores []BlobStore, opts ErasureOpts) (*ErasureStore, error) {
+	if opts.DataShards+opts.ParityShards != len(stores) {
+		return nil, errors.Err("need %d stores for %d data and %d parity shards, got %d",
+			opts.DataShards+opts.ParityShards, opts.DataShards, opts.ParityShards, len(stores))
+	}
+	enc, err := reedsolomon.New(opts.DataShards, opts.ParityShards)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	return &ErasureStore{stores: stores, opts: opts, enc: enc}, nil
+}
+
+const nameErasure = "erasure"
+
+// Name is the cache type name
+func (e *ErasureStore) Name() string { return nameErasure }
+
+// Has returns true if enough shards of the blob exist to read it. Shards are not checked for corruption.
+func (e *ErasureStore) Has(hash string) (bool, error) {
+	found := make([]bool, len(e.stores))
+	errs := make([]error, len(e.stores))
+	e.each(all(len(e.stores)), func(i int) {
+		found[i], errs[i] = e.stores[i].Has(hash)
+	})
+
+	count := 0
+	var lastErr error
+	for i := range found {
+		if errs[i] != nil {
+			lastErr = errs[i]
+		} else if found[i] {
+			count++
+		}
+	}
+	if count >= e.opts.DataShards {
+		return true, nil
+	}
+	if lastErr != nil && count+e.failed(errs) >= e.opts.DataShards {
+		return false, lastErr // the blob might be there, but we can't tell
+	}
+	return false, nil
+}
+
+// Get reads the data shards of the blob, and the parity shards too if any data shard is missing or corrupt
+func (e *ErasureStore) Get(hash string) (stream.Blob, error) {
+	shards := make([][]byte, len(e.stores))
+	errs := make([]error, len(e.stores))
+	size := e.readShards(hash, shards, errs, all(e.opts.DataShards))
+
+	if e.count(shards) < e.opts.DataShards {
+		parity := make([]int, e.opts.ParityShards)
+		for i := range parity {
+			parity[i] = e.opts.DataShards + i
+		}
+		paritySize := e.readShards(hash, shards, errs, parity)
+		if size < 0 {
+			size = paritySize
+		}
+
+		err := e.reconstruct(hash, shards, errs, false)
+		if err != nil {
+			return nil, err
+		}
+		metrics.ErasureReconstructCount.With(metrics.CacheLabels(e.Name(), e.opts.Component)).Inc()
+	}
+
+	var buf bytes.Buffer
+	err := e.enc.Join(&buf, shards, size)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Put splits the blob into shards and stores them. It fails if fewer than DataShards shards are stored.
+// Shards that failed to store can be recreated by Scrub.
+func (e *ErasureStore) Put(hash string, blob stream.Blob) error {
+	if len(blob) == 0 {
+		return errors.Err("blob is empty")
+	}
+	// Split uses any spare capacity of the slice for the parity shards, which could belong to the caller
+	shards, err := e.enc.Split(blob[:len(blob):len(blob)])
+	if err != nil {
+		return errors.Err(err)
+	}
+	err = e.enc.Encode(shards)
+	if err != nil {
+		return errors.Err(err)
+	}
+
+	errs := make([]error, len(e.stores))
+	e.each(all(len(e.stores)), func(i int) {
+		errs[i] = e.stores[i].Put(hash, encodeShard(i, len(blob), shards[i]))
+	})
+
+	failed := e.failed(errs)
+	if failed == 0 {
+		return nil
+	}
+	if len(e.stores)-failed < e.opts.DataShards {
+		return errors.Prefix("storing shards", firstErr(errs))
+	}
+	log.Errorf("stored only %d of %d shards of %s: %s", len(e.stores)-failed, len(e.stores), hash,
+		errors.FullTrace(firstErr(errs)))
+	return nil
+}
+
+// PutSD stores the sd blob like any other blob
+func (e *ErasureStore) PutSD(hash string, blob stream.Blob) error {
+	return e.Put(hash, blob)
+}
+
+// Delete deletes all shards of the blob
+func (e *ErasureStore) Delete(hash string) error {
+	errs := make([]error, len(e.stores))
+	e.each(all(len(e.stores)), func(i int) {
+		errs[i] = e.stores[i].Delete(hash)
+	})
+	return firstErr(errs)
+}
+
+// ErasureScrubSummary counts the blobs checked by Scrub
+type ErasureScrubSummary struct {
+	Checked       int `json:"checked"`
+	Repaired      int `json:"repaired"`      // some shards were missing or corrupt and were recreated
+	Unrecoverable int `json:"unrecoverable"` // too few shards are left to recreate the blob
+	Errors        int `json:"errors"`
+}
+
+// Scrub checks every shard of every blob and recreates the ones that are missing or corrupt. Blobs are
+// found by listing the stores, so at least one working store must support listing, e.g. a DiskStore.
+func (e *ErasureStore) Scrub(workers int) (ErasureScrubSummary, error) {
+	var summary ErasureScrubSummary
+	hashes, err := e.list()
+	if err != nil {
+		return summary, err
+	}
+	if workers <= 0 {
+		workers = 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	hashChan := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for hash := range hashChan {
+				repaired, err := e.scrub(hash)
+
+				mu.Lock()
+				summary.Checked++
+				switch {
+				case errors.Is(err, errTooFewShards):
+					summary.Unrecoverable++
+					log.Errorf("scrubbing %s: %s", hash, err.Error())
+				case err != nil:
+					summary.Errors++
+					log.Errorf("scrubbing %s: %s", hash, errors.FullTrace(err))
+				case repaired:
+					summary.Repaired++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, hash := range hashes {
+		hashChan <- hash
+	}
+	close(hashChan)
+	wg.Wait()
+	return summary, nil
+}
+
+var errTooFewShards = errors.Base("too few shards to reconstruct the blob")
+
+// scrub reads all shards of the blob and rewrites the ones that are missing or corrupt
+func (e *ErasureStore) scrub(hash string) (bool, error) {
+	shards := make([][]byte, len(e.stores))
+	errs := make([]error, len(e.stores))
+	size := e.readShards(hash, shards, errs, all(len(e.stores)))
+	if e.count(shards) == len(e.stores) {
+		return false, nil
+	}
+
+	err := e.reconstruct(hash, shards, errs, true)
+	if err != nil {
+		return false, err
+	}
+
+	var missing []int
+	for i := range errs {
+		if errs[i] != nil {
+			missing = append(missing, i)
+		}
+	}
+	e.each(missing, func(i int) {
+		errs[i] = e.stores[i].Put(hash, encodeShard(i, size, shards[i]))
+	})
+	err = firstErr(errs)
+	if err != nil {
+		return false, err
+	}
+	metrics.ErasureReconstructCount.With(metrics.CacheLabels(e.Name(), e.opts.Component)).Inc()
+	return true, nil
+}
+
+// readShards reads the shards at indexes into shards. Shards that are missing or corrupt are left nil and
+// their error is set in errs. It returns the blob size from the shard headers, or -1 if no shard was read.
+func (e *ErasureStore) readShards(hash string, shards [][]byte, errs []error, indexes []int) int {
+	sizes := make([]int, len(e.stores))
+	e.each(indexes, func(i int) {
+		var blob stream.Blob
+		blob, errs[i] = e.stores[i].Get(hash)
+		if errs[i] == nil {
+			shards[i], sizes[i], errs[i] = decodeShard(i, blob)
+		}
+		if errs[i] != nil && !errors.Is(errs[i], ErrBlobNotFound) {
+			log.Errorf("reading shard %d of %s: %s", i, hash, errors.FullTrace(errs[i]))
+		}
+	})
+
+	for _, i := range indexes {
+		if shards[i] != nil {
+			return sizes[i]
+		}
+	}
+	return -1
+}
+
+// reconstruct fills in the missing shards, or only the missing data shards if all is false
+func (e *ErasureStore) reconstruct(hash string, shards [][]byte, errs []error, all bool) error {
+	if e.count(shards) < e.opts.DataShards {
+		for _, err := range errs {
+			if err != nil && !errors.Is(err, ErrBlobNotFound) {
+				return errors.Err(errTooFewShards)
+			}
+		}
+		if e.count(shards) == 0 {
+			return errors.Err(ErrBlobNotFound)
+		}
+		return errors.Err(errTooFewShards)
+	}
+
+	var err error
+	if all {
+		err = e.enc.Reconstruct(shards)
+	} else {
+		err = e.enc.ReconstructData(shards)
+	}
+	if err != nil {
+		return errors.Prefix("reconstructing "+hash, err)
+	}
+	return nil
+}
+
+// list returns the hashes of the blobs in all stores that support listing
+func (e *ErasureStore) list() ([]string, error) {
+	seen := make(map[string]bool)
+	var hashes []string
+	listed := false
+	for _, s := range e.stores {
+		l, ok := s.(lister)
+		if !ok {
+			continue
+		}
+		h, err := l.list()
+		if err != nil {
+			// the store might be the one that lost its shards
+			log.Errorf("listing %s: %s", s.Name(), errors.FullTrace(err))
+			continue
+		}
+		listed = true
+		for _, hash := range h {
+			if !seen[hash] {
+				seen[hash] = true
+				hashes = append(hashes, hash)
+			}
+		}
+	}
+	if !listed {
+		return nil, errors.Err("none of the stores could list their blobs")
+	}
+	return hashes, nil
+}
+
+// listPrefix returns the hashes of the blobs in all stores that can list by prefix that start with prefix
+func (e *ErasureStore) listPrefix(prefix string) ([]string, error) {
+	seen := make(map[string]bool)
+	var hashes []string
+	listed := false
+	for _, s := range e.stores {
+		l, ok := s.(prefixLister)
+		if !ok {
+			continue
+		}
+		h, err := l.listPrefix(prefix)
+		if err != nil {
+			// the store might be the one that lost its shards
+			log.Errorf("listing %s in %s: %s", prefix, s.Name(), errors.FullTrace(err))
+			continue
+		}
+		listed = true
+		for _, hash := range h {
+			if !seen[hash] {
+				seen[hash] = true
+				hashes = append(hashes, hash)
+			}
+		}
+	}
+	if !listed {
+		return nil, errors.Err("none of the stores could list their blobs")
+	}
+	return hashes, nil
+}
+
+// each runs fn for every index at once and waits for them to finish
+func (e *ErasureStore) each(indexes []int, fn func(i int)) {
+	var wg sync.WaitGroup
+	for _, i := range indexes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (e *ErasureStore) count(shards [][]byte) int {
+	n := 0
+	for _, s := range shards {
+		if s != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// failed counts the errors that are not ErrBlobNotFound
+func (e *ErasureStore) failed(errs []error) int {
+	n := 0
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, ErrBlobNotFound) {
+			n++
+		}
+	}
+	return n
+}
+
+func all(n int) []int {
+	indexes := make([]int, n)
+	for i := range indexes {
+		indexes[i] = i
+	}
+	return indexes
+}
+
+func firstErr(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeShard(index, size int, shard []byte) []byte {
+	b := make([]byte, erasureHeaderSize+len(shard))
+	b[0] = erasureVersion
+	b[1] = byte(index)
+	binary.BigEndian.PutUint32(b[2:6], uint32(size))
+	binary.BigEndian.PutUint32(b[6:10], crc32.ChecksumIEEE(shard))
+	copy(b[erasureHeaderSize:], shard)
+	return b
+}
+
+func decodeShard(index int, b []byte) ([]byte, int, error) {
+	if len(b) < erasureHeaderSize {
+		return nil, 0, errors.Err("shard is too short")
+	}
+	if b[0] != erasureVersion {
+		return nil, 0, errors.Err("unknown shard version %d", b[0])
+	}
+	if int(b[1]) != index {
+		return nil, 0, errors.Err("expected shard %d, got shard %d", index, b[1])
+	}
+	shard := b[erasureHeaderSize:]
+	if crc32.ChecksumIEEE(shard) != binary.BigEndian.Uint32(b[6:10]) {
+		return nil, 0, errors.Err("shard is corrupt")
+	}
+	return shard, int(binary.BigEndian.Uint32(b[2:6])), nil
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newErasureMemStore(t *testing.T) (*ErasureStore, []*MemStore) {
+	var mems []*MemStore
+	var stores []BlobStore
+	for i := 0; i < 6; i++ {
+		m := NewMemStore()
+		mems = append(mems, m)
+		stores = append(stores, m)
+	}
+	e, err := NewErasureStore(stores, ErasureOpts{DataShards: 4, ParityShards: 2})
+	require.NoError(t, err)
+	return e, mems
+}
+
+func TestErasureStore_MissingShards(t *testing.T) {
+	e, mems := newErasureMemStore(t)
+	blob := []byte("this is a blob of stuff that is split into shards")
+	hash := BlobHash(blob)
+	require.NoError(t, e.Put(hash, blob))
+
+	for _, m := range mems {
+		shard, err := m.Get(hash)
+		require.NoError(t, err)
+		assert.True(t, len(shard) < len(blob), "each store should only get a shard of the blob")
+	}
+
+	// lose a data shard and corrupt another one
+	require.NoError(t, mems[0].Delete(hash))
+	shard, _ := mems[2].Get(hash)
+	shard[len(shard)-1]++
+
+	has, err := e.Has(hash)
+	require.NoError(t, err)
+	assert.True(t, has)
+	read, err := e.Get(hash)
+	require.NoError(t, err)
+	assert.EqualValues(t, blob, read)
+
+	// one more is too many
+	require.NoError(t, mems[5].Delete(hash))
+	_, err = e.Get(hash)
+	assert.True(t, errors.Is(err, errTooFewShards))
+
+	_, err = e.Get("nonexistent")
+	assert.True(t, errors.Is(err, ErrBlobNotFound))
+}
+
+func TestErasureStore_WrongStoreCount(t *testing.T) {
+	_, err := NewErasureStore([]BlobStore{NewMemStore(), NewMemStore()}, ErasureOpts{DataShards: 2, ParityShards: 1})
+	assert.Error(t, err)
+}
+
+func TestErasureStore_Scrub(t *testing.T) {
+	tmpDir, dirs := shardDirs(t, 3)
+	defer os.RemoveAll(tmpDir)
+	var disks []*DiskStore
+	var stores []BlobStore
+	for _, dir := range dirs {
+		d := NewDiskStore(dir, 2)
+		disks = append(disks, d)
+		stores = append(stores, d)
+	}
+	e, err := NewErasureStore(stores, ErasureOpts{DataShards: 2, ParityShards: 1})
+	require.NoError(t, err)
+
+	var hashes []string
+	for i := 0; i < 5; i++ {
+		b := []byte(fmt.Sprintf("blob %d", i))
+		hashes = append(hashes, BlobHash(b))
+		require.NoError(t, e.Put(BlobHash(b), b))
+	}
+
+	// lose a whole directory
+	require.NoError(t, os.RemoveAll(dirs[1]))
+	// and another shard of one blob, so it can't be recovered
+	require.NoError(t, disks[2].Delete(hashes[4]))
+
+	summary, err := e.Scrub(2)
+	require.NoError(t, err)
+	assert.Equal(t, ErasureScrubSummary{Checked: 5, Repaired: 4, Unrecoverable: 1}, summary)
+
+	for i, hash := range hashes[:4] {
+		for _, d := range disks {
+			has, err := d.Has(hash)
+			require.NoError(t, err)
+			assert.True(t, has)
+		}
+		read, err := e.Get(hash)
+		require.NoError(t, err)
+		assert.EqualValues(t, fmt.Sprintf("blob %d", i), read)
+	}
+
+	summary, err = e.Scrub(2)
+	require.NoError(t, err)
+	assert.Equal(t, 0, summary.Repaired)
+}
+
+func TestErasureStore_ScrubNeedsLister(t *testing.T) {
+	e, _ := newErasureMemStore(t)
+	_, err := e.Scrub(1)
+	assert.Error(t, err)
+}
@@ -0,0 +1,184 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/irmf/reflector.go/internal/metrics"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	golru "github.com/hashicorp/golang-lru"
+	log "github.com/sirupsen/logrus"
+)
+
+// FallbackStore reads from a list of origins in order, e.g. a nearby peer, then another reflector, then
+// S3. It remembers which origin served each blob and asks that one first next time. Writes go to the last
+// origin, which is usually the origin of record.
+type FallbackStore struct {
+	origins []BlobStore
+	opts    FallbackOpts
+	// hash -> index of the origin that last served it
+	served *golru.Cache
+	// nil if requests are not hedged
+	hedged *HedgedStore
+}
+
+// FallbackOpts allows to set options for a new FallbackStore.
+type FallbackOpts struct {
+	// if an origin hasn't answered a Get after this long, the next origin is asked too and the first blob
+	// to arrive is used. Origins are hedged in pairs, the third is only asked once the first two failed.
+	// 0 = only ask the next origin once the current one fails
+	HedgeDelay time.Duration
+	// how many hashes to remember the origin of
+	Remember int
+	// used as the component label in metrics
+	Component string
+}
+
+// NewFallbackStore returns a store that reads from origins in order
+func NewFallbackStore(origins []BlobStore, opts FallbackOpts) *FallbackStore {
+	if len(origins) == 0 {
+		panic("at least one origin is needed")
+	}
+	if opts.Remember <= 0 {
+		opts.Remember = 100000
+	}
+	served, err := golru.New(opts.Remember)
+	if err != nil {
+		panic(err)
+	}
+	f := &FallbackStore{origins: origins, opts: opts, served: served}
+	if opts.HedgeDelay > 0 {
+		f.hedged = NewHedgedStore(f, nil, HedgedOpts{
+			MinDelay:  opts.HedgeDelay,
+			MaxDelay:  opts.HedgeDelay,
+			Component: opts.Component,
+		})
+	}
+	return f
+}
+
+const nameFallback = "fallback"
+
+// Name is the cache type name
+func (f *FallbackStore) Name() string { return nameFallback }
+
+// Has asks each origin in turn until one has the blob
+func (f *FallbackStore) Has(hash string) (bool, error) {
+	return f.HasContext(context.Background(), hash)
+}
+
+// HasContext is Has with a context
+func (f *FallbackStore) HasContext(ctx context.Context, hash string) (bool, error) {
+	var lastErr error
+	for _, i := range f.order(hash) {
+		has, err := HasContext(ctx, f.origins[i], hash)
+		if err != nil {
+			if ctx.Err() != nil {
+				return false, errors.Err(ctx.Err())
+			}
+			log.Debugf("checking %s on %s: %s", hash, f.label(i), err.Error())
+			lastErr = err
+			continue
+		}
+		if has {
+			f.served.Add(hash, i)
+			return true, nil
+		}
+	}
+	return false, lastErr // the blob might be in the origin that failed
+}
+
+// Get gets the blob from the first origin that has it
+func (f *FallbackStore) Get(hash string) (stream.Blob, error) {
+	return f.GetContext(context.Background(), hash)
+}
+
+// GetContext is Get with a context
+func (f *FallbackStore) GetContext(ctx context.Context, hash string) (stream.Blob, error) {
+	order := f.order(hash)
+	var lastErr error
+	for len(order) > 0 {
+		var blob stream.Blob
+		var err error
+		served := order[0]
+		if f.hedged != nil && len(order) > 1 {
+			var fromNext bool
+			blob, fromNext, err = f.hedged.getFrom(ctx, hash, f.origins[order[0]], f.origins[order[1]])
+			if fromNext {
+				served = order[1]
+			}
+			order = order[2:]
+		} else {
+			blob, err = GetContext(ctx, f.origins[served], hash)
+			order = order[1:]
+		}
+
+		if err == nil {
+			f.served.Add(hash, served)
+			metrics.OriginServedCount.With(f.labels(served)).Inc()
+			return blob, nil
+		}
+		if ctx.Err() != nil {
+			return nil, errors.Err(ctx.Err())
+		}
+		if !errors.Is(err, ErrBlobNotFound) {
+			log.Debugf("getting %s from %s: %s", hash, f.label(served), err.Error())
+			lastErr = err
+		}
+	}
+
+	if lastErr != nil {
+		return nil, lastErr // the blob might be in the origin that failed
+	}
+	return nil, errors.Err(ErrBlobNotFound)
+}
+
+// Put stores the blob in the last origin
+func (f *FallbackStore) Put(hash string, blob stream.Blob) error {
+	return f.origins[len(f.origins)-1].Put(hash, blob)
+}
+
+// PutSD stores the sd blob in the last origin
+func (f *FallbackStore) PutSD(hash string, blob stream.Blob) error {
+	return f.origins[len(f.origins)-1].PutSD(hash, blob)
+}
+
+// Delete deletes the blob from the last origin
+func (f *FallbackStore) Delete(hash string) error {
+	f.served.Remove(hash)
+	return f.origins[len(f.origins)-1].Delete(hash)
+}
+
+// order returns the origin indexes to try, starting with the one that served the blob last time
+func (f *FallbackStore) order(hash string) []int {
+	first := -1
+	if i, ok := f.served.Get(hash); ok {
+		first = i.(int)
+	}
+
+	order := make([]int, 0, len(f.origins))
+	if first >= 0 {
+		order = append(order, first)
+	}
+	for i := range f.origins {
+		if i != first {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+func (f *FallbackStore) label(i int) string {
+	return fmt.Sprintf("%d_%s", i, f.origins[i].Name())
+}
+
+func (f *FallbackStore) labels(i int) map[string]string {
+	return map[string]string{
+		metrics.LabelComponent: f.opts.Component,
+		metrics.LabelOrigin:    f.label(i),
+	}
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFallbackStore_Order(t *testing.T) {
+	a, b, c := NewMemStore(), NewMemStore(), NewMemStore()
+	f := NewFallbackStore([]BlobStore{a, b, c}, FallbackOpts{})
+
+	require.NoError(t, b.Put("hash", []byte("from b")))
+	require.NoError(t, c.Put("hash", []byte("from c")))
+
+	blob, err := f.Get("hash")
+	require.NoError(t, err)
+	assert.EqualValues(t, "from b", blob)
+	assert.Equal(t, []int{1, 0, 2}, f.order("hash"), "the origin that served the blob should be asked first")
+
+	has, err := f.Has("hash")
+	require.NoError(t, err)
+	assert.True(t, has)
+
+	_, err = f.Get("nonexistent")
+	assert.True(t, errors.Is(err, ErrBlobNotFound))
+
+	require.NoError(t, f.Put("other", []byte("blob")))
+	has, err = c.Has("other")
+	require.NoError(t, err)
+	assert.True(t, has, "writes should go to the last origin")
+}
+
+func TestFallbackStore_FailingOrigin(t *testing.T) {
+	down := NewCircuitBreakerStore(NewMemStore(), CircuitBreakerOpts{})
+	down.open(nil, 0)
+	up := NewMemStore()
+	f := NewFallbackStore([]BlobStore{down, up}, FallbackOpts{})
+
+	require.NoError(t, up.Put("hash", []byte("blob")))
+	blob, err := f.Get("hash")
+	require.NoError(t, err)
+	assert.EqualValues(t, "blob", blob)
+
+	// the blob might be in the origin that's down
+	_, err = f.Get("nonexistent")
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+}
+
+func TestFallbackStore_Hedge(t *testing.T) {
+	slow := NewSlowBlobStore(time.Second)
+	fast := NewMemStore()
+	require.NoError(t, slow.mem.Put("hash", []byte("from slow")))
+	require.NoError(t, fast.Put("hash", []byte("from fast")))
+
+	f := NewFallbackStore([]BlobStore{slow, fast}, FallbackOpts{HedgeDelay: 10 * time.Millisecond})
+	start := time.Now()
+	blob, err := f.Get("hash")
+	require.NoError(t, err)
+	assert.EqualValues(t, "from fast", blob)
+	assert.True(t, time.Since(start) < 500*time.Millisecond, "should not wait for the slow origin")
+}
+
+func TestFallbackStore_HedgeInPairs(t *testing.T) {
+	slow, missing, last := NewSlowBlobStore(time.Second), NewMemStore(), NewMemStore()
+	require.NoError(t, slow.mem.Put("hash", []byte("from slow")))
+	require.NoError(t, last.Put("hash", []byte("from last")))
+
+	f := NewFallbackStore([]BlobStore{slow, missing, last}, FallbackOpts{HedgeDelay: 10 * time.Millisecond})
+	blob, err := f.Get("hash")
+	require.NoError(t, err)
+	assert.EqualValues(t, "from slow", blob, "the third origin should only be asked once the first two failed")
+	assert.Equal(t, []int{0, 1, 2}, f.order("hash"))
+
+	require.NoError(t, missing.Put("other", []byte("from missing")))
+	blob, err = f.Get("other")
+	require.NoError(t, err)
+	assert.EqualValues(t, "from missing", blob)
+	assert.Equal(t, []int{1, 0, 2}, f.order("other"), "the origin that won the hedge should be remembered")
+}
@@ -0,0 +1,260 @@
+package store
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/irmf/reflector.go/store/speedwalk"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+)
+
+// Problems found by Fsck
+const (
+	FsckEmpty        = "empty"         // zero-byte file
+	FsckTooBig       = "too_big"       // bigger than the max blob size
+	FsckInvalidName  = "invalid_name"  // the filename is not a blob hash, e.g. a leftover temp file
+	FsckHashMismatch = "hash_mismatch" // the contents don't match the filename, e.g. a partial write
+	FsckMisplaced    = "misplaced"     // a good blob in the wrong prefix subdirectory
+	FsckTempFile     = "temp_file"     // a DiskStore temp file older than the grace period, e.g. left by a crash
+)
+
+// Actions taken by Fsck
+const (
+	FsckActionNone        = "none"
+	FsckActionMoved       = "moved"
+	FsckActionDeleted     = "deleted"
+	FsckActionQuarantined = "quarantined"
+	FsckActionFailed      = "failed"
+)
+
+// FsckOpts configures Fsck
+type FsckOpts struct {
+	// the prefixLength of the DiskStore that uses the directory
+	PrefixLength int
+	// move misplaced blobs to the right subdirectory
+	Repair bool
+	// delete bad files. ignored if QuarantineDir is set
+	Delete bool
+	// move bad files here instead of deleting them
+	QuarantineDir string
+	// number of files checked concurrently. defaults to the number of CPUs
+	Workers int
+	// DiskStore temp files modified more recently than this are skipped, since they may still be written to.
+	// defaults to an hour
+	TempFileGrace time.Duration
+}
+
+// FsckProblem is a file that failed a check
+type FsckProblem struct {
+	Path    string `json:"path"`
+	Problem string `json:"problem"`
+	Action  string `json:"action"`
+	Error   string `json:"error,omitempty"`
+}
+
+// FsckReport summarizes a Fsck run
+type FsckReport struct {
+	Checked     int            `json:"checked"`
+	Skipped     int            `json:"skipped"`
+	OK          int            `json:"ok"`
+	Bytes       int64          `json:"bytes"`
+	Problems    map[string]int `json:"problems"`
+	Moved       int            `json:"moved"`
+	Deleted     int            `json:"deleted"`
+	Quarantined int            `json:"quarantined"`
+	Failed      int            `json:"failed"`
+	Files       []FsckProblem  `json:"files"`
+}
+
+// Unresolved returns the number of problems that were not fixed
+func (r *FsckReport) Unresolved() int {
+	return len(r.Files) - r.Moved - r.Deleted - r.Quarantined
+}
+
+// Fsck checks every file in a DiskStore directory. Each file must be a blob named after its hash, and
+// stored in the prefix subdirectory that matches opts.PrefixLength.
+func Fsck(dir string, opts FsckOpts) (*FsckReport, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	if opts.TempFileGrace <= 0 {
+		opts.TempFileGrace = time.Hour
+	}
+	if opts.QuarantineDir != "" {
+		err := os.MkdirAll(opts.QuarantineDir, 0755)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+	}
+
+	paths, err := speedwalk.AllFiles(dir, false)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	sort.Strings(paths)
+
+	ds := NewDiskStore(dir, opts.PrefixLength)
+	report := &FsckReport{Problems: make(map[string]int)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	pathChan := make(chan string)
+
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range pathChan {
+				if isTempFile(filepath.Base(p)) && modifiedWithin(p, opts.TempFileGrace) {
+					// a blob that is still being written
+					mu.Lock()
+					report.Skipped++
+					mu.Unlock()
+					continue
+				}
+
+				size, problem := fsckFile(ds, p)
+				action, err := FsckActionNone, error(nil)
+				if problem != "" {
+					action, err = fsckFix(ds, p, problem, opts)
+				}
+
+				mu.Lock()
+				report.Checked++
+				report.Bytes += size
+				if problem == "" {
+					report.OK++
+				} else {
+					report.Problems[problem]++
+					fp := FsckProblem{Path: p, Problem: problem, Action: action}
+					if err != nil {
+						fp.Error = err.Error()
+					}
+					report.Files = append(report.Files, fp)
+					switch action {
+					case FsckActionMoved:
+						report.Moved++
+					case FsckActionDeleted:
+						report.Deleted++
+					case FsckActionQuarantined:
+						report.Quarantined++
+					case FsckActionFailed:
+						report.Failed++
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, p := range paths {
+		pathChan <- p
+	}
+	close(pathChan)
+	wg.Wait()
+
+	sort.Slice(report.Files, func(i, j int) bool { return report.Files[i].Path < report.Files[j].Path })
+	return report, nil
+}
+
+// fsckFile checks a single file and returns its size and the problem with it, if any
+func fsckFile(ds *DiskStore, p string) (int64, string) {
+	name := filepath.Base(p)
+	if isTempFile(name) {
+		return 0, FsckTempFile
+	}
+	if !isBlobHash(name) {
+		return 0, FsckInvalidName
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return 0, FsckInvalidName
+	}
+	if fi.Size() == 0 {
+		return 0, FsckEmpty
+	}
+	if fi.Size() > stream.MaxBlobSize {
+		return fi.Size(), FsckTooBig
+	}
+
+	blob, err := ioutil.ReadFile(p)
+	if err == nil {
+		blob, err = decodeBlob(blob) // the dir may be used by a CompressedStore
+	}
+	if err != nil || BlobHash(blob) != name {
+		return fi.Size(), FsckHashMismatch
+	}
+
+	if filepath.Clean(p) != filepath.Clean(ds.path(name)) {
+		return fi.Size(), FsckMisplaced
+	}
+	return fi.Size(), ""
+}
+
+// fsckFix moves misplaced blobs and removes bad files, as allowed by opts
+func fsckFix(ds *DiskStore, p, problem string, opts FsckOpts) (string, error) {
+	if problem == FsckMisplaced {
+		if !opts.Repair {
+			return FsckActionNone, nil
+		}
+		hash := filepath.Base(p)
+		err := ds.ensureDirExists(ds.dir(hash))
+		if err == nil {
+			err = os.Rename(p, ds.path(hash))
+		}
+		if err != nil {
+			return FsckActionFailed, errors.Err(err)
+		}
+		return FsckActionMoved, nil
+	}
+
+	if opts.QuarantineDir != "" {
+		// keep the path relative to the store, so files with the same name in different subdirs don't collide
+		rel, err := filepath.Rel(ds.blobDir, p)
+		if err != nil {
+			return FsckActionFailed, errors.Err(err)
+		}
+		dest := filepath.Join(opts.QuarantineDir, rel)
+		err = os.MkdirAll(filepath.Dir(dest), 0755)
+		if err == nil {
+			err = os.Rename(p, dest)
+		}
+		if err != nil {
+			return FsckActionFailed, errors.Err(err)
+		}
+		return FsckActionQuarantined, nil
+	}
+
+	if opts.Delete {
+		err := os.Remove(p)
+		if err != nil {
+			return FsckActionFailed, errors.Err(err)
+		}
+		return FsckActionDeleted, nil
+	}
+
+	return FsckActionNone, nil
+}
+
+// modifiedWithin returns true if the file was modified less than d ago
+func modifiedWithin(p string, d time.Duration) bool {
+	fi, err := os.Stat(p)
+	return err == nil && time.Since(fi.ModTime()) < d
+}
+
+// isBlobHash returns true if name is a hex-encoded SHA-384 hash
+func isBlobHash(name string) bool {
+	if len(name) != stream.BlobHashHexLength {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFsck(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	ds := NewDiskStore(tmpDir, 2)
+	good := []byte("this is a good blob")
+	goodHash := BlobHash(good)
+	require.NoError(t, ds.Put(goodHash, good))
+
+	// misplaced: in the top-level dir instead of its prefix subdir
+	misplaced := []byte("this blob is in the wrong place")
+	misplacedHash := BlobHash(misplaced)
+	require.NoError(t, ioutil.WriteFile(path.Join(tmpDir, misplacedHash), misplaced, 0644))
+
+	truncatedHash := BlobHash([]byte("this blob was cut short"))
+	require.NoError(t, ds.Put(truncatedHash, []byte("this blob")))
+
+	emptyHash := BlobHash([]byte("this blob is empty"))
+	require.NoError(t, ds.Put(emptyHash, []byte{}))
+
+	require.NoError(t, ioutil.WriteFile(path.Join(tmpDir, "leftover.tmp"), []byte("junk"), 0644))
+
+	report, err := Fsck(tmpDir, FsckOpts{PrefixLength: 2})
+	require.NoError(t, err)
+	assert.Equal(t, 5, report.Checked)
+	assert.Equal(t, 1, report.OK)
+	assert.Equal(t, map[string]int{FsckMisplaced: 1, FsckHashMismatch: 1, FsckEmpty: 1, FsckInvalidName: 1}, report.Problems)
+	assert.Equal(t, 4, report.Unresolved())
+
+	quarantineDir := path.Join(tmpDir, "..", path.Base(tmpDir)+"_quarantine")
+	defer os.RemoveAll(quarantineDir)
+	report, err = Fsck(tmpDir, FsckOpts{PrefixLength: 2, Repair: true, QuarantineDir: quarantineDir})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Moved)
+	assert.Equal(t, 3, report.Quarantined)
+	assert.Equal(t, 0, report.Unresolved())
+
+	blob, err := ds.Get(misplacedHash)
+	require.NoError(t, err)
+	assert.EqualValues(t, misplaced, blob)
+	_, err = os.Stat(path.Join(quarantineDir, truncatedHash[:2], truncatedHash))
+	assert.NoError(t, err)
+
+	report, err = Fsck(tmpDir, FsckOpts{PrefixLength: 2})
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Checked)
+	assert.Equal(t, 2, report.OK)
+}
+
+func TestFsck_TempFiles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	ds := NewDiskStore(tmpDir, 2)
+	a, b := []byte("blob a"), []byte("blob b")
+	require.NoError(t, ds.Put(BlobHash(a), a))
+	require.NoError(t, ds.Put(BlobHash(b), b))
+
+	// a blob being written, and one left behind by a crash a while ago
+	writing := path.Join(ds.dir(BlobHash(a)), tempFilePrefix+"writing")
+	require.NoError(t, ioutil.WriteFile(writing, []byte("blob"), 0644))
+	stale := path.Join(ds.dir(BlobHash(b)), tempFilePrefix+"stale")
+	require.NoError(t, ioutil.WriteFile(stale, []byte("blob"), 0644))
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(stale, old, old))
+
+	// bad files with the same name in different subdirs
+	require.NoError(t, ioutil.WriteFile(path.Join(ds.dir(BlobHash(a)), "junk"), []byte("junk"), 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(ds.dir(BlobHash(b)), "junk"), []byte("junk"), 0644))
+
+	quarantineDir := path.Join(tmpDir, "..", path.Base(tmpDir)+"_quarantine")
+	defer os.RemoveAll(quarantineDir)
+	report, err := Fsck(tmpDir, FsckOpts{PrefixLength: 2, QuarantineDir: quarantineDir})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Skipped)
+	assert.Equal(t, map[string]int{FsckTempFile: 1, FsckInvalidName: 2}, report.Problems)
+	assert.Equal(t, 3, report.Quarantined)
+	assert.Equal(t, 0, report.Unresolved())
+
+	_, err = os.Stat(writing)
+	assert.NoError(t, err, "a temp file that may still be written to should be left alone")
+	for _, hash := range []string{BlobHash(a), BlobHash(b)} {
+		_, err = os.Stat(path.Join(quarantineDir, hash[:2], "junk"))
+		assert.NoError(t, err, "quarantined files should keep their path")
+	}
+}
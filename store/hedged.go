@@ -0,0 +1,230 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/irmf/reflector.go/internal/metrics"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+)
+
+// HedgedStore cuts the tail latency of origin reads. If a Get hasn't finished by the time most Gets
+// have (the Percentile of recent latencies), a second request is sent to the alternate origin, or to the
+// same origin if there is none, and whichever finishes first is used. The other one is cancelled.
+type HedgedStore struct {
+	BlobStore
+
+	alternate BlobStore
+	opts      HedgedOpts
+	// recent latencies of the origin, not the alternate
+	latency *latencyTracker
+}
+
+// HedgedOpts allows to set options for a new HedgedStore.
+type HedgedOpts struct {
+	// hedge requests that are slower than this percentile of recent requests (0-1)
+	Percentile float64
+	// bounds for the hedge delay. MaxDelay is also used until enough requests were seen
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// used as the component label in metrics
+	Component string
+}
+
+// NewHedgedStore returns a store that hedges slow reads from origin. alternate may be nil.
+func NewHedgedStore(origin, alternate BlobStore, opts HedgedOpts) *HedgedStore {
+	if opts.Percentile <= 0 || opts.Percentile >= 1 {
+		opts.Percentile = 0.95
+	}
+	if opts.MinDelay <= 0 {
+		opts.MinDelay = 10 * time.Millisecond
+	}
+	if opts.MaxDelay < opts.MinDelay {
+		opts.MaxDelay = 2 * time.Second
+	}
+	return &HedgedStore{
+		BlobStore: origin,
+		alternate: alternate,
+		opts:      opts,
+		latency:   newLatencyTracker(opts.Percentile),
+	}
+}
+
+// Name is the cache type name
+func (h *HedgedStore) Name() string { return "hedged_" + h.BlobStore.Name() }
+
+// HasContext is Has with a context
+func (h *HedgedStore) HasContext(ctx context.Context, hash string) (bool, error) {
+	return HasContext(ctx, h.BlobStore, hash)
+}
+
+// Get gets the blob, hedging the request if it's slow
+func (h *HedgedStore) Get(hash string) (stream.Blob, error) {
+	return h.GetContext(context.Background(), hash)
+}
+
+type hedgeResult struct {
+	blob      stream.Blob
+	err       error
+	hedge     bool
+	alternate bool
+}
+
+// GetContext is Get with a context
+func (h *HedgedStore) GetContext(ctx context.Context, hash string) (stream.Blob, error) {
+	blob, _, err := h.getFrom(ctx, hash, h.BlobStore, h.alternate)
+	return blob, err
+}
+
+// getFrom gets the blob from origin, hedging the request with one to alternate, or to origin again if
+// alternate is nil. It returns whether the blob came from the alternate
+func (h *HedgedStore) getFrom(ctx context.Context, hash string, origin, alternate BlobStore) (stream.Blob, bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stops the request that lost
+
+	results := make(chan hedgeResult, 2)
+	h.get(ctx, hash, origin, alternate, false, results)
+	pending, hedged := 1, false
+	hedge := func() {
+		hedged = true
+		pending++
+		metrics.HedgedRequestCount.With(metrics.CacheLabels(h.BlobStore.Name(), h.opts.Component)).Inc()
+		h.get(ctx, hash, origin, alternate, true, results)
+	}
+
+	timer := time.NewTimer(h.delay())
+	defer timer.Stop()
+
+	var lastErr error
+	for {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if res.hedge {
+					metrics.HedgeWonCount.With(metrics.CacheLabels(h.BlobStore.Name(), h.opts.Component)).Inc()
+				}
+				return res.blob, res.alternate, nil
+			}
+			if lastErr == nil || errors.Is(lastErr, ErrBlobNotFound) {
+				lastErr = res.err
+			}
+
+			// a missing blob will be missing from the same origin again, but maybe not from the alternate
+			retry := alternate != nil || !errors.Is(res.err, ErrBlobNotFound)
+			if !hedged && retry && ctx.Err() == nil {
+				hedge()
+			} else if pending == 0 {
+				return nil, false, lastErr
+			}
+		case <-timer.C:
+			if !hedged {
+				hedge()
+			}
+		}
+	}
+}
+
+// get reads the blob in the background and sends the result to results
+func (h *HedgedStore) get(ctx context.Context, hash string, origin, alternate BlobStore, hedge bool, results chan<- hedgeResult) {
+	fromAlternate := hedge && alternate != nil
+	if fromAlternate {
+		origin = alternate
+	}
+
+	go func() {
+		start := time.Now()
+		blob, err := GetContext(ctx, origin, hash)
+		took := time.Since(start)
+		// only blobs that were found count, a quick "not found" would pull the delay down. requests that
+		// lost are cancelled, but how long they took so far still counts. otherwise only the fast requests
+		// would be seen, and the delay would keep going down too
+		if !fromAlternate && (err == nil || ctx.Err() != nil) {
+			h.latency.observe(took)
+		}
+		metrics.OriginLatency.With(map[string]string{
+			metrics.LabelComponent: h.opts.Component,
+			metrics.LabelOrigin:    origin.Name(),
+		}).Observe(took.Seconds())
+
+		if err != nil && ctx.Err() != nil {
+			err = errors.Err(ctx.Err())
+		}
+		results <- hedgeResult{blob: blob, err: err, hedge: hedge, alternate: fromAlternate}
+	}()
+}
+
+// delay returns how long to wait before hedging
+func (h *HedgedStore) delay() time.Duration {
+	d, ok := h.latency.estimate()
+	if !ok || d > h.opts.MaxDelay {
+		return h.opts.MaxDelay
+	}
+	if d < h.opts.MinDelay {
+		return h.opts.MinDelay
+	}
+	return d
+}
+
+// latencyTracker estimates a latency percentile from a window of recent requests
+type latencyTracker struct {
+	percentile float64
+
+	mu       sync.Mutex
+	samples  []time.Duration
+	next     int
+	full     bool
+	sinceEst int
+	est      time.Duration
+}
+
+const (
+	latencyWindow = 1000
+	// the estimate is recalculated after this many new samples, so it's not sorted on every request
+	latencyRecalculateEvery = 50
+	// no estimate until there are this many samples
+	latencyMinSamples = 20
+)
+
+func newLatencyTracker(percentile float64) *latencyTracker {
+	return &latencyTracker{percentile: percentile, samples: make([]time.Duration, latencyWindow)}
+}
+
+func (l *latencyTracker) observe(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % len(l.samples)
+	if l.next == 0 {
+		l.full = true
+	}
+
+	l.sinceEst++
+	if l.sinceEst >= latencyRecalculateEvery || (!l.full && l.next == latencyMinSamples) {
+		l.sinceEst = 0
+		n := l.count()
+		sorted := make([]time.Duration, n)
+		copy(sorted, l.samples[:n])
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		l.est = sorted[int(float64(n-1)*l.percentile)]
+	}
+}
+
+// estimate returns the latency percentile, or false if there are not enough samples yet
+func (l *latencyTracker) estimate() (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.est, l.count() >= latencyMinSamples
+}
+
+func (l *latencyTracker) count() int {
+	if l.full {
+		return len(l.samples)
+	}
+	return l.next
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHedgedStore_Alternate(t *testing.T) {
+	slow := NewSlowBlobStore(time.Second)
+	fast := NewMemStore()
+	require.NoError(t, slow.mem.Put("hash", []byte("from slow")))
+	require.NoError(t, fast.Put("hash", []byte("from fast")))
+
+	h := NewHedgedStore(slow, fast, HedgedOpts{MaxDelay: 20 * time.Millisecond})
+	start := time.Now()
+	blob, err := h.Get("hash")
+	require.NoError(t, err)
+	assert.EqualValues(t, "from fast", blob)
+	assert.True(t, time.Since(start) < 500*time.Millisecond, "should not wait for the slow origin")
+
+	// a blob missing from the origin is looked for in the alternate right away
+	require.NoError(t, fast.Put("other", []byte("only in fast")))
+	blob, err = h.Get("other")
+	require.NoError(t, err)
+	assert.EqualValues(t, "only in fast", blob)
+}
+
+func TestHedgedStore_SameOrigin(t *testing.T) {
+	origin := NewMemStore()
+	h := NewHedgedStore(origin, nil, HedgedOpts{})
+	require.NoError(t, origin.Put("hash", []byte("blob")))
+
+	blob, err := h.Get("hash")
+	require.NoError(t, err)
+	assert.EqualValues(t, "blob", blob)
+
+	_, err = h.Get("nonexistent")
+	assert.True(t, errors.Is(err, ErrBlobNotFound))
+}
+
+func TestHedgedStore_Delay(t *testing.T) {
+	h := NewHedgedStore(NewMemStore(), nil, HedgedOpts{Percentile: 0.9, MinDelay: time.Millisecond, MaxDelay: time.Second})
+	assert.Equal(t, time.Second, h.delay(), "the max delay should be used until there are enough samples")
+
+	// the estimate is updated every latencyRecalculateEvery samples, the last time after 120
+	for i := 1; i <= 120; i++ {
+		h.latency.observe(time.Duration(i) * time.Millisecond)
+	}
+	assert.Equal(t, 108*time.Millisecond, h.delay())
+
+	for i := 0; i < latencyWindow; i++ {
+		h.latency.observe(time.Microsecond)
+	}
+	assert.Equal(t, time.Millisecond, h.delay(), "the delay should not go below the min")
+}
+
+func TestHedgedStore_OnlyFoundBlobsCount(t *testing.T) {
+	origin := NewMemStore()
+	h := NewHedgedStore(origin, nil, HedgedOpts{MinDelay: time.Millisecond, MaxDelay: time.Second})
+
+	for i := 0; i < 2*latencyMinSamples; i++ {
+		_, err := h.Get("nonexistent")
+		require.True(t, errors.Is(err, ErrBlobNotFound))
+	}
+	assert.Equal(t, time.Second, h.delay(), "missing blobs should not pull the delay down")
+
+	require.NoError(t, origin.Put("hash", []byte("blob")))
+	for i := 0; i < latencyMinSamples; i++ {
+		_, err := h.Get("hash")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, time.Millisecond, h.delay())
+}
@@ -1,35 +1,62 @@
 package store
 
 import (
+	"io"
+	"math"
+	"sort"
+	"sync"
+
 	"github.com/lbryio/lbry.go/v2/extras/errors"
 	"github.com/lbryio/lbry.go/v2/stream"
 	"github.com/irmf/reflector.go/internal/metrics"
 
 	golru "github.com/hashicorp/golang-lru"
+	"go.uber.org/atomic"
 )
 
 // LRUStore adds a max cache size and LRU eviction to a BlobStore
 type LRUStore struct {
 	// underlying store
 	store BlobStore
-	// lru implementation
+	// lru implementation. values are blob sizes in bytes
 	lru *golru.Cache
+	// max total size of cached blobs in bytes. 0 = limited by item count instead
+	maxBytes int64
+	// total size of cached blobs in bytes
+	usedBytes *atomic.Int64
+	// serializes adds so the size accounting and byte-based eviction stay consistent
+	addMu sync.Mutex
+
+	component string
 }
 
-// NewLRUStore initialize a new LRUStore
+// NewLRUStore initialize a new LRUStore that holds at most maxItems blobs
 func NewLRUStore(component string, store BlobStore, maxItems int) *LRUStore {
+	return newLRUStore(component, store, maxItems, 0)
+}
+
+// NewSizedLRUStore initialize a new LRUStore that holds at most maxBytes bytes of blobs
+func NewSizedLRUStore(component string, store BlobStore, maxBytes int64) *LRUStore {
+	return newLRUStore(component, store, math.MaxInt32, maxBytes)
+}
+
+func newLRUStore(component string, store BlobStore, maxItems int, maxBytes int64) *LRUStore {
+	l := &LRUStore{
+		store:     store,
+		maxBytes:  maxBytes,
+		usedBytes: atomic.NewInt64(0),
+		component: component,
+	}
+
 	lru, err := golru.NewWithEvict(maxItems, func(key interface{}, value interface{}) {
 		metrics.CacheLRUEvictCount.With(metrics.CacheLabels(store.Name(), component)).Inc()
+		l.addUsedBytes(-value.(int64))
 		_ = store.Delete(key.(string)) // TODO: log this error. may happen if underlying entry is gone but cache entry still there
 	})
 	if err != nil {
 		panic(err)
 	}
-
-	l := &LRUStore{
-		store: store,
-		lru:   lru,
-	}
+	l.lru = lru
 
 	if lstr, ok := store.(lister); ok {
 		err = l.loadExisting(lstr, maxItems)
@@ -65,6 +92,20 @@ func (l *LRUStore) Get(hash string) (stream.Blob, error) {
 	return blob, err
 }
 
+// GetReader returns a reader for the blob or an error if the blob doesn't exist.
+func (l *LRUStore) GetReader(hash string) (io.ReadCloser, int64, error) {
+	_, has := l.lru.Get(hash)
+	if !has {
+		return nil, 0, errors.Err(ErrBlobNotFound)
+	}
+	rc, size, err := GetReader(l.store, hash)
+	if errors.Is(err, ErrBlobNotFound) {
+		// Blob disappeared from underlying store
+		l.lru.Remove(hash)
+	}
+	return rc, size, err
+}
+
 // Put stores the blob
 func (l *LRUStore) Put(hash string, blob stream.Blob) error {
 	err := l.store.Put(hash, blob)
@@ -72,7 +113,19 @@ func (l *LRUStore) Put(hash string, blob stream.Blob) error {
 		return err
 	}
 
-	l.lru.Add(hash, true)
+	l.add(hash, int64(len(blob)))
+	return nil
+}
+
+// PutReader stores the blob read from r
+func (l *LRUStore) PutReader(hash string, r io.Reader) error {
+	cr := &countingReader{r: r}
+	err := PutReader(l.store, hash, cr)
+	if err != nil {
+		return err
+	}
+
+	l.add(hash, cr.n)
 	return nil
 }
 
@@ -83,7 +136,7 @@ func (l *LRUStore) PutSD(hash string, blob stream.Blob) error {
 		return err
 	}
 
-	l.lru.Add(hash, true)
+	l.add(hash, int64(len(blob)))
 	return nil
 }
 
@@ -101,20 +154,77 @@ func (l *LRUStore) Delete(hash string) error {
 	return nil
 }
 
-// loadExisting imports existing blobs from the underlying store into the LRU cache
+// UsedBytes returns the total size of the cached blobs
+func (l *LRUStore) UsedBytes() int64 {
+	return l.usedBytes.Load()
+}
+
+// add tracks the blob in the lru and evicts blobs until the cache fits in maxBytes
+func (l *LRUStore) add(hash string, size int64) {
+	l.addMu.Lock()
+	defer l.addMu.Unlock()
+
+	if old, ok := l.lru.Peek(hash); ok {
+		l.addUsedBytes(-old.(int64)) // blob is being replaced
+	}
+	l.addUsedBytes(size)
+	l.lru.Add(hash, size)
+
+	for l.maxBytes > 0 && l.usedBytes.Load() > l.maxBytes {
+		_, _, ok := l.lru.RemoveOldest()
+		if !ok {
+			break
+		}
+	}
+}
+
+func (l *LRUStore) addUsedBytes(delta int64) {
+	used := l.usedBytes.Add(delta)
+	metrics.CacheLRUBytes.With(metrics.CacheLabels(l.store.Name(), l.component)).Set(float64(used))
+}
+
+// loadExisting imports existing blobs from the underlying store into the LRU cache. If the store knows
+// when blobs were last accessed, the most recently accessed blobs are kept and the LRU order is restored.
 func (l *LRUStore) loadExisting(store lister, maxItems int) error {
-	existing, err := store.list()
-	if err != nil {
-		return err
+	var existing []blobInfo
+	if il, ok := store.(infoLister); ok {
+		var err error
+		existing, err = il.listInfo()
+		if err != nil {
+			return err
+		}
+	} else {
+		hashes, err := store.list()
+		if err != nil {
+			return err
+		}
+		existing = make([]blobInfo, len(hashes))
+		for i, h := range hashes {
+			existing[i] = blobInfo{hash: h}
+		}
 	}
 
-	added := 0
-	for _, h := range existing {
-		l.lru.Add(h, true)
-		added++
-		if maxItems > 0 && added >= maxItems { // underlying cache is bigger than LRU cache
+	// most recent first, so those are the ones that get loaded if the underlying cache is bigger than the LRU cache
+	sort.SliceStable(existing, func(i, j int) bool {
+		return existing[i].accessed.After(existing[j].accessed)
+	})
+
+	fits := 0
+	var size int64
+	for _, b := range existing {
+		if l.maxBytes > 0 && size+b.size > l.maxBytes { // underlying cache is bigger than LRU cache
+			break
+		}
+		size += b.size
+		fits++
+		if maxItems > 0 && fits >= maxItems { // underlying cache is bigger than LRU cache
 			break
 		}
 	}
+
+	// add least recent first so the most recent blob ends up at the front of the LRU
+	for i := fits - 1; i >= 0; i-- {
+		l.add(existing[i].hash, existing[i].size)
+	}
 	return nil
 }
@@ -5,6 +5,7 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/lbryio/lbry.go/v2/extras/errors"
 
@@ -119,3 +120,85 @@ func TestLRUStore_loadExisting(t *testing.T) {
 	require.NoError(t, err)
 	assert.True(t, has, "hash should be loaded from disk store but it's not")
 }
+
+func TestSizedLRUStore_Eviction(t *testing.T) {
+	mem := NewMemStore()
+	lru := NewSizedLRUStore("test", mem, 10)
+
+	require.NoError(t, lru.Put("one", []byte("1234")))
+	require.NoError(t, lru.Put("two", []byte("1234")))
+	assert.EqualValues(t, 8, lru.UsedBytes())
+
+	lru.Get("one") // touch so it stays in cache
+	require.NoError(t, lru.Put("three", []byte("1234")))
+	assert.EqualValues(t, 8, lru.UsedBytes())
+
+	for k, v := range map[string]bool{
+		"one":   true,
+		"two":   false,
+		"three": true,
+	} {
+		has, err := lru.Has(k)
+		assert.NoError(t, err)
+		assert.Equal(t, v, has)
+	}
+	assert.Equal(t, 2, len(mem.Debug()))
+
+	// replacing a blob should not count it twice
+	require.NoError(t, lru.Put("one", []byte("12")))
+	assert.EqualValues(t, 6, lru.UsedBytes())
+
+	require.NoError(t, lru.Delete("one"))
+	require.NoError(t, lru.Delete("three"))
+	assert.EqualValues(t, 0, lru.UsedBytes())
+	assert.Equal(t, 0, len(mem.Debug()))
+}
+
+func TestSizedLRUStore_loadExisting(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	d := NewDiskStore(tmpDir, 2)
+
+	b := []byte("this is a blob of stuff")
+	require.NoError(t, d.Put("hash1", b))
+	require.NoError(t, d.Put("hash2", b))
+
+	lru := NewSizedLRUStore("test", d, 1000)
+	assert.EqualValues(t, 2*len(b), lru.UsedBytes(), "sizes should be loaded from disk store")
+}
+
+func TestLRUStore_loadExistingRestoresOrder(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	d := NewDiskStore(tmpDir, 2)
+
+	b := []byte("this is a blob of stuff")
+	now := time.Now()
+	for i, hash := range []string{"old", "mid", "new"} {
+		require.NoError(t, d.Put(hash, b))
+		accessed := now.Add(time.Duration(i-3) * time.Hour)
+		require.NoError(t, os.Chtimes(d.path(hash), accessed, accessed))
+	}
+
+	lru := NewLRUStore("test", d, 2)
+	for k, v := range map[string]bool{
+		"old": false,
+		"mid": true,
+		"new": true,
+	} {
+		has, err := lru.Has(k)
+		assert.NoError(t, err)
+		assert.Equal(t, v, has, k)
+	}
+
+	// "mid" is the least recently used blob, so it gets evicted first
+	require.NoError(t, lru.Put("newest", b))
+	has, err := lru.Has("mid")
+	assert.NoError(t, err)
+	assert.False(t, has)
+	has, err = lru.Has("new")
+	assert.NoError(t, err)
+	assert.True(t, has)
+}
@@ -0,0 +1,329 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/irmf/reflector.go/internal/metrics"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	golru "github.com/hashicorp/golang-lru"
+	log "github.com/sirupsen/logrus"
+)
+
+// NextBlobsLister finds the blobs that come after a blob in its stream. Every db.DB implements it.
+type NextBlobsLister interface {
+	// NextBlobs returns up to n blobs that follow the blob in its stream, or the first n blobs of the
+	// stream if hash is an sd blob
+	NextBlobs(hash string, n int) ([]string, error)
+}
+
+// PrefetchStore warms the cache ahead of clients. Clients download a stream one blob at a time, so when a
+// blob is requested, the next few blobs of its stream are fetched from the origin in the background.
+// Prefetched blobs go straight into the cache, without asking the admission policy.
+type PrefetchStore struct {
+	*CachingStore
+
+	opts PrefetchOpts
+	// limits how many prefetches run at once
+	slots chan struct{}
+	// blobs that were prefetched and not requested yet
+	prefetched *golru.Cache
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// PrefetchOpts allows to set options for a new PrefetchStore.
+type PrefetchOpts struct {
+	// how many blobs to fetch ahead
+	Count int
+	// how many requests can trigger a prefetch at the same time. more are not prefetched for
+	Workers int
+	// finds the next blobs. if nil, they are found in the sd blobs that go through the store
+	Index NextBlobsLister
+}
+
+// NewPrefetchStore returns a store that prefetches blobs into the cache of c
+func NewPrefetchStore(c *CachingStore, opts PrefetchOpts) *PrefetchStore {
+	if opts.Count <= 0 {
+		opts.Count = 3
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 10
+	}
+	if opts.Index == nil {
+		opts.Index = newSDBlobIndex(10000)
+	}
+	prefetched, err := golru.New(10000)
+	if err != nil {
+		panic(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &PrefetchStore{
+		CachingStore: c,
+		opts:         opts,
+		slots:        make(chan struct{}, opts.Workers),
+		prefetched:   prefetched,
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+// Shutdown stops the running prefetches
+func (p *PrefetchStore) Shutdown() {
+	p.cancel()
+	p.wg.Wait()
+}
+
+// Get gets the blob and prefetches the ones after it
+func (p *PrefetchStore) Get(hash string) (stream.Blob, error) {
+	return p.GetContext(context.Background(), hash)
+}
+
+// GetContext is Get with a context
+func (p *PrefetchStore) GetContext(ctx context.Context, hash string) (stream.Blob, error) {
+	blob, err := p.CachingStore.GetContext(ctx, hash)
+	if err == nil {
+		p.requested(hash, blob)
+	}
+	return blob, err
+}
+
+// GetReader gets a reader for the blob and prefetches the ones after it
+func (p *PrefetchStore) GetReader(hash string) (io.ReadCloser, int64, error) {
+	return p.GetReaderContext(context.Background(), hash)
+}
+
+// GetReaderContext is GetReader with a context
+func (p *PrefetchStore) GetReaderContext(ctx context.Context, hash string) (io.ReadCloser, int64, error) {
+	rc, size, err := p.CachingStore.GetReaderContext(ctx, hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, ok := p.opts.Index.(*sdBlobIndex); !ok || size > maxSDBlobSize {
+		p.requested(hash, nil)
+		return rc, size, nil
+	}
+
+	// the index needs the sd blobs, so the ones that are read are kept. sd blobs are JSON and content blobs
+	// are encrypted, so the first byte tells them apart
+	br := bufio.NewReader(rc)
+	first, err := br.Peek(1)
+	if err != nil || first[0] != '{' {
+		p.requested(hash, nil)
+		return struct {
+			io.Reader
+			io.Closer
+		}{br, rc}, size, nil
+	}
+	return &sdBlobReader{r: br, rc: rc, size: size, done: func(blob []byte) { p.requested(hash, blob) }}, size, nil
+}
+
+// requested records a hit if the blob was prefetched, and starts prefetching the blobs after it. blob is
+// the content of the blob if the request read it, so the index can learn sd blobs from it
+func (p *PrefetchStore) requested(hash string, blob []byte) {
+	if p.prefetched.Contains(hash) {
+		p.prefetched.Remove(hash)
+		metrics.PrefetchHitCount.With(metrics.CacheLabels(p.cache.Name(), p.component)).Inc()
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		p.count(metrics.PrefetchDropped)
+		return
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() { <-p.slots }()
+		p.prefetch(hash, blob)
+	}()
+}
+
+func (p *PrefetchStore) prefetch(hash string, blob []byte) {
+	if idx, ok := p.opts.Index.(*sdBlobIndex); ok && blob != nil {
+		idx.learn(hash, blob)
+	}
+
+	next, err := p.opts.Index.NextBlobs(hash, p.opts.Count)
+	if err != nil {
+		log.Errorf("finding the blobs after %s: %s", hash, errors.FullTrace(err))
+		return
+	}
+
+	for _, h := range next {
+		if p.ctx.Err() != nil {
+			return
+		}
+		has, err := p.cache.Has(h)
+		if err == nil && has {
+			p.count(metrics.PrefetchCached)
+			continue
+		}
+
+		blob, err := GetContext(p.ctx, p.origin, h)
+		if err == nil {
+			err = p.cache.Put(h, blob)
+		}
+		if err != nil {
+			if !errors.Is(err, ErrBlobNotFound) && p.ctx.Err() == nil {
+				log.Errorf("prefetching %s: %s", h, errors.FullTrace(err))
+			}
+			p.count(metrics.PrefetchFailed)
+			continue
+		}
+		p.prefetched.Add(h, nil)
+		p.count(metrics.PrefetchFetched)
+	}
+}
+
+func (p *PrefetchStore) count(result string) {
+	labels := metrics.CacheLabels(p.cache.Name(), p.component)
+	labels[metrics.LabelResult] = result
+	metrics.PrefetchCount.With(labels).Inc()
+}
+
+// sdBlobIndex remembers the order of the blobs in the streams whose sd blobs it has seen
+type sdBlobIndex struct {
+	// sd hash -> content blob hashes in order
+	streams *golru.Cache
+
+	mu sync.Mutex
+	// content blob hash -> where it is in its stream
+	positions map[string]blobPosition
+}
+
+type blobPosition struct {
+	sdHash string
+	num    int
+}
+
+// sd blobs are small, so bigger blobs are not read to check if they are sd blobs
+const maxSDBlobSize = 1 << 20
+
+func newSDBlobIndex(size int) *sdBlobIndex {
+	idx := &sdBlobIndex{positions: make(map[string]blobPosition)}
+	streams, err := golru.NewWithEvict(size, func(key interface{}, value interface{}) {
+		idx.mu.Lock()
+		defer idx.mu.Unlock()
+		for _, h := range value.([]string) {
+			if idx.positions[h].sdHash == key.(string) {
+				delete(idx.positions, h)
+			}
+		}
+	})
+	if err != nil {
+		panic(err)
+	}
+	idx.streams = streams
+	return idx
+}
+
+// NextBlobs returns up to n blobs after hash in its stream
+func (s *sdBlobIndex) NextBlobs(hash string, n int) ([]string, error) {
+	s.mu.Lock()
+	pos, ok := s.positions[hash]
+	s.mu.Unlock()
+	if !ok {
+		pos = blobPosition{sdHash: hash, num: -1}
+	}
+
+	blobs, ok := s.streams.Get(pos.sdHash)
+	if !ok {
+		return nil, nil
+	}
+	hashes := blobs.([]string)
+	start := pos.num + 1
+	if start >= len(hashes) {
+		return nil, nil
+	}
+	end := start + n
+	if end > len(hashes) {
+		end = len(hashes)
+	}
+	return hashes[start:end], nil
+}
+
+// learn remembers the blobs of the stream if blob is an sd blob that wasn't seen yet
+func (s *sdBlobIndex) learn(hash string, blob []byte) {
+	if len(blob) == 0 || len(blob) > maxSDBlobSize || blob[0] != '{' { // sd blobs are JSON, content blobs are encrypted
+		return
+	}
+	s.mu.Lock()
+	_, known := s.positions[hash]
+	s.mu.Unlock()
+	if known || s.streams.Contains(hash) {
+		return
+	}
+
+	var sd struct {
+		Blobs []struct {
+			BlobNum  int    `json:"blob_num"`
+			BlobHash string `json:"blob_hash"`
+		} `json:"blobs"`
+	}
+	if json.Unmarshal(blob, &sd) != nil || len(sd.Blobs) == 0 {
+		return
+	}
+
+	var hashes []string
+	for _, blob := range sd.Blobs {
+		if blob.BlobHash == "" || blob.BlobNum != len(hashes) {
+			break // the terminating blob, or blobs out of order
+		}
+		hashes = append(hashes, blob.BlobHash)
+	}
+
+	s.mu.Lock()
+	for i, h := range hashes {
+		s.positions[h] = blobPosition{sdHash: hash, num: i}
+	}
+	s.mu.Unlock()
+	s.streams.Add(hash, hashes)
+}
+
+// sdBlobReader keeps what is read from a blob that might be an sd blob. Once the blob was read to the end
+// or closed, done is called with it, or with nil if it was not read completely
+type sdBlobReader struct {
+	r    io.Reader
+	rc   io.Closer
+	size int64
+	done func([]byte)
+
+	buf  bytes.Buffer
+	once sync.Once
+}
+
+func (s *sdBlobReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.buf.Write(p[:n])
+	if err == io.EOF {
+		s.finish()
+	}
+	return n, err
+}
+
+func (s *sdBlobReader) Close() error {
+	s.finish()
+	return s.rc.Close()
+}
+
+func (s *sdBlobReader) finish() {
+	s.once.Do(func() {
+		if int64(s.buf.Len()) != s.size {
+			s.done(nil)
+			return
+		}
+		s.done(s.buf.Bytes())
+	})
+}
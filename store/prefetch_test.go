@@ -0,0 +1,150 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testStream puts an sd blob and its content blobs in s, and returns the sd hash and the content hashes
+func testStream(t *testing.T, s BlobStore, blobs int) (string, []string) {
+	type blobInfo struct {
+		BlobNum  int    `json:"blob_num"`
+		BlobHash string `json:"blob_hash,omitempty"`
+		Length   int    `json:"length"`
+	}
+	var infos []blobInfo
+	var hashes []string
+	for i := 0; i < blobs; i++ {
+		b := []byte(fmt.Sprintf("content blob %d", i))
+		require.NoError(t, s.Put(BlobHash(b), b))
+		hashes = append(hashes, BlobHash(b))
+		infos = append(infos, blobInfo{BlobNum: i, BlobHash: BlobHash(b), Length: len(b)})
+	}
+	infos = append(infos, blobInfo{BlobNum: blobs})
+
+	sd, err := json.Marshal(map[string]interface{}{"blobs": infos, "stream_type": "lbryfile"})
+	require.NoError(t, err)
+	require.NoError(t, s.PutSD(BlobHash(sd), sd))
+	return BlobHash(sd), hashes
+}
+
+// cached is called from Eventually's goroutine, so it can't stop the test with require
+func cached(t *testing.T, cache BlobStore, hashes []string) []bool {
+	var has []bool
+	for _, h := range hashes {
+		ok, err := cache.Has(h)
+		assert.NoError(t, err)
+		has = append(has, ok)
+	}
+	return has
+}
+
+func TestPrefetchStore_SDBlob(t *testing.T) {
+	origin, cache := NewMemStore(), NewMemStore()
+	p := NewPrefetchStore(NewCachingStore("test", origin, cache), PrefetchOpts{Count: 2})
+	defer p.Shutdown()
+	sdHash, hashes := testStream(t, origin, 5)
+
+	_, err := p.Get(sdHash)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return cached(t, cache, hashes)[1] }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []bool{true, true, false, false, false}, cached(t, cache, hashes))
+
+	_, err = p.Get(hashes[1])
+	require.NoError(t, err)
+	assert.False(t, p.prefetched.Contains(hashes[1]), "the prefetched blob should be counted as a hit")
+	require.Eventually(t, func() bool { return cached(t, cache, hashes)[3] }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []bool{true, true, true, true, false}, cached(t, cache, hashes))
+
+	// the last blob has nothing after it
+	_, err = p.Get(hashes[4])
+	require.NoError(t, err)
+}
+
+// readCountingStore counts the blobs read from it
+type readCountingStore struct {
+	BlobStore
+	reads int32
+}
+
+func (r *readCountingStore) Get(hash string) (stream.Blob, error) {
+	atomic.AddInt32(&r.reads, 1)
+	return r.BlobStore.Get(hash)
+}
+
+func TestPrefetchStore_SDBlobReader(t *testing.T) {
+	origin, cache := NewMemStore(), &readCountingStore{BlobStore: NewMemStore()}
+	p := NewPrefetchStore(NewCachingStore("test", origin, cache), PrefetchOpts{Count: 2})
+	defer p.Shutdown()
+	sdHash, hashes := testStream(t, origin, 3)
+	sd, err := origin.Get(sdHash)
+	require.NoError(t, err)
+	require.NoError(t, cache.PutSD(sdHash, sd))
+
+	rc, _, err := p.GetReader(sdHash)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Eventually(t, func() bool { return cached(t, cache, hashes)[1] }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []bool{true, true, false}, cached(t, cache, hashes))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&cache.reads), "the sd blob should be learned from the request, not read again")
+}
+
+type fakeNextBlobs map[string][]string
+
+func (f fakeNextBlobs) NextBlobs(hash string, n int) ([]string, error) {
+	next := f[hash]
+	if len(next) > n {
+		next = next[:n]
+	}
+	return next, nil
+}
+
+func TestPrefetchStore_Index(t *testing.T) {
+	origin, cache := NewMemStore(), NewMemStore()
+	_, hashes := testStream(t, origin, 3)
+	p := NewPrefetchStore(NewCachingStore("test", origin, cache), PrefetchOpts{
+		Count: 5,
+		Index: fakeNextBlobs{hashes[0]: hashes[1:]},
+	})
+
+	defer p.Shutdown()
+
+	rc, _, err := p.GetReader(hashes[0])
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Eventually(t, func() bool { return cached(t, cache, hashes)[2] }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []bool{true, true, true}, cached(t, cache, hashes))
+}
+
+func TestSDBlobIndex_Evict(t *testing.T) {
+	mem := NewMemStore()
+	idx := newSDBlobIndex(1)
+	sd1, hashes1 := testStream(t, mem, 2)
+
+	sd, err := mem.Get(sd1)
+	require.NoError(t, err)
+	idx.learn(sd1, sd)
+	next, err := idx.NextBlobs(hashes1[0], 5)
+	require.NoError(t, err)
+	assert.Equal(t, hashes1[1:], next)
+
+	// content blobs are not sd blobs
+	content, err := mem.Get(hashes1[0])
+	require.NoError(t, err)
+	idx.learn(hashes1[0], content)
+	assert.Equal(t, 1, idx.streams.Len())
+
+	idx.streams.Add("other", []string{"a"})
+	assert.Empty(t, idx.positions, "positions of evicted streams should be forgotten")
+}
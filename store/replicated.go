@@ -0,0 +1,561 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/irmf/reflector.go/db"
+	"github.com/irmf/reflector.go/internal/metrics"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ReplicatedStore stores every blob in several replicas, e.g. two S3 buckets in different regions.
+// Writes succeed once WriteQuorum replicas have the blob. Reads go to the fastest healthy replica and
+// fall back to the others. Replicas that are found to be missing a blob are repaired in the background.
+//
+// The blobs waiting to be repaired are kept in memory, up to MaxMissing of them. If more go missing, or the
+// store is restarted, the replicas that can list their blobs by prefix are compared to find the ones they
+// lack, one hash prefix at a time so a replica is never listed into memory all at once.
+type ReplicatedStore struct {
+	replicas []*replica
+	opts     ReplicatedOpts
+
+	mu sync.Mutex
+	// hash -> the replicas that don't have it
+	missing map[string]*missingBlob
+	// number of missing blobs for each replica
+	missingCounts []int
+	// true if missing blobs were not tracked, so the replicas need to be compared
+	overflowed bool
+	// the hash prefix the next comparison starts at
+	compareFrom int
+
+	grp *stop.Group
+}
+
+// ReplicatedOpts allows to set options for a new ReplicatedStore.
+type ReplicatedOpts struct {
+	// how many replicas must store a blob before a write succeeds. defaults to a majority
+	WriteQuorum int
+	// how often missing blobs are copied to the replicas that lack them
+	RepairInterval time.Duration
+	// how many missing blobs to keep track of. defaults to 100000
+	MaxMissing int
+	// used as the component label in metrics
+	Component string
+}
+
+type missingBlob struct {
+	isSD     bool
+	replicas map[int]bool
+}
+
+type replica struct {
+	index int
+	store BlobStore
+
+	mu sync.Mutex
+	// moving average of successful request latency
+	latency  time.Duration
+	failedAt time.Time
+}
+
+// how long a replica that returned an error is tried after the healthy ones
+const replicaRetryInterval = 30 * time.Second
+
+// NewReplicatedStore returns a store that replicates blobs to all the stores. Call Start to begin repairs.
+func NewReplicatedStore(stores []BlobStore, opts ReplicatedOpts) *ReplicatedStore {
+	if opts.WriteQuorum <= 0 {
+		opts.WriteQuorum = len(stores)/2 + 1
+	}
+	if opts.WriteQuorum > len(stores) {
+		opts.WriteQuorum = len(stores)
+	}
+	if opts.RepairInterval <= 0 {
+		opts.RepairInterval = time.Minute
+	}
+	if opts.MaxMissing <= 0 {
+		opts.MaxMissing = 100000
+	}
+
+	r := &ReplicatedStore{
+		opts:          opts,
+		missing:       make(map[string]*missingBlob),
+		missingCounts: make([]int, len(stores)),
+		overflowed:    true, // blobs that went missing before a restart are not known
+		grp:           stop.New(),
+	}
+	for i, s := range stores {
+		r.replicas = append(r.replicas, &replica{index: i, store: s})
+	}
+	return r
+}
+
+const nameReplicated = "replicated"
+
+// Name is the cache type name
+func (r *ReplicatedStore) Name() string { return nameReplicated }
+
+// Start starts the repair job
+func (r *ReplicatedStore) Start() {
+	r.grp.Add(1)
+	go func() {
+		defer r.grp.Done()
+		ticker := time.NewTicker(r.opts.RepairInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.grp.Ch():
+				return
+			case <-ticker.C:
+				r.repair()
+			}
+		}
+	}()
+}
+
+// Shutdown stops the repair job. Blobs that were not repaired yet are found again by comparing the
+// replicas after the next start.
+func (r *ReplicatedStore) Shutdown() {
+	r.grp.StopAndWait()
+}
+
+// Has returns true if any replica has the blob
+func (r *ReplicatedStore) Has(hash string) (bool, error) {
+	return r.HasContext(context.Background(), hash)
+}
+
+// HasContext is Has with a context
+func (r *ReplicatedStore) HasContext(ctx context.Context, hash string) (bool, error) {
+	var lastErr error
+	var lacking []int
+	for _, rep := range r.ordered() {
+		start := time.Now()
+		has, err := HasContext(ctx, rep.store, hash)
+		if err != nil {
+			if ctx.Err() != nil {
+				return false, err
+			}
+			rep.fail()
+			lastErr = err
+			continue
+		}
+		rep.succeed(time.Since(start))
+		if has {
+			r.markAllMissing(hash, lacking)
+			return true, nil
+		}
+		lacking = append(lacking, rep.index)
+	}
+	return false, lastErr
+}
+
+// Get gets the blob from the fastest replica that has it
+func (r *ReplicatedStore) Get(hash string) (stream.Blob, error) {
+	return r.GetContext(context.Background(), hash)
+}
+
+// GetContext is Get with a context
+func (r *ReplicatedStore) GetContext(ctx context.Context, hash string) (stream.Blob, error) {
+	var lastErr error
+	var lacking []int
+	for _, rep := range r.ordered() {
+		start := time.Now()
+		blob, err := GetContext(ctx, rep.store, hash)
+		if err == nil {
+			rep.succeed(time.Since(start))
+			r.markAllMissing(hash, lacking)
+			return blob, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if errors.Is(err, ErrBlobNotFound) {
+			rep.succeed(time.Since(start))
+			lacking = append(lacking, rep.index)
+		} else {
+			rep.fail()
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, errors.Err(ErrBlobNotFound)
+}
+
+// Put stores the blob in every replica. It returns once WriteQuorum replicas have stored it.
+func (r *ReplicatedStore) Put(hash string, blob stream.Blob) error {
+	return r.write(hash, false, func(s BlobStore) error { return s.Put(hash, blob) })
+}
+
+// PutSD stores the sd blob in every replica. It returns once WriteQuorum replicas have stored it.
+func (r *ReplicatedStore) PutSD(hash string, blob stream.Blob) error {
+	return r.write(hash, true, func(s BlobStore) error { return s.PutSD(hash, blob) })
+}
+
+// Delete deletes the blob from every replica
+func (r *ReplicatedStore) Delete(hash string) error {
+	r.repaired(hash, nil)
+
+	var lastErr error
+	for _, rep := range r.replicas {
+		err := rep.store.Delete(hash)
+		if err != nil {
+			log.Errorf("deleting %s from replica %s: %s", hash, rep.label(), errors.FullTrace(err))
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+type replicaResult struct {
+	rep *replica
+	err error
+}
+
+func (r *ReplicatedStore) write(hash string, isSD bool, put func(s BlobStore) error) error {
+	results := make(chan replicaResult, len(r.replicas))
+	for _, rep := range r.replicas {
+		go func(rep *replica) {
+			start := time.Now()
+			err := put(rep.store)
+			if err == nil {
+				rep.succeed(time.Since(start))
+			} else {
+				rep.fail()
+			}
+			results <- replicaResult{rep: rep, err: err}
+		}(rep)
+	}
+
+	handle := func(res replicaResult) {
+		if res.err != nil {
+			log.Errorf("writing %s to replica %s: %s", hash, res.rep.label(), errors.FullTrace(res.err))
+			_ = r.markMissing(hash, isSD, res.rep.index)
+		}
+	}
+
+	succeeded, failed := 0, 0
+	var lastErr error
+	for i := 0; i < len(r.replicas); i++ {
+		res := <-results
+		handle(res)
+		if res.err == nil {
+			succeeded++
+		} else {
+			failed++
+			lastErr = res.err
+		}
+
+		if succeeded >= r.opts.WriteQuorum || failed > len(r.replicas)-r.opts.WriteQuorum {
+			// the outcome is decided. let the slower replicas finish in the background
+			go func(remaining int) {
+				for j := 0; j < remaining; j++ {
+					handle(<-results)
+				}
+			}(len(r.replicas) - i - 1)
+			break
+		}
+	}
+
+	if succeeded < r.opts.WriteQuorum {
+		return errors.Prefix(fmt.Sprintf("write quorum not reached (%d/%d)", succeeded, r.opts.WriteQuorum), lastErr)
+	}
+	return nil
+}
+
+// markMissing records that a replica lacks a blob. It returns false if there was no room to track it.
+func (r *ReplicatedStore) markMissing(hash string, isSD bool, index int) bool {
+	r.mu.Lock()
+	m, ok := r.missing[hash]
+	if !ok {
+		if len(r.missing) >= r.opts.MaxMissing {
+			r.overflowed = true
+			r.mu.Unlock()
+			return false
+		}
+		m = &missingBlob{replicas: make(map[int]bool)}
+		r.missing[hash] = m
+	}
+	m.isSD = m.isSD || isSD
+	if !m.replicas[index] {
+		m.replicas[index] = true
+		r.missingCounts[index]++
+	}
+	r.updateMissingGauge()
+	r.mu.Unlock()
+	return true
+}
+
+// markAllMissing records replicas that were found to lack a blob that another replica has. Whether it's an
+// sd blob is not known here, so repair checks the blob it copies.
+func (r *ReplicatedStore) markAllMissing(hash string, replicas []int) {
+	for _, i := range replicas {
+		_ = r.markMissing(hash, false, i)
+	}
+}
+
+// repair copies each missing blob from a replica that has it to the replicas that don't
+func (r *ReplicatedStore) repair() {
+	r.mu.Lock()
+	todo := make(map[string]missingBlob, len(r.missing))
+	for hash, m := range r.missing {
+		replicas := make(map[int]bool, len(m.replicas))
+		for i := range m.replicas {
+			replicas[i] = true
+		}
+		todo[hash] = missingBlob{isSD: m.isSD, replicas: replicas}
+	}
+	r.mu.Unlock()
+
+	for hash, m := range todo {
+		select {
+		case <-r.grp.Ch():
+			return
+		default:
+		}
+
+		blob, err := r.getFromAny(hash, m.replicas)
+		if err != nil {
+			if errors.Is(err, ErrBlobNotFound) {
+				r.repaired(hash, m.replicas) // nothing to repair from, e.g. it was deleted
+			} else {
+				log.Errorf("repairing %s: %s", hash, errors.FullTrace(err))
+			}
+			continue
+		}
+
+		isSD := m.isSD || isSDBlob(blob)
+		fixed := make(map[int]bool)
+		for i := range m.replicas {
+			rep := r.replicas[i]
+			if isSD {
+				err = rep.store.PutSD(hash, blob)
+			} else {
+				err = rep.store.Put(hash, blob)
+			}
+			if err != nil {
+				log.Errorf("repairing %s in replica %s: %s", hash, rep.label(), errors.FullTrace(err))
+				continue
+			}
+			metrics.ReplicaRepairCount.With(r.labels(rep)).Inc()
+			fixed[i] = true
+		}
+		r.repaired(hash, fixed)
+	}
+
+	r.mu.Lock()
+	overflowed := r.overflowed && len(r.missing) < r.opts.MaxMissing
+	if overflowed {
+		r.overflowed = false
+	}
+	r.mu.Unlock()
+	if overflowed {
+		r.compare()
+	}
+}
+
+// compare lists the blobs in every replica that supports it, one hash prefix at a time, and marks the ones
+// that some replicas lack. If too many are missing to track, it stops and continues from the same prefix
+// after they are repaired.
+func (r *ReplicatedStore) compare() {
+	var listers []prefixLister
+	var indexes []int
+	for i, rep := range r.replicas {
+		l, ok := rep.store.(prefixLister)
+		if !ok || i >= 64 {
+			log.Warnf("replica %s can't list its blobs by prefix, so it's only repaired when a blob is found missing", rep.label())
+			continue
+		}
+		listers = append(listers, l)
+		indexes = append(indexes, i)
+	}
+	if len(listers) < 2 {
+		return
+	}
+
+	r.mu.Lock()
+	from := r.compareFrom
+	r.mu.Unlock()
+
+	for p := from; p < comparePrefixes; p++ {
+		select {
+		case <-r.grp.Ch():
+			r.setCompareFrom(p, true)
+			return
+		default:
+		}
+
+		prefix := fmt.Sprintf("%02x", p)
+		stored := make(map[string]uint64) // hash -> a bit for each replica that has it
+		for j, l := range listers {
+			i := indexes[j]
+			hashes, err := l.listPrefix(prefix)
+			if err != nil {
+				log.Errorf("listing %s in replica %s: %s", prefix, r.replicas[i].label(), errors.FullTrace(err))
+				r.setCompareFrom(p, true) // try again on the next repair
+				return
+			}
+			for _, hash := range hashes {
+				stored[hash] |= 1 << uint(i)
+			}
+		}
+
+		for hash, has := range stored {
+			for _, i := range indexes {
+				if has&(1<<uint(i)) == 0 && !r.markMissing(hash, false, i) {
+					// no room left. the rest of this prefix is compared again once these are repaired
+					r.setCompareFrom(p, true)
+					return
+				}
+			}
+		}
+	}
+	r.setCompareFrom(0, false)
+}
+
+// number of two hex character hash prefixes
+const comparePrefixes = 256
+
+// setCompareFrom sets where the next comparison starts, and whether one is needed
+func (r *ReplicatedStore) setCompareFrom(p int, overflowed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.compareFrom = p
+	r.overflowed = r.overflowed || overflowed
+}
+
+// isSDBlob returns true if the blob is an sd blob, which must be stored with PutSD
+func isSDBlob(blob stream.Blob) bool {
+	if len(blob) == 0 || len(blob) > maxSDBlobSize || blob[0] != '{' { // sd blobs are JSON, content blobs are encrypted
+		return false
+	}
+	var sd db.SdBlob
+	return json.Unmarshal(blob, &sd) == nil && sd.StreamHash != ""
+}
+
+// getFromAny gets the blob from a replica that's not in skip
+func (r *ReplicatedStore) getFromAny(hash string, skip map[int]bool) (stream.Blob, error) {
+	var lastErr error
+	for _, rep := range r.ordered() {
+		if skip[rep.index] {
+			continue
+		}
+		blob, err := rep.store.Get(hash)
+		if err == nil {
+			return blob, nil
+		}
+		if !errors.Is(err, ErrBlobNotFound) {
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, errors.Err(ErrBlobNotFound)
+}
+
+// repaired removes the replicas from the blob's missing list. nil removes all of them.
+func (r *ReplicatedStore) repaired(hash string, replicas map[int]bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.missing[hash]
+	if !ok {
+		return
+	}
+	for i := range m.replicas {
+		if replicas == nil || replicas[i] {
+			delete(m.replicas, i)
+			r.missingCounts[i]--
+		}
+	}
+	if len(m.replicas) == 0 {
+		delete(r.missing, hash)
+	}
+	r.updateMissingGauge()
+}
+
+// updateMissingGauge must be called with the lock held
+func (r *ReplicatedStore) updateMissingGauge() {
+	for i, rep := range r.replicas {
+		metrics.ReplicaMissingBlobs.With(r.labels(rep)).Set(float64(r.missingCounts[i]))
+	}
+	metrics.ReplicaRepairQueueSize.With(map[string]string{metrics.LabelComponent: r.opts.Component}).Set(float64(len(r.missing)))
+}
+
+// missingCount returns the number of blobs that some replica is missing
+func (r *ReplicatedStore) missingCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.missing)
+}
+
+func (r *ReplicatedStore) labels(rep *replica) map[string]string {
+	return map[string]string{
+		metrics.LabelComponent: r.opts.Component,
+		metrics.LabelReplica:   rep.label(),
+	}
+}
+
+// ordered returns the healthy replicas from fastest to slowest, followed by the unhealthy ones
+func (r *ReplicatedStore) ordered() []*replica {
+	type ranked struct {
+		rep     *replica
+		healthy bool
+		latency time.Duration
+	}
+	reps := make([]ranked, len(r.replicas))
+	for i, rep := range r.replicas {
+		rep.mu.Lock()
+		reps[i] = ranked{rep: rep, healthy: time.Since(rep.failedAt) > replicaRetryInterval, latency: rep.latency}
+		rep.mu.Unlock()
+	}
+
+	// insertion sort keeps the configured order for ties. there are only a few replicas
+	for i := 1; i < len(reps); i++ {
+		for j := i; j > 0; j-- {
+			a, b := reps[j-1], reps[j]
+			if a.healthy == b.healthy && a.latency <= b.latency || a.healthy && !b.healthy {
+				break
+			}
+			reps[j-1], reps[j] = b, a
+		}
+	}
+
+	ordered := make([]*replica, len(reps))
+	for i, rr := range reps {
+		ordered[i] = rr.rep
+	}
+	return ordered
+}
+
+func (rep *replica) label() string {
+	return strconv.Itoa(rep.index) + "_" + rep.store.Name()
+}
+
+func (rep *replica) succeed(d time.Duration) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	if rep.latency == 0 {
+		rep.latency = d
+	} else {
+		rep.latency = (rep.latency*4 + d) / 5
+	}
+}
+
+func (rep *replica) fail() {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	rep.failedAt = time.Now()
+}
@@ -0,0 +1,155 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicatedStore_WriteQuorum(t *testing.T) {
+	a, b := NewMemStore(), NewMemStore()
+	c := &flakyStore{MemStore: NewMemStore(), failures: 1}
+	r := NewReplicatedStore([]BlobStore{a, b, c}, ReplicatedOpts{WriteQuorum: 2})
+
+	blob := []byte("this is a blob of stuff")
+	require.NoError(t, r.Put("hash", blob))
+
+	require.Eventually(t, func() bool { return r.missingCount() == 1 }, time.Second, 10*time.Millisecond,
+		"the replica that failed should be recorded")
+
+	r.repair()
+	assert.Equal(t, 0, r.missingCount())
+	repaired, err := c.Get("hash")
+	require.NoError(t, err)
+	assert.EqualValues(t, blob, repaired)
+}
+
+func TestReplicatedStore_NoQuorum(t *testing.T) {
+	a := NewMemStore()
+	b := &flakyStore{MemStore: NewMemStore(), failures: 1}
+	c := &flakyStore{MemStore: NewMemStore(), failures: 1}
+	r := NewReplicatedStore([]BlobStore{a, b, c}, ReplicatedOpts{})
+
+	err := r.Put("hash", []byte("this is a blob of stuff"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "write quorum not reached (1/2)")
+}
+
+func TestReplicatedStore_ReadFallback(t *testing.T) {
+	a, b := NewMemStore(), NewMemStore()
+	r := NewReplicatedStore([]BlobStore{a, b}, ReplicatedOpts{})
+
+	blob := []byte("this is a blob of stuff")
+	require.NoError(t, b.Put("hash", blob))
+
+	has, err := r.Has("hash")
+	require.NoError(t, err)
+	assert.True(t, has)
+
+	read, err := r.Get("hash")
+	require.NoError(t, err)
+	assert.EqualValues(t, blob, read)
+	assert.Equal(t, 1, r.missingCount(), "the replica without the blob should be recorded")
+
+	r.repair()
+	read, err = a.Get("hash")
+	require.NoError(t, err)
+	assert.EqualValues(t, blob, read)
+
+	_, err = r.Get("nonexistent")
+	assert.True(t, errors.Is(err, ErrBlobNotFound))
+}
+
+func TestReplicatedStore_ReadsFromFastest(t *testing.T) {
+	slow := NewSlowBlobStore(20 * time.Millisecond)
+	fast := NewMemStore()
+	r := NewReplicatedStore([]BlobStore{slow, fast}, ReplicatedOpts{WriteQuorum: 2})
+
+	require.NoError(t, r.Put("hash", []byte("this is a blob of stuff")))
+	assert.Equal(t, fast, r.ordered()[0].store)
+
+	// a failing replica is tried last
+	r.replicas[1].fail()
+	assert.Equal(t, slow, r.ordered()[0].store)
+}
+
+func TestReplicatedStore_ComparesReplicas(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	a, b := NewDiskStore(tmpDir+"/a", 2), NewDiskStore(tmpDir+"/b", 2)
+	var hashes []string
+	for i := 0; i < 3; i++ {
+		blob := []byte(fmt.Sprintf("blob %d", i))
+		hashes = append(hashes, BlobHash(blob))
+		require.NoError(t, a.Put(BlobHash(blob), blob))
+	}
+
+	sort.Strings(hashes)
+	second, err := strconv.ParseInt(hashes[1][:2], 16, 0)
+	require.NoError(t, err)
+
+	// nothing is known to be missing after a start, and only one missing blob is tracked at a time
+	r := NewReplicatedStore([]BlobStore{a, b}, ReplicatedOpts{MaxMissing: 1})
+	r.repair()
+	assert.Equal(t, 1, r.missingCount(), "the replicas should be compared")
+	assert.Equal(t, int(second), r.compareFrom, "the comparison should stop at the prefix that overflowed")
+
+	for i := 0; i < len(hashes); i++ {
+		r.repair()
+	}
+	assert.Equal(t, 0, r.missingCount())
+	assert.Equal(t, 0, r.compareFrom)
+	assert.False(t, r.overflowed)
+	for _, hash := range hashes {
+		has, err := b.Has(hash)
+		require.NoError(t, err)
+		assert.True(t, has)
+	}
+}
+
+// sdRecordingStore records the blobs that are stored with PutSD
+type sdRecordingStore struct {
+	*MemStore
+	sd map[string]bool
+}
+
+func (s *sdRecordingStore) PutSD(hash string, blob stream.Blob) error {
+	s.sd[hash] = true
+	return s.MemStore.PutSD(hash, blob)
+}
+
+func TestReplicatedStore_RepairsSDBlobs(t *testing.T) {
+	a := NewMemStore()
+	b := &sdRecordingStore{MemStore: NewMemStore(), sd: make(map[string]bool)}
+	r := NewReplicatedStore([]BlobStore{b, a}, ReplicatedOpts{})
+
+	sdBlob := []byte(`{"stream_name":"test","blobs":[],"stream_type":"lbryfile","key":"","suggested_file_name":"test","stream_hash":"abcd"}`)
+	blob := []byte("this is a blob of stuff")
+	require.NoError(t, a.PutSD("sd", sdBlob))
+	require.NoError(t, a.Put("blob", blob))
+
+	// reads don't know which blobs are sd blobs. b is read first, so it's found to lack them
+	r.replicas[1].fail()
+	_, err := r.Get("sd")
+	require.NoError(t, err)
+	_, err = r.Get("blob")
+	require.NoError(t, err)
+	require.Equal(t, 2, r.missingCount())
+
+	r.repair()
+	assert.Equal(t, 0, r.missingCount())
+	assert.True(t, b.sd["sd"], "the sd blob should be repaired with PutSD")
+	assert.False(t, b.sd["blob"])
+}
@@ -2,7 +2,16 @@ package store
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/lbryio/lbry.go/v2/extras/errors"
@@ -20,22 +29,54 @@ import (
 
 // S3Store is an S3 store
 type S3Store struct {
-	awsID     string
-	awsSecret string
-	region    string
-	bucket    string
+	opts S3Opts
 
 	session *session.Session
 }
 
+// S3Opts configures an S3Store. Only the credentials, region, and bucket are needed for AWS. The other
+// options are for S3-compatible services like MinIO or Ceph RGW.
+type S3Opts struct {
+	AwsID     string
+	AwsSecret string
+	Region    string
+	Bucket    string
+
+	// URL of an S3-compatible service. Empty means AWS. Use an http:// URL to disable TLS.
+	Endpoint string
+	// address buckets as endpoint/bucket instead of bucket.endpoint. most non-AWS services need this
+	PathStyle bool
+	// storage class for uploaded blobs. empty means the bucket's default
+	StorageClass string
+	// prepended to the hash to make the key of each blob
+	KeyPrefix string
+	// store blobs under directories named after the first N chars of the hash, like DiskStore does. this
+	// spreads the keys over more S3 partitions. 0 = all blobs in the same directory.
+	// use MigrateKeys to move existing blobs after changing this
+	PrefixLength int
+	// also look for blobs at the key they have without PrefixLength, so blobs that MigrateKeys has not
+	// moved yet can still be read
+	LegacyKeyFallback bool
+	// path to a PEM file with the CA certificates to trust instead of the system ones
+	CACertFile string
+	// don't verify the server's TLS certificate
+	InsecureSkipVerify bool
+}
+
 // NewS3Store returns an initialized S3 store pointer.
 func NewS3Store(awsID, awsSecret, region, bucket string) *S3Store {
-	return &S3Store{
-		awsID:     awsID,
-		awsSecret: awsSecret,
-		region:    region,
-		bucket:    bucket,
-	}
+	return NewS3StoreWithOpts(S3Opts{
+		AwsID:        awsID,
+		AwsSecret:    awsSecret,
+		Region:       region,
+		Bucket:       bucket,
+		StorageClass: s3.StorageClassIntelligentTiering,
+	})
+}
+
+// NewS3StoreWithOpts returns an S3 store configured with opts.
+func NewS3StoreWithOpts(opts S3Opts) *S3Store {
+	return &S3Store{opts: opts}
 }
 
 const nameS3 = "s3"
@@ -45,27 +86,40 @@ func (s *S3Store) Name() string { return nameS3 }
 
 // Has returns T/F or Error ( from S3 ) if the store contains the blob.
 func (s *S3Store) Has(hash string) (bool, error) {
+	return s.HasContext(context.Background(), hash)
+}
+
+// HasContext is Has with a context
+func (s *S3Store) HasContext(ctx context.Context, hash string) (bool, error) {
 	err := s.initOnce()
 	if err != nil {
 		return false, err
 	}
 
-	_, err = s3.New(s.session).HeadObject(&s3.HeadObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(hash),
-	})
-	if err != nil {
-		if reqFail, ok := err.(s3.RequestFailure); ok && reqFail.StatusCode() == http.StatusNotFound {
-			return false, nil
+	for _, key := range s.keys(hash) {
+		_, err = s3.New(s.session).HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(s.opts.Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			if reqFail, ok := err.(s3.RequestFailure); ok && reqFail.StatusCode() == http.StatusNotFound {
+				continue
+			}
+			return false, err
 		}
-		return false, err
+		return true, nil
 	}
 
-	return true, nil
+	return false, nil
 }
 
 // Get returns the blob slice if present or errors on S3.
 func (s *S3Store) Get(hash string) (stream.Blob, error) {
+	return s.GetContext(context.Background(), hash)
+}
+
+// GetContext is Get with a context
+func (s *S3Store) GetContext(ctx context.Context, hash string) (stream.Blob, error) {
 	//Todo-Need to handle error for blob doesn't exist for consistency.
 	err := s.initOnce()
 	if err != nil {
@@ -77,26 +131,103 @@ func (s *S3Store) Get(hash string) (stream.Blob, error) {
 		log.Debugf("Getting %s from S3 took %s", hash[:8], time.Since(t).String())
 	}(time.Now())
 
-	buf := &aws.WriteAtBuffer{}
-	_, err = s3manager.NewDownloader(s.session).Download(buf, &s3.GetObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(hash),
-	})
+	var buf *aws.WriteAtBuffer
+	for _, key := range s.keys(hash) {
+		buf = &aws.WriteAtBuffer{}
+		_, err = s3manager.NewDownloader(s.session).DownloadWithContext(ctx, buf, &s3.GetObjectInput{
+			Bucket: aws.String(s.opts.Bucket),
+			Key:    aws.String(key),
+		})
+		err = s.getErr(err)
+		if !errors.Is(err, ErrBlobNotFound) {
+			break
+		}
+	}
+
+	return buf.Bytes(), err
+}
+
+// GetReader returns a reader for the blob body and its size, or an error if the blob doesn't exist.
+func (s *S3Store) GetReader(hash string) (io.ReadCloser, int64, error) {
+	return s.GetReaderContext(context.Background(), hash)
+}
+
+// GetReaderContext is GetReader with a context
+func (s *S3Store) GetReaderContext(ctx context.Context, hash string) (io.ReadCloser, int64, error) {
+	err := s.initOnce()
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case s3.ErrCodeNoSuchBucket:
-				return nil, errors.Err("bucket %s does not exist", s.bucket)
-			case s3.ErrCodeNoSuchKey:
-				return nil, errors.Err(ErrBlobNotFound)
-			}
+		return nil, 0, err
+	}
+
+	log.Debugf("Streaming %s from S3", hash[:8])
+
+	var res *s3.GetObjectOutput
+	for _, key := range s.keys(hash) {
+		res, err = s3.New(s.session).GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.opts.Bucket),
+			Key:    aws.String(key),
+		})
+		err = s.getErr(err)
+		if !errors.Is(err, ErrBlobNotFound) {
+			break
 		}
-		return buf.Bytes(), err
+	}
+	if err != nil {
+		return nil, 0, err
 	}
 
-	return buf.Bytes(), nil
+	return res.Body, aws.Int64Value(res.ContentLength), nil
 }
 
+// GetRange returns a reader for part of the blob
+func (s *S3Store) GetRange(hash string, offset, length int64) (io.ReadCloser, error) {
+	err := s.initOnce()
+	if err != nil {
+		return nil, err
+	}
+
+	if length == 0 {
+		// there is no range for zero bytes, but a missing blob should still be an error
+		has, err := s.Has(hash)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			return nil, errors.Err(ErrBlobNotFound)
+		}
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	rng := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		rng += strconv.FormatInt(offset+length-1, 10)
+	}
+
+	var res *s3.GetObjectOutput
+	for _, key := range s.keys(hash) {
+		res, err = s3.New(s.session).GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(s.opts.Bucket),
+			Key:    aws.String(key),
+			Range:  aws.String(rng),
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == errCodeInvalidRange {
+			return ioutil.NopCloser(bytes.NewReader(nil)), nil // offset is past the end
+		}
+		err = s.getErr(err)
+		if !errors.Is(err, ErrBlobNotFound) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+// S3 returns this when a range starts after the end of the object. the sdk has no constant for it
+const errCodeInvalidRange = "InvalidRange"
+
 // Put stores the blob on S3 or errors if S3 connection errors.
 func (s *S3Store) Put(hash string, blob stream.Blob) error {
 	err := s.initOnce()
@@ -110,16 +241,40 @@ func (s *S3Store) Put(hash string, blob stream.Blob) error {
 	}(time.Now())
 
 	_, err = s3manager.NewUploader(s.session).Upload(&s3manager.UploadInput{
-		Bucket:       aws.String(s.bucket),
-		Key:          aws.String(hash),
+		Bucket:       aws.String(s.opts.Bucket),
+		Key:          aws.String(s.key(hash)),
 		Body:         bytes.NewBuffer(blob),
-		StorageClass: aws.String(s3.StorageClassIntelligentTiering),
+		StorageClass: s.storageClass(),
 	})
 	metrics.MtrOutBytesReflector.Add(float64(blob.Size()))
 
 	return err
 }
 
+// PutReader stores the blob read from r on S3 or errors if S3 connection errors.
+func (s *S3Store) PutReader(hash string, r io.Reader) error {
+	err := s.initOnce()
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Streaming %s to S3", hash[:8])
+	defer func(t time.Time) {
+		log.Debugf("Streaming %s took %s", hash[:8], time.Since(t).String())
+	}(time.Now())
+
+	cr := &countingReader{r: r}
+	_, err = s3manager.NewUploader(s.session).Upload(&s3manager.UploadInput{
+		Bucket:       aws.String(s.opts.Bucket),
+		Key:          aws.String(s.key(hash)),
+		Body:         cr,
+		StorageClass: s.storageClass(),
+	})
+	metrics.MtrOutBytesReflector.Add(float64(cr.n))
+
+	return err
+}
+
 // PutSD stores the sd blob on S3 or errors if S3 connection errors.
 func (s *S3Store) PutSD(hash string, blob stream.Blob) error {
 	//Todo - handle missing stream for consistency
@@ -134,23 +289,149 @@ func (s *S3Store) Delete(hash string) error {
 
 	log.Debugf("Deleting %s from S3", hash[:8])
 
-	_, err = s3.New(s.session).DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(hash),
-	})
+	for _, key := range s.keys(hash) {
+		_, err = s3.New(s.session).DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(s.opts.Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
+// getErr translates S3 errors for missing buckets and keys into store errors
+func (s *S3Store) getErr(err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchBucket:
+			return errors.Err("bucket %s does not exist", s.opts.Bucket)
+		case s3.ErrCodeNoSuchKey:
+			return errors.Err(ErrBlobNotFound)
+		}
+	}
 	return err
 }
 
+func (s *S3Store) key(hash string) string {
+	if s.opts.PrefixLength <= 0 || len(hash) < s.opts.PrefixLength {
+		return s.opts.KeyPrefix + hash
+	}
+	return s.opts.KeyPrefix + hash[:s.opts.PrefixLength] + "/" + hash
+}
+
+// list returns the hashes of the blobs in the bucket
+func (s *S3Store) list() ([]string, error) {
+	return s.listKeys(s.opts.KeyPrefix, "")
+}
+
+// listPrefix returns the hashes of the blobs in the bucket that start with prefix
+func (s *S3Store) listPrefix(prefix string) ([]string, error) {
+	keyPrefix := s.opts.KeyPrefix + prefix
+	if s.opts.PrefixLength > 0 && len(prefix) > s.opts.PrefixLength {
+		keyPrefix = s.opts.KeyPrefix + prefix[:s.opts.PrefixLength] + "/" + prefix
+	}
+	hashes, err := s.listKeys(keyPrefix, prefix)
+	if err != nil || !s.opts.LegacyKeyFallback || keyPrefix == s.opts.KeyPrefix+prefix {
+		return hashes, err
+	}
+
+	// blobs that were not moved to their prefixed key yet
+	legacy, err := s.listKeys(s.opts.KeyPrefix+prefix, prefix)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(hashes))
+	for _, h := range hashes {
+		seen[h] = true
+	}
+	for _, h := range legacy {
+		if !seen[h] {
+			hashes = append(hashes, h)
+		}
+	}
+	return hashes, nil
+}
+
+// listKeys returns the hashes of the blobs whose keys start with keyPrefix and whose hashes start with
+// hashPrefix
+func (s *S3Store) listKeys(keyPrefix, hashPrefix string) ([]string, error) {
+	err := s.initOnce()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var hashes []string
+	err = s3.New(s.session).ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.opts.Bucket),
+		Prefix: aws.String(keyPrefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			hash := path.Base(strings.TrimPrefix(aws.StringValue(obj.Key), s.opts.KeyPrefix))
+			if isBlobHash(hash) && strings.HasPrefix(hash, hashPrefix) && !seen[hash] {
+				seen[hash] = true
+				hashes = append(hashes, hash)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, s.getErr(err)
+	}
+	return hashes, nil
+}
+
+// keys returns the keys the blob may be stored at, in the order they should be tried
+func (s *S3Store) keys(hash string) []string {
+	key := s.key(hash)
+	if legacy := s.opts.KeyPrefix + hash; s.opts.LegacyKeyFallback && legacy != key {
+		return []string{key, legacy}
+	}
+	return []string{key}
+}
+
+func (s *S3Store) storageClass() *string {
+	if s.opts.StorageClass == "" {
+		return nil
+	}
+	return aws.String(s.opts.StorageClass)
+}
+
 func (s *S3Store) initOnce() error {
 	if s.session != nil {
 		return nil
 	}
 
-	sess, err := session.NewSession(&aws.Config{
-		Credentials: credentials.NewStaticCredentials(s.awsID, s.awsSecret, ""),
-		Region:      aws.String(s.region),
-	})
+	config := &aws.Config{
+		Credentials:      credentials.NewStaticCredentials(s.opts.AwsID, s.opts.AwsSecret, ""),
+		Region:           aws.String(s.opts.Region),
+		S3ForcePathStyle: aws.Bool(s.opts.PathStyle),
+	}
+	if s.opts.Endpoint != "" {
+		config.Endpoint = aws.String(s.opts.Endpoint)
+	}
+
+	if s.opts.InsecureSkipVerify {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		config.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	opts := session.Options{Config: *config}
+	if s.opts.CACertFile != "" {
+		// takes priority over the AWS_CA_BUNDLE env var
+		f, err := os.Open(s.opts.CACertFile)
+		if err != nil {
+			return errors.Err(err)
+		}
+		defer f.Close()
+		opts.CustomCABundle = f
+	}
+
+	sess, err := session.NewSessionWithOptions(opts)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,108 @@
+package store
+
+import (
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+// S3MigrateSummary counts the objects seen by MigrateKeys
+type S3MigrateSummary struct {
+	Checked int `json:"checked"`
+	Moved   int `json:"moved"`
+	Skipped int `json:"skipped"` // not named after a blob hash
+	Errors  int `json:"errors"`
+}
+
+// MigrateKeys moves every blob under the key prefix to the key it has in the store's layout. Blobs can
+// be in any layout before the migration, e.g. after PrefixLength was changed. If dryRun is true, blobs
+// are counted as moved but are not touched.
+func (s *S3Store) MigrateKeys(workers int, dryRun bool) (S3MigrateSummary, error) {
+	var summary S3MigrateSummary
+	err := s.initOnce()
+	if err != nil {
+		return summary, err
+	}
+	if workers <= 0 {
+		workers = 1
+	}
+
+	client := s3.New(s.session)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	keyChan := make(chan string)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keyChan {
+				hash := path.Base(strings.TrimPrefix(key, s.opts.KeyPrefix))
+				moved, err := false, error(nil)
+				if isBlobHash(hash) && key != s.key(hash) {
+					moved = true
+					if !dryRun {
+						err = s.moveKey(client, key, s.key(hash))
+					}
+				}
+
+				mu.Lock()
+				summary.Checked++
+				switch {
+				case !isBlobHash(hash):
+					summary.Skipped++
+				case err != nil:
+					summary.Errors++
+					log.Errorf("moving %s: %s", key, errors.FullTrace(err))
+				case moved:
+					summary.Moved++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	err = client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.opts.Bucket),
+		Prefix: aws.String(s.opts.KeyPrefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			keyChan <- aws.StringValue(obj.Key)
+		}
+		return true
+	})
+	close(keyChan)
+	wg.Wait()
+
+	if err != nil {
+		return summary, s.getErr(err)
+	}
+	return summary, nil
+}
+
+// moveKey copies the object to the new key and deletes the old one
+func (s *S3Store) moveKey(client *s3.S3, from, to string) error {
+	source := url.URL{Path: s.opts.Bucket + "/" + from}
+	_, err := client.CopyObject(&s3.CopyObjectInput{
+		Bucket:       aws.String(s.opts.Bucket),
+		Key:          aws.String(to),
+		CopySource:   aws.String(source.EscapedPath()),
+		StorageClass: s.storageClass(),
+	})
+	if err != nil {
+		return errors.Err(err)
+	}
+
+	_, err = client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.opts.Bucket),
+		Key:    aws.String(from),
+	})
+	return errors.Err(err)
+}
@@ -0,0 +1,404 @@
+package store
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is an in-process S3 server that supports the few path-style object requests S3Store makes
+type fakeS3 struct {
+	bucket string
+
+	mu            sync.Mutex
+	objects       map[string][]byte
+	storageClass  map[string]string
+	requestsByKey map[string]int
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		bucket:        bucket,
+		objects:       make(map[string][]byte),
+		storageClass:  make(map[string]string),
+		requestsByKey: make(map[string]int),
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != f.bucket {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(parts) == 1 || parts[1] == "" {
+		f.list(w, r.URL.Query().Get("prefix"))
+		return
+	}
+	key := parts[1]
+	f.requestsByKey[key]++
+
+	switch r.Method {
+	case http.MethodPut:
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			source, _ = url.PathUnescape(source)
+			obj, ok := f.objects[strings.TrimPrefix(strings.TrimPrefix(source, "/"), f.bucket+"/")]
+			if !ok {
+				f.error(w, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			f.objects[key] = obj
+			f.storageClass[key] = r.Header.Get("X-Amz-Storage-Class")
+			_, _ = fmt.Fprint(w, `<CopyObjectResult><ETag>"etag"</ETag></CopyObjectResult>`)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			f.error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.objects[key] = body
+		f.storageClass[key] = r.Header.Get("X-Amz-Storage-Class")
+		w.Header().Set("ETag", `"etag"`)
+	case http.MethodHead, http.MethodGet:
+		obj, ok := f.objects[key]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		status := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			end := len(obj) - 1
+			bounds := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+			start, err := strconv.Atoi(bounds[0])
+			if err == nil && len(bounds) == 2 && bounds[1] != "" {
+				end, err = strconv.Atoi(bounds[1])
+			}
+			if err != nil || start >= len(obj) {
+				f.error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			if end >= len(obj) {
+				end = len(obj) - 1
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(obj)))
+			obj = obj[start : end+1]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(obj)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// list responds to ListObjectsV2 with every matching key in one page
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = fmt.Fprintf(w, "<ListBucketResult><Name>%s</Name><IsTruncated>false</IsTruncated><KeyCount>%d</KeyCount>", f.bucket, len(keys))
+	for _, key := range keys {
+		_, _ = fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size></Contents>", key, len(f.objects[key]))
+	}
+	_, _ = fmt.Fprint(w, "</ListBucketResult>")
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) object(key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[key]
+	return obj, ok
+}
+
+func newFakeS3Store(server *httptest.Server, opts S3Opts) *S3Store {
+	opts.AwsID = "id"
+	opts.AwsSecret = "secret"
+	opts.Region = "us-east-1"
+	opts.Endpoint = server.URL
+	opts.PathStyle = true
+	if opts.Bucket == "" {
+		opts.Bucket = "blobs"
+	}
+	return NewS3StoreWithOpts(opts)
+}
+
+func TestS3Store_FakeServer(t *testing.T) {
+	fake := newFakeS3("blobs")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	s := newFakeS3Store(server, S3Opts{StorageClass: s3.StorageClassStandard, KeyPrefix: "blobs/"})
+
+	b := []byte("this is a blob of stuff")
+	hash := BlobHash(b)
+
+	has, err := s.Has(hash)
+	require.NoError(t, err)
+	assert.False(t, has)
+	_, err = s.Get(hash)
+	assert.True(t, errors.Is(err, ErrBlobNotFound))
+
+	require.NoError(t, s.Put(hash, b))
+	obj, ok := fake.object("blobs/" + hash)
+	require.True(t, ok, "key should have the prefix")
+	assert.EqualValues(t, b, obj)
+	assert.Equal(t, s3.StorageClassStandard, fake.storageClass["blobs/"+hash])
+
+	has, err = s.Has(hash)
+	require.NoError(t, err)
+	assert.True(t, has)
+
+	blob, err := s.Get(hash)
+	require.NoError(t, err)
+	assert.EqualValues(t, b, blob)
+
+	rc, size, err := s.GetReader(hash)
+	require.NoError(t, err)
+	read, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	rc.Close()
+	assert.EqualValues(t, len(b), size)
+	assert.EqualValues(t, b, read)
+
+	require.NoError(t, s.PutReader(hash+"2", strings.NewReader("streamed")))
+	obj, ok = fake.object("blobs/" + hash + "2")
+	require.True(t, ok)
+	assert.EqualValues(t, "streamed", obj)
+
+	require.NoError(t, s.Delete(hash))
+	has, err = s.Has(hash)
+	require.NoError(t, err)
+	assert.False(t, has)
+}
+
+func TestS3Store_FakeServerNoStorageClass(t *testing.T) {
+	fake := newFakeS3("blobs")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	hash := BlobHash([]byte("blob"))
+	s := newFakeS3Store(server, S3Opts{})
+	require.NoError(t, s.Put(hash, []byte("blob")))
+	assert.Empty(t, fake.storageClass[hash], "no storage class should be sent")
+}
+
+func TestS3Store_FakeServerMissingBucket(t *testing.T) {
+	server := httptest.NewServer(newFakeS3("blobs"))
+	defer server.Close()
+
+	s := newFakeS3Store(server, S3Opts{Bucket: "nope"})
+	_, err := s.Get(BlobHash([]byte("blob")))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "bucket nope does not exist")
+}
+
+func TestS3Store_FakeServerTLS(t *testing.T) {
+	fake := newFakeS3("blobs")
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+
+	hash := BlobHash([]byte("blob"))
+
+	// the test server's certificate is self-signed
+	_, err := newFakeS3Store(server, S3Opts{}).Has(hash)
+	require.Error(t, err)
+
+	has, err := newFakeS3Store(server, S3Opts{InsecureSkipVerify: true}).Has(hash)
+	require.NoError(t, err)
+	assert.False(t, has)
+
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	caFile := path.Join(tmpDir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, ioutil.WriteFile(caFile, caPEM, 0644))
+
+	s := newFakeS3Store(server, S3Opts{CACertFile: caFile})
+	require.NoError(t, s.Put(hash, []byte("blob")))
+	blob, err := s.Get(hash)
+	require.NoError(t, err)
+	assert.EqualValues(t, "blob", blob)
+}
+
+func TestS3Store_PrefixLength(t *testing.T) {
+	fake := newFakeS3("blobs")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	b := []byte("this is a blob of stuff")
+	hash := BlobHash(b)
+
+	s := newFakeS3Store(server, S3Opts{KeyPrefix: "blobs/", PrefixLength: 2})
+	require.NoError(t, s.Put(hash, b))
+	_, ok := fake.object("blobs/" + hash[:2] + "/" + hash)
+	assert.True(t, ok)
+
+	blob, err := s.Get(hash)
+	require.NoError(t, err)
+	assert.EqualValues(t, b, blob)
+
+	hashes, err := s.list()
+	require.NoError(t, err)
+	assert.Equal(t, []string{hash}, hashes)
+}
+
+func TestS3Store_LegacyKeyFallback(t *testing.T) {
+	fake := newFakeS3("blobs")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	b := []byte("this is a blob of stuff")
+	hash := BlobHash(b)
+	require.NoError(t, newFakeS3Store(server, S3Opts{KeyPrefix: "blobs/"}).Put(hash, b))
+
+	s := newFakeS3Store(server, S3Opts{KeyPrefix: "blobs/", PrefixLength: 2})
+	has, err := s.Has(hash)
+	require.NoError(t, err)
+	assert.False(t, has, "without the fallback, blobs that were not migrated are missing")
+
+	s = newFakeS3Store(server, S3Opts{KeyPrefix: "blobs/", PrefixLength: 2, LegacyKeyFallback: true})
+	has, err = s.Has(hash)
+	require.NoError(t, err)
+	assert.True(t, has)
+	blob, err := s.Get(hash)
+	require.NoError(t, err)
+	assert.EqualValues(t, b, blob)
+	rc, size, err := s.GetReader(hash)
+	require.NoError(t, err)
+	rc.Close()
+	assert.EqualValues(t, len(b), size)
+	rc, err = s.GetRange(hash, 0, 4)
+	require.NoError(t, err)
+	read, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	rc.Close()
+	assert.Equal(t, "this", string(read))
+
+	_, err = s.Get(BlobHash([]byte("missing")))
+	assert.True(t, errors.Is(err, ErrBlobNotFound))
+
+	require.NoError(t, s.Delete(hash))
+	_, ok := fake.object("blobs/" + hash)
+	assert.False(t, ok, "the legacy key should be deleted too")
+}
+
+func TestS3Store_MigrateKeys(t *testing.T) {
+	fake := newFakeS3("blobs")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	var hashes []string
+	flat := newFakeS3Store(server, S3Opts{KeyPrefix: "blobs/"})
+	for i := 0; i < 5; i++ {
+		b := []byte(fmt.Sprintf("blob %d", i))
+		hashes = append(hashes, BlobHash(b))
+		require.NoError(t, flat.Put(BlobHash(b), b))
+	}
+	require.NoError(t, flat.PutReader("not-a-blob", strings.NewReader("stuff")))
+
+	sharded := newFakeS3Store(server, S3Opts{KeyPrefix: "blobs/", PrefixLength: 3})
+	summary, err := sharded.MigrateKeys(2, true)
+	require.NoError(t, err)
+	assert.Equal(t, S3MigrateSummary{Checked: 6, Moved: 5, Skipped: 1}, summary)
+	has, err := sharded.Has(hashes[0])
+	require.NoError(t, err)
+	assert.False(t, has, "dry run should not move blobs")
+
+	summary, err = sharded.MigrateKeys(2, false)
+	require.NoError(t, err)
+	assert.Equal(t, S3MigrateSummary{Checked: 6, Moved: 5, Skipped: 1}, summary)
+
+	for i, hash := range hashes {
+		blob, err := sharded.Get(hash)
+		require.NoError(t, err)
+		assert.EqualValues(t, fmt.Sprintf("blob %d", i), blob)
+		has, err := flat.Has(hash)
+		require.NoError(t, err)
+		assert.False(t, has, "old key should be deleted")
+	}
+
+	summary, err = sharded.MigrateKeys(2, false)
+	require.NoError(t, err)
+	assert.Equal(t, 0, summary.Moved)
+}
+
+func TestGetRange(t *testing.T) {
+	fake := newFakeS3("blobs")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	b := []byte("0123456789")
+	hash := BlobHash(b)
+
+	stores := []BlobStore{newFakeS3Store(server, S3Opts{}), NewDiskStore(tmpDir, 2), NewMemStore()}
+	for _, s := range stores {
+		require.NoError(t, s.Put(hash, b))
+
+		for _, c := range []struct {
+			offset, length int64
+			expected       string
+		}{
+			{0, 3, "012"},
+			{4, -1, "456789"},
+			{8, 5, "89"},
+			{20, 5, ""},
+			{3, 0, ""},
+		} {
+			rc, err := GetRange(s, hash, c.offset, c.length)
+			require.NoError(t, err, s.Name())
+			read, err := ioutil.ReadAll(rc)
+			require.NoError(t, err, s.Name())
+			rc.Close()
+			assert.Equal(t, c.expected, string(read), "%s: offset %d, length %d", s.Name(), c.offset, c.length)
+		}
+
+		_, err = GetRange(s, BlobHash([]byte("missing")), 0, 1)
+		assert.True(t, errors.Is(err, ErrBlobNotFound), s.Name())
+		_, err = GetRange(s, BlobHash([]byte("missing")), 0, 0)
+		assert.True(t, errors.Is(err, ErrBlobNotFound), s.Name())
+	}
+}
@@ -0,0 +1,768 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SegmentStore packs blobs into large segment files instead of writing one file per blob, which saves
+// inodes and makes startup fast when there are millions of blobs. Blobs are appended to the newest
+// segment. Deletes append a tombstone, and the space is reclaimed by compaction, which copies the live
+// blobs out of mostly dead segments and removes them.
+//
+// Each full segment gets an index file next to it, so the blob index can be rebuilt on startup without
+// reading the segments. Only the newest segment is scanned.
+//
+// The index of all blobs is kept in memory. It takes about 150 bytes per blob for the hash, its location
+// and the map overhead, so 1M blobs take about 150MB and 50M blobs about 7GB. There is no on-disk index, so
+// this store is meant for caches of up to a few million blobs. Blob access times are not saved, so after a
+// restart the LRU order is restored from when blobs were written.
+type SegmentStore struct {
+	dir  string
+	opts SegmentOpts
+
+	// mu guards the index and the segments. It is not held while records are written, so reads don't
+	// wait for writes and fsyncs
+	mu sync.RWMutex
+	// writeMu serializes writes, so each record is appended after the previous one. Take it before mu
+	writeMu sync.Mutex
+	// compactMu keeps the background compaction and a Compact call from closing the same segment twice
+	compactMu   sync.Mutex
+	initialized bool
+	index       map[string]segmentLocation
+	segments    map[uint32]*segment
+	active      *segment
+
+	grp *stop.Group
+}
+
+// SegmentOpts allows to set options for a new SegmentStore.
+type SegmentOpts struct {
+	// a new segment is started once the newest one is this big
+	MaxSegmentSize int64
+	// segments with less than this share of live data are compacted
+	CompactRatio float64
+	// how often to look for segments to compact
+	CompactInterval time.Duration
+	// fsync the segment after every write
+	Fsync bool
+}
+
+type segment struct {
+	id   uint32
+	f    *os.File
+	size int64
+	// bytes used by records that are still in the index
+	live int64
+	// records written to the segment, only kept for the active segment so its index can be written
+	entries []segmentEntry
+}
+
+// segmentEntry is a record in a segment
+type segmentEntry struct {
+	tombstone bool
+	hash      string
+	written   int64 // unix time
+	offset    int64 // where the record starts in the segment
+	length    uint32
+}
+
+func (e segmentEntry) size() int64 {
+	return segmentHeaderSize + int64(len(e.hash)) + int64(e.length)
+}
+
+type segmentLocation struct {
+	segment uint32
+	offset  int64
+	length  uint32
+	written int64
+}
+
+func (l segmentLocation) size(hash string) int64 {
+	return segmentHeaderSize + int64(len(hash)) + int64(l.length)
+}
+
+// a record is a header followed by the hash and the blob:
+// type (1 byte), hash length (1 byte), written (8 bytes), blob length (4 bytes), crc32 of hash and blob (4 bytes)
+//
+// an index entry is:
+// type (1 byte), hash length (1 byte), written (8 bytes), record offset (8 bytes), blob length (4 bytes), hash
+const (
+	segmentHeaderSize = 18
+	segmentIndexSize  = 22
+
+	recordPut       = 1
+	recordTombstone = 2
+
+	segmentExt      = ".seg"
+	segmentIndexExt = ".idx"
+)
+
+// NewSegmentStore returns a store that packs blobs into segments in dir. Call Start to run compaction.
+func NewSegmentStore(dir string, opts SegmentOpts) *SegmentStore {
+	if opts.MaxSegmentSize <= 0 {
+		opts.MaxSegmentSize = 1 << 30
+	}
+	if opts.CompactRatio <= 0 || opts.CompactRatio > 1 {
+		opts.CompactRatio = 0.5
+	}
+	if opts.CompactInterval <= 0 {
+		opts.CompactInterval = time.Minute
+	}
+	return &SegmentStore{dir: dir, opts: opts, grp: stop.New()}
+}
+
+const nameSegment = "segment"
+
+// Name is the cache type name
+func (s *SegmentStore) Name() string { return nameSegment }
+
+// Start starts compacting segments in the background
+func (s *SegmentStore) Start() error {
+	err := s.initOnce()
+	if err != nil {
+		return err
+	}
+
+	s.grp.Add(1)
+	go func() {
+		defer s.grp.Done()
+		for {
+			select {
+			case <-s.grp.Ch():
+				return
+			case <-time.After(s.opts.CompactInterval):
+			}
+
+			_, err := s.Compact()
+			if err != nil {
+				log.Errorf("compacting segments in %s: %s", s.dir, errors.FullTrace(err))
+			}
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops compaction and closes the segments
+func (s *SegmentStore) Shutdown() {
+	s.grp.StopAndWait()
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, seg := range s.segments {
+		_ = seg.f.Close()
+	}
+	s.segments = nil
+	s.initialized = false
+}
+
+// Has returns true if the blob is in the store
+func (s *SegmentStore) Has(hash string) (bool, error) {
+	err := s.initOnce()
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.index[hash]
+	return ok, nil
+}
+
+// Get reads the blob from its segment
+func (s *SegmentStore) Get(hash string) (stream.Blob, error) {
+	err := s.initOnce()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	loc, ok := s.index[hash]
+	if !ok {
+		return nil, errors.Err(ErrBlobNotFound)
+	}
+	return s.read(hash, loc)
+}
+
+// Put appends the blob to the newest segment. Blobs that are already stored are not written again.
+func (s *SegmentStore) Put(hash string, blob stream.Blob) error {
+	if len(hash) > 255 {
+		return errors.Err("hash is too long")
+	}
+	err := s.initOnce()
+	if err != nil {
+		return err
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.has(hash) {
+		return nil
+	}
+	return s.append(recordPut, hash, blob, time.Now().Unix())
+}
+
+// PutSD stores the sd blob
+func (s *SegmentStore) PutSD(hash string, blob stream.Blob) error {
+	return s.Put(hash, blob)
+}
+
+// Delete removes the blob from the index and appends a tombstone. The space is reclaimed by compaction.
+func (s *SegmentStore) Delete(hash string) error {
+	err := s.initOnce()
+	if err != nil {
+		return err
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if !s.has(hash) {
+		return nil
+	}
+	return s.append(recordTombstone, hash, nil, time.Now().Unix())
+}
+
+func (s *SegmentStore) has(hash string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.index[hash]
+	return ok
+}
+
+// list returns the hashes of all blobs
+func (s *SegmentStore) list() ([]string, error) {
+	err := s.initOnce()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hashes := make([]string, 0, len(s.index))
+	for hash := range s.index {
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// listPrefix returns the hashes of the blobs that start with prefix
+func (s *SegmentStore) listPrefix(prefix string) ([]string, error) {
+	err := s.initOnce()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var hashes []string
+	for hash := range s.index {
+		if strings.HasPrefix(hash, prefix) {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes, nil
+}
+
+// listInfo returns all blobs. Their access time is when they were written.
+func (s *SegmentStore) listInfo() ([]blobInfo, error) {
+	err := s.initOnce()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	blobs := make([]blobInfo, 0, len(s.index))
+	for hash, loc := range s.index {
+		blobs = append(blobs, blobInfo{hash: hash, size: int64(loc.length), accessed: time.Unix(loc.written, 0)})
+	}
+	return blobs, nil
+}
+
+// Compact rewrites the segments that are mostly dead and returns how many bytes were reclaimed
+func (s *SegmentStore) Compact() (int64, error) {
+	err := s.initOnce()
+	if err != nil {
+		return 0, err
+	}
+
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	s.mu.RLock()
+	var candidates []*segment
+	for _, seg := range s.segments {
+		if seg != s.active && float64(seg.live) < float64(seg.size)*s.opts.CompactRatio {
+			candidates = append(candidates, seg)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].id < candidates[j].id })
+
+	var reclaimed int64
+	for _, seg := range candidates {
+		select {
+		case <-s.grp.Ch():
+			return reclaimed, nil
+		default:
+		}
+
+		size := seg.size
+		err := s.compact(seg)
+		if err != nil {
+			return reclaimed, err
+		}
+		reclaimed += size
+	}
+	return reclaimed, nil
+}
+
+// compact copies the live blobs of the segment to the active segment and removes it
+func (s *SegmentStore) compact(seg *segment) error {
+	entries, err := s.readIndex(seg.id)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.tombstone {
+			err = s.keepTombstone(seg, e)
+		} else {
+			err = s.moveRecord(seg, e)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	delete(s.segments, seg.id)
+	s.mu.Unlock()
+
+	_ = seg.f.Close()
+	err = os.Remove(s.segmentPath(seg.id, segmentExt))
+	if err != nil {
+		return errors.Err(err)
+	}
+	return errors.Err(os.Remove(s.segmentPath(seg.id, segmentIndexExt)))
+}
+
+// moveRecord copies a blob to the active segment if the record is still the blob's live copy
+func (s *SegmentStore) moveRecord(seg *segment, e segmentEntry) error {
+	s.mu.RLock()
+	loc, ok := s.index[e.hash]
+	live := ok && loc.segment == seg.id && loc.offset == e.offset
+	var blob []byte
+	var err error
+	if live {
+		blob, err = s.read(e.hash, loc)
+	}
+	s.mu.RUnlock()
+	if !live {
+		return nil
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.mu.Lock()
+	moved := s.index[e.hash] != loc
+	if err != nil && !moved {
+		// the copy is lost either way. drop it from the index so it's not read again
+		log.Errorf("compacting segment %d in %s: %s", seg.id, s.dir, errors.FullTrace(err))
+		seg.live -= loc.size(e.hash)
+		delete(s.index, e.hash)
+	}
+	s.mu.Unlock()
+	if err != nil || moved {
+		return nil // deleted or moved while it was being read
+	}
+	return s.append(recordPut, e.hash, blob, e.written)
+}
+
+// keepTombstone copies a tombstone to the active segment if an older segment might still have the blob.
+// Otherwise the blob would come back when the index is rebuilt.
+func (s *SegmentStore) keepTombstone(seg *segment, e segmentEntry) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.RLock()
+	_, stored := s.index[e.hash] // stored again after it was deleted
+	older := false
+	for id := range s.segments {
+		older = older || id < seg.id
+	}
+	s.mu.RUnlock()
+
+	if stored || !older {
+		return nil
+	}
+	return s.append(recordTombstone, e.hash, nil, e.written)
+}
+
+// read reads the blob's record and checks it. must be called with the lock held
+func (s *SegmentStore) read(hash string, loc segmentLocation) ([]byte, error) {
+	seg, ok := s.segments[loc.segment]
+	if !ok {
+		return nil, errors.Err("segment %d is missing", loc.segment)
+	}
+	record := make([]byte, loc.size(hash))
+	_, err := seg.f.ReadAt(record, loc.offset)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	e, blob, err := decodeRecord(record)
+	if err != nil || e.hash != hash {
+		return nil, errors.Err(ErrBlobCorrupt)
+	}
+	return blob, nil
+}
+
+// append writes a record to the active segment and then adds it to the index. must be called with writeMu
+// held and mu not held. only writers change the active segment and its size, so they can be read without mu
+func (s *SegmentStore) append(typ byte, hash string, blob []byte, written int64) error {
+	seg := s.active
+	e := segmentEntry{
+		tombstone: typ == recordTombstone,
+		hash:      hash,
+		written:   written,
+		offset:    seg.size,
+		length:    uint32(len(blob)),
+	}
+	_, err := seg.f.WriteAt(encodeRecord(e, blob), seg.size)
+	if err != nil {
+		// a partial record at the end is cut off when the segment is scanned on restart, but writes after it
+		// would be lost too, so keep them from going after it
+		_ = seg.f.Truncate(seg.size)
+		return errors.Err(err)
+	}
+	if s.opts.Fsync {
+		err = seg.f.Sync()
+		if err != nil {
+			return errors.Err(err)
+		}
+	}
+
+	s.mu.Lock()
+	seg.size += e.size()
+	seg.entries = append(seg.entries, e)
+	s.apply(seg, e)
+	s.mu.Unlock()
+
+	if seg.size >= s.opts.MaxSegmentSize {
+		return s.roll()
+	}
+	return nil
+}
+
+// apply updates the index for a record in seg. must be called with the lock held
+func (s *SegmentStore) apply(seg *segment, e segmentEntry) {
+	if old, ok := s.index[e.hash]; ok {
+		if oldSeg, ok := s.segments[old.segment]; ok {
+			oldSeg.live -= old.size(e.hash)
+		}
+		delete(s.index, e.hash)
+	}
+	if !e.tombstone {
+		s.index[e.hash] = segmentLocation{segment: seg.id, offset: e.offset, length: e.length, written: e.written}
+		seg.live += e.size()
+	}
+}
+
+// roll writes the index of the active segment and starts a new one. must be called with writeMu held and
+// mu not held
+func (s *SegmentStore) roll() error {
+	err := s.active.f.Sync()
+	if err != nil {
+		return errors.Err(err)
+	}
+	err = s.writeIndex(s.active)
+	if err != nil {
+		return err
+	}
+
+	seg, err := s.openSegment(s.active.id + 1)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active.entries = nil
+	s.segments[seg.id] = seg
+	s.active = seg
+	return nil
+}
+
+func (s *SegmentStore) initOnce() error {
+	s.mu.RLock()
+	initialized := s.initialized
+	s.mu.RUnlock()
+	if initialized {
+		return nil
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.initialized {
+		return nil
+	}
+
+	err := os.MkdirAll(s.dir, 0755)
+	if err != nil {
+		return errors.Err(err)
+	}
+
+	ids, err := s.segmentIDs()
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		ids = []uint32{1}
+	}
+
+	s.index = make(map[string]segmentLocation)
+	s.segments = make(map[uint32]*segment)
+	for i, id := range ids {
+		seg, err := s.openSegment(id)
+		if err != nil {
+			return err
+		}
+		s.segments[id] = seg
+
+		last := i == len(ids)-1
+		var entries []segmentEntry
+		if !last {
+			entries, err = s.readIndex(id)
+		}
+		if last || err != nil {
+			if err != nil {
+				log.Warnf("rebuilding the index of segment %d in %s: %s", id, s.dir, err.Error())
+			}
+			entries, err = s.scan(seg)
+			if err != nil {
+				return err
+			}
+			if !last {
+				seg.entries = entries
+				err = s.writeIndex(seg)
+				if err != nil {
+					return err
+				}
+				seg.entries = nil
+			}
+		}
+
+		for _, e := range entries {
+			s.apply(seg, e)
+		}
+		if last {
+			seg.entries = entries
+			s.active = seg
+		}
+	}
+
+	s.initialized = true
+	return nil
+}
+
+// segmentIDs returns the ids of the segments in the dir, oldest first
+func (s *SegmentStore) segmentIDs() ([]uint32, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	var ids []uint32
+	for _, f := range files {
+		if isTempFile(f.Name()) {
+			_ = os.Remove(path.Join(s.dir, f.Name())) // an index that was being written
+			continue
+		}
+		if !strings.HasSuffix(f.Name(), segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), segmentExt), 10, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (s *SegmentStore) segmentPath(id uint32, ext string) string {
+	return path.Join(s.dir, fmt.Sprintf("%08d%s", id, ext))
+}
+
+func (s *SegmentStore) openSegment(id uint32) (*segment, error) {
+	f, err := os.OpenFile(s.segmentPath(id, segmentExt), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, errors.Err(err)
+	}
+	return &segment{id: id, f: f, size: fi.Size()}, nil
+}
+
+// scan reads all records in the segment. A partial or corrupt record at the end, e.g. from a crash, is cut
+// off along with anything after it.
+func (s *SegmentStore) scan(seg *segment) ([]segmentEntry, error) {
+	r := bufio.NewReaderSize(io.NewSectionReader(seg.f, 0, seg.size), 1<<20)
+	var entries []segmentEntry
+	var offset int64
+	for offset < seg.size {
+		header := make([]byte, segmentHeaderSize)
+		_, err := io.ReadFull(r, header)
+		if err != nil {
+			break
+		}
+		rest := make([]byte, int(header[1])+int(binary.BigEndian.Uint32(header[10:14])))
+		_, err = io.ReadFull(r, rest)
+		if err != nil {
+			break
+		}
+		e, _, err := decodeRecord(append(header, rest...))
+		if err != nil {
+			break
+		}
+		e.offset = offset
+		entries = append(entries, e)
+		offset += e.size()
+	}
+
+	if offset < seg.size {
+		log.Warnf("cutting off %d bytes of segment %d in %s that were not written completely", seg.size-offset, seg.id, s.dir)
+		err := seg.f.Truncate(offset)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		seg.size = offset
+	}
+	return entries, nil
+}
+
+// writeIndex writes the index file for the segment
+func (s *SegmentStore) writeIndex(seg *segment) error {
+	tmp, err := ioutil.TempFile(s.dir, tempFilePrefix+"idx-*")
+	if err != nil {
+		return errors.Err(err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for _, e := range seg.entries {
+		b := make([]byte, segmentIndexSize, segmentIndexSize+len(e.hash))
+		b[0] = recordPut
+		if e.tombstone {
+			b[0] = recordTombstone
+		}
+		b[1] = byte(len(e.hash))
+		binary.BigEndian.PutUint64(b[2:10], uint64(e.written))
+		binary.BigEndian.PutUint64(b[10:18], uint64(e.offset))
+		binary.BigEndian.PutUint32(b[18:22], e.length)
+		_, err = w.Write(append(b, e.hash...))
+		if err != nil {
+			_ = tmp.Close()
+			return errors.Err(err)
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		_ = tmp.Close()
+		return errors.Err(err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return errors.Err(err)
+	}
+	return errors.Err(os.Rename(tmp.Name(), s.segmentPath(seg.id, segmentIndexExt)))
+}
+
+// readIndex reads the index file of a full segment
+func (s *SegmentStore) readIndex(id uint32) ([]segmentEntry, error) {
+	b, err := ioutil.ReadFile(s.segmentPath(id, segmentIndexExt))
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	var entries []segmentEntry
+	for len(b) > 0 {
+		if len(b) < segmentIndexSize || len(b) < segmentIndexSize+int(b[1]) {
+			return nil, errors.Err("index of segment %d is truncated", id)
+		}
+		hashEnd := segmentIndexSize + int(b[1])
+		entries = append(entries, segmentEntry{
+			tombstone: b[0] == recordTombstone,
+			hash:      string(b[segmentIndexSize:hashEnd]),
+			written:   int64(binary.BigEndian.Uint64(b[2:10])),
+			offset:    int64(binary.BigEndian.Uint64(b[10:18])),
+			length:    binary.BigEndian.Uint32(b[18:22]),
+		})
+		b = b[hashEnd:]
+	}
+	return entries, nil
+}
+
+func encodeRecord(e segmentEntry, blob []byte) []byte {
+	b := make([]byte, segmentHeaderSize, e.size())
+	b[0] = recordPut
+	if e.tombstone {
+		b[0] = recordTombstone
+	}
+	b[1] = byte(len(e.hash))
+	binary.BigEndian.PutUint64(b[2:10], uint64(e.written))
+	binary.BigEndian.PutUint32(b[10:14], e.length)
+	b = append(b, e.hash...)
+	b = append(b, blob...)
+	binary.BigEndian.PutUint32(b[14:18], crc32.ChecksumIEEE(b[segmentHeaderSize:]))
+	return b
+}
+
+// decodeRecord parses a whole record. The entry's offset is not set.
+func decodeRecord(b []byte) (segmentEntry, []byte, error) {
+	if len(b) < segmentHeaderSize || (b[0] != recordPut && b[0] != recordTombstone) {
+		return segmentEntry{}, nil, errors.Err("not a record")
+	}
+	e := segmentEntry{
+		tombstone: b[0] == recordTombstone,
+		written:   int64(binary.BigEndian.Uint64(b[2:10])),
+		length:    binary.BigEndian.Uint32(b[10:14]),
+	}
+	hashEnd := segmentHeaderSize + int(b[1])
+	if int64(len(b)) != int64(hashEnd)+int64(e.length) {
+		return segmentEntry{}, nil, errors.Err("record has the wrong length")
+	}
+	if crc32.ChecksumIEEE(b[segmentHeaderSize:]) != binary.BigEndian.Uint32(b[14:18]) {
+		return segmentEntry{}, nil, errors.Err("record is corrupt")
+	}
+	e.hash = string(b[segmentHeaderSize:hashEnd])
+	return e, b[hashEnd:], nil
+}
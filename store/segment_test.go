@@ -0,0 +1,253 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func segmentTestBlob(i int) ([]byte, string) {
+	blob := bytes.Repeat([]byte{byte(i)}, 1000+i)
+	return blob, BlobHash(blob)
+}
+
+func TestSegmentStore_PutGetDelete(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	s := NewSegmentStore(tmpDir, SegmentOpts{})
+	defer s.Shutdown()
+
+	blob, hash := segmentTestBlob(1)
+	require.NoError(t, s.Put(hash, blob))
+
+	has, err := s.Has(hash)
+	require.NoError(t, err)
+	assert.True(t, has)
+	read, err := s.Get(hash)
+	require.NoError(t, err)
+	assert.EqualValues(t, blob, read)
+
+	require.NoError(t, s.Delete(hash))
+	has, err = s.Has(hash)
+	require.NoError(t, err)
+	assert.False(t, has)
+	_, err = s.Get(hash)
+	assert.True(t, errors.Is(err, ErrBlobNotFound))
+}
+
+func TestSegmentStore_ConcurrentPutGet(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	// small segments, so some writes roll to a new segment while others read
+	s := NewSegmentStore(tmpDir, SegmentOpts{MaxSegmentSize: 10000, Fsync: true})
+	defer s.Shutdown()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w * 25; i < (w+1)*25; i++ {
+				blob, hash := segmentTestBlob(i)
+				assert.NoError(t, s.Put(hash, blob))
+				read, err := s.Get(hash)
+				assert.NoError(t, err)
+				assert.EqualValues(t, blob, read)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	hashes, err := s.list()
+	require.NoError(t, err)
+	assert.Len(t, hashes, 100)
+}
+
+func TestSegmentStore_Restart(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	// small segments, so some of them are full and have an index
+	s := NewSegmentStore(tmpDir, SegmentOpts{MaxSegmentSize: 3000})
+	for i := 0; i < 10; i++ {
+		blob, hash := segmentTestBlob(i)
+		require.NoError(t, s.Put(hash, blob))
+	}
+	_, deleted := segmentTestBlob(3)
+	require.NoError(t, s.Delete(deleted))
+	s.Shutdown()
+
+	// a write that was cut off by a crash
+	last, err := s.segmentIDs()
+	require.NoError(t, err)
+	f, err := os.OpenFile(s.segmentPath(last[len(last)-1], segmentExt), os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{recordPut, 20, 0, 0, 0})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s = NewSegmentStore(tmpDir, SegmentOpts{MaxSegmentSize: 3000})
+	defer s.Shutdown()
+	for i := 0; i < 10; i++ {
+		blob, hash := segmentTestBlob(i)
+		read, err := s.Get(hash)
+		if hash == deleted {
+			assert.True(t, errors.Is(err, ErrBlobNotFound))
+			continue
+		}
+		require.NoError(t, err)
+		assert.EqualValues(t, blob, read)
+	}
+
+	// writes continue after the cut off record
+	blob, hash := segmentTestBlob(20)
+	require.NoError(t, s.Put(hash, blob))
+	read, err := s.Get(hash)
+	require.NoError(t, err)
+	assert.EqualValues(t, blob, read)
+}
+
+func TestSegmentStore_CorruptRecord(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	s := NewSegmentStore(tmpDir, SegmentOpts{})
+	defer s.Shutdown()
+
+	blob, hash := segmentTestBlob(1)
+	require.NoError(t, s.Put(hash, blob))
+
+	f, err := os.OpenFile(path.Join(tmpDir, "00000001"+segmentExt), os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, 500)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = s.Get(hash)
+	assert.True(t, errors.Is(err, ErrBlobCorrupt))
+}
+
+func TestSegmentStore_Compact(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	s := NewSegmentStore(tmpDir, SegmentOpts{MaxSegmentSize: 5000})
+	for i := 0; i < 20; i++ {
+		blob, hash := segmentTestBlob(i)
+		require.NoError(t, s.Put(hash, blob))
+	}
+	for i := 0; i < 20; i++ {
+		if i%4 != 0 {
+			_, hash := segmentTestBlob(i)
+			require.NoError(t, s.Delete(hash))
+		}
+	}
+	before, err := s.segmentIDs()
+	require.NoError(t, err)
+
+	reclaimed, err := s.Compact()
+	require.NoError(t, err)
+	assert.True(t, reclaimed > 0)
+	after, err := s.segmentIDs()
+	require.NoError(t, err)
+	assert.NotEqual(t, before[0], after[0], "the oldest segment should be compacted")
+	s.Shutdown()
+
+	// deleted blobs must not come back after a restart
+	s = NewSegmentStore(tmpDir, SegmentOpts{MaxSegmentSize: 5000})
+	defer s.Shutdown()
+	for i := 0; i < 20; i++ {
+		blob, hash := segmentTestBlob(i)
+		read, err := s.Get(hash)
+		if i%4 != 0 {
+			assert.True(t, errors.Is(err, ErrBlobNotFound), "blob %d should be deleted", i)
+			continue
+		}
+		require.NoError(t, err)
+		assert.EqualValues(t, blob, read)
+	}
+}
+
+func TestSegmentStore_ConcurrentCompact(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	s := NewSegmentStore(tmpDir, SegmentOpts{MaxSegmentSize: 5000})
+	defer s.Shutdown()
+	for i := 0; i < 20; i++ {
+		blob, hash := segmentTestBlob(i)
+		require.NoError(t, s.Put(hash, blob))
+	}
+	for i := 0; i < 20; i++ {
+		if i%4 != 0 {
+			_, hash := segmentTestBlob(i)
+			require.NoError(t, s.Delete(hash))
+		}
+	}
+
+	// e.g. the background compaction and a manual one
+	var wg sync.WaitGroup
+	reclaimed := make([]int64, 2)
+	for i := range reclaimed {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			reclaimed[i], err = s.Compact()
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	assert.True(t, reclaimed[0] == 0 || reclaimed[1] == 0, "each segment should only be compacted once")
+
+	for i := 0; i < 20; i += 4 {
+		blob, hash := segmentTestBlob(i)
+		read, err := s.Get(hash)
+		require.NoError(t, err)
+		assert.EqualValues(t, blob, read)
+	}
+}
+
+func TestSegmentStore_LRU(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	s := NewSegmentStore(tmpDir, SegmentOpts{})
+	for i := 0; i < 5; i++ {
+		blob, hash := segmentTestBlob(i)
+		require.NoError(t, s.Put(hash, blob))
+	}
+	s.Shutdown()
+
+	s = NewSegmentStore(tmpDir, SegmentOpts{})
+	defer s.Shutdown()
+	lru := NewSizedLRUStore("test", s, 1<<20)
+
+	// the LRU gets the blob sizes from the index when it loads the blobs
+	var size int64
+	for i := 0; i < 5; i++ {
+		blob, hash := segmentTestBlob(i)
+		size += int64(len(blob))
+		has, err := lru.Has(hash)
+		require.NoError(t, err)
+		assert.True(t, has)
+	}
+	assert.EqualValues(t, size, lru.UsedBytes())
+}
@@ -0,0 +1,339 @@
+package store
+
+import (
+	ee "errors"
+	"hash/fnv"
+	"io"
+	"path"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/irmf/reflector.go/internal/metrics"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ShardedDiskStore spreads blobs across several directories, usually on different disks. Each blob goes
+// to a directory picked by rendezvous hashing, so adding a directory only moves the blobs that now
+// belong in it. A directory whose disk fails is taken offline for a while and the others keep working.
+// Errors that are about one blob or one request, like a client that goes away mid-upload, don't count.
+type ShardedDiskStore struct {
+	shards []*diskShard
+}
+
+type diskShard struct {
+	dir  string
+	disk *DiskStore
+
+	mu       sync.Mutex
+	failedAt time.Time
+}
+
+// how long a failed shard stays offline before it's tried again
+const shardRetryInterval = time.Minute
+
+// NewShardedDiskStore returns a store that spreads blobs across dirs. Each dir is laid out like a DiskStore
+// with the given prefixLength.
+func NewShardedDiskStore(dirs []string, prefixLength int) *ShardedDiskStore {
+	s := &ShardedDiskStore{}
+	for _, dir := range dirs {
+		dir = path.Clean(dir) // the dir is part of the hash, so it must be the same every time
+		s.shards = append(s.shards, &diskShard{dir: dir, disk: NewDiskStore(dir, prefixLength)})
+	}
+	return s
+}
+
+// SetFsync sets whether writes are flushed to disk before they return. See DiskStore.SetFsync.
+func (s *ShardedDiskStore) SetFsync(fsync bool) {
+	for _, shard := range s.shards {
+		shard.disk.SetFsync(fsync)
+	}
+}
+
+const nameShardedDisk = "sharded_disk"
+
+// Name is the cache type name
+func (s *ShardedDiskStore) Name() string { return nameShardedDisk }
+
+// Has returns true if the blob is in any of the directories
+func (s *ShardedDiskStore) Has(hash string) (bool, error) {
+	for _, shard := range s.ranked(hash) {
+		has, err := shard.disk.Has(hash)
+		if err != nil {
+			shard.failOnDeviceError(err)
+			continue
+		}
+		if has {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Get returns the blob from the directory it's in
+func (s *ShardedDiskStore) Get(hash string) (stream.Blob, error) {
+	var blob stream.Blob
+	err := s.read(hash, func(d *DiskStore) error {
+		var err error
+		blob, err = d.Get(hash)
+		return err
+	})
+	return blob, err
+}
+
+// GetReader returns a reader for the blob from the directory it's in
+func (s *ShardedDiskStore) GetReader(hash string) (io.ReadCloser, int64, error) {
+	var rc io.ReadCloser
+	var size int64
+	err := s.read(hash, func(d *DiskStore) error {
+		var err error
+		rc, size, err = d.GetReader(hash)
+		return err
+	})
+	return rc, size, err
+}
+
+// GetRange returns a reader for part of the blob from the directory it's in
+func (s *ShardedDiskStore) GetRange(hash string, offset, length int64) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	err := s.read(hash, func(d *DiskStore) error {
+		var err error
+		rc, err = d.GetRange(hash, offset, length)
+		return err
+	})
+	return rc, err
+}
+
+// Put stores the blob in its directory, or in the next one if that directory fails
+func (s *ShardedDiskStore) Put(hash string, blob stream.Blob) error {
+	return s.write(hash, func(d *DiskStore) error { return d.Put(hash, blob) })
+}
+
+// PutSD stores the sd blob in its directory
+func (s *ShardedDiskStore) PutSD(hash string, blob stream.Blob) error {
+	return s.Put(hash, blob)
+}
+
+// PutReader stores the blob read from r. The reader can't be rewound, so the blob is only written to its
+// directory and the write fails if that directory fails.
+func (s *ShardedDiskStore) PutReader(hash string, r io.Reader) error {
+	shards := s.ranked(hash)
+	if len(shards) == 0 {
+		return errors.Err("all disk shards are offline")
+	}
+	err := shards[0].disk.PutReader(hash, r)
+	if err != nil {
+		shards[0].failOnDeviceError(err)
+	}
+	return err
+}
+
+// Delete deletes the blob from every directory and returns the first error
+func (s *ShardedDiskStore) Delete(hash string) error {
+	var firstErr error
+	for _, shard := range s.ranked(hash) {
+		err := shard.disk.Delete(hash)
+		if err == nil {
+			continue
+		}
+		shard.failOnDeviceError(err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Rebalance moves blobs that are not in their directory, e.g. after a directory was added. It returns
+// the number of blobs moved. Blobs stay readable while they are moved.
+func (s *ShardedDiskStore) Rebalance() (int, error) {
+	moved := 0
+	for _, shard := range s.online() {
+		hashes, err := shard.disk.list()
+		if err != nil {
+			shard.failOnDeviceError(err)
+			continue
+		}
+
+		for _, hash := range hashes {
+			// rank all shards, so blobs are not moved around while their shard is offline
+			target := rank(hash, s.shards)[0]
+			if target == shard || !target.online() {
+				continue
+			}
+
+			err = moveBlob(shard.disk, target.disk, hash)
+			if err != nil {
+				log.Errorf("moving %s from %s to %s: %s", hash, shard.dir, target.dir, errors.FullTrace(err))
+				continue
+			}
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+func moveBlob(from, to *DiskStore, hash string) error {
+	rc, _, err := from.GetReader(hash)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	err = to.PutReader(hash, rc)
+	if err != nil {
+		return err
+	}
+	return from.Delete(hash)
+}
+
+// list returns the hashes of the blobs in all online directories
+func (s *ShardedDiskStore) list() ([]string, error) {
+	var hashes []string
+	for _, shard := range s.online() {
+		h, err := shard.disk.list()
+		if err != nil {
+			shard.failOnDeviceError(err)
+			continue
+		}
+		hashes = append(hashes, h...)
+	}
+	return hashes, nil
+}
+
+// listPrefix returns the hashes of the blobs in all online directories that start with prefix
+func (s *ShardedDiskStore) listPrefix(prefix string) ([]string, error) {
+	var hashes []string
+	for _, shard := range s.online() {
+		h, err := shard.disk.listPrefix(prefix)
+		if err != nil {
+			shard.failOnDeviceError(err)
+			continue
+		}
+		hashes = append(hashes, h...)
+	}
+	return hashes, nil
+}
+
+// listInfo returns the blobs in all online directories
+func (s *ShardedDiskStore) listInfo() ([]blobInfo, error) {
+	var blobs []blobInfo
+	for _, shard := range s.online() {
+		b, err := shard.disk.listInfo()
+		if err != nil {
+			shard.failOnDeviceError(err)
+			continue
+		}
+		blobs = append(blobs, b...)
+	}
+	return blobs, nil
+}
+
+// read tries fn on each online directory, starting with the one the blob belongs in. Blobs can be in
+// another directory if they have not been rebalanced yet, or if their directory was offline when they
+// were written.
+func (s *ShardedDiskStore) read(hash string, fn func(d *DiskStore) error) error {
+	for _, shard := range s.ranked(hash) {
+		err := fn(shard.disk)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrBlobNotFound) {
+			shard.failOnDeviceError(err)
+		}
+	}
+	return errors.Err(ErrBlobNotFound)
+}
+
+// write tries fn on each online directory in order until one succeeds. Only a failing disk moves the
+// write to the next directory, other errors would fail there too.
+func (s *ShardedDiskStore) write(hash string, fn func(d *DiskStore) error) error {
+	var err error
+	for _, shard := range s.ranked(hash) {
+		err = fn(shard.disk)
+		if err == nil {
+			return nil
+		}
+		if !isDeviceError(err) {
+			return err
+		}
+		shard.fail(err)
+	}
+	if err == nil {
+		err = errors.Err("all disk shards are offline")
+	}
+	return err
+}
+
+// ranked returns the online shards in the order the blob should be stored in them
+func (s *ShardedDiskStore) ranked(hash string) []*diskShard {
+	return rank(hash, s.online())
+}
+
+// rank sorts the shards by how much the blob belongs in them, using rendezvous hashing
+func rank(hash string, shards []*diskShard) []*diskShard {
+	shards = append([]*diskShard(nil), shards...)
+	scores := make(map[*diskShard]uint64, len(shards))
+	for _, shard := range shards {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(shard.dir))
+		_, _ = h.Write([]byte(hash))
+		scores[shard] = h.Sum64()
+	}
+	sort.Slice(shards, func(i, j int) bool { return scores[shards[i]] > scores[shards[j]] })
+	return shards
+}
+
+// isDeviceError returns true if the error means the disk is failing or the directory can't be used, rather
+// than that something is wrong with one blob or request
+func isDeviceError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EIO, syscall.ENOSPC, syscall.EDQUOT, syscall.EROFS, syscall.ENODEV, syscall.ENXIO, syscall.ENOTDIR} {
+		if ee.Is(errors.Unwrap(err), errno) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ShardedDiskStore) online() []*diskShard {
+	shards := make([]*diskShard, 0, len(s.shards))
+	for _, shard := range s.shards {
+		if shard.online() {
+			shards = append(shards, shard)
+		}
+	}
+	return shards
+}
+
+func (d *diskShard) online() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.failedAt.IsZero() && time.Since(d.failedAt) > shardRetryInterval {
+		d.failedAt = time.Time{}
+		metrics.DiskShardOffline.WithLabelValues(d.dir).Set(0)
+		log.Infof("disk shard %s is back online", d.dir)
+	}
+	return d.failedAt.IsZero()
+}
+
+// failOnDeviceError takes the shard offline if err means its disk is failing
+func (d *diskShard) failOnDeviceError(err error) {
+	if isDeviceError(err) {
+		d.fail(err)
+	}
+}
+
+func (d *diskShard) fail(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.failedAt.IsZero() {
+		log.Errorf("disk shard %s is offline for %s: %s", d.dir, shardRetryInterval, errors.FullTrace(err))
+	}
+	d.failedAt = time.Now()
+	metrics.DiskShardOffline.WithLabelValues(d.dir).Set(1)
+}
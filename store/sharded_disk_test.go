@@ -0,0 +1,173 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"testing/iotest"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func shardDirs(t *testing.T, n int) (string, []string) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	var dirs []string
+	for i := 0; i < n; i++ {
+		dirs = append(dirs, path.Join(tmpDir, fmt.Sprintf("disk%d", i)))
+	}
+	return tmpDir, dirs
+}
+
+func TestShardedDiskStore_SpreadsBlobs(t *testing.T) {
+	tmpDir, dirs := shardDirs(t, 3)
+	defer os.RemoveAll(tmpDir)
+	s := NewShardedDiskStore(dirs, 2)
+
+	for i := 0; i < 30; i++ {
+		b := []byte(fmt.Sprintf("blob %d", i))
+		require.NoError(t, s.Put(BlobHash(b), b))
+	}
+
+	for _, dir := range dirs {
+		hashes, err := NewDiskStore(dir, 2).list()
+		require.NoError(t, err)
+		assert.NotEmpty(t, hashes, "every dir should get some blobs")
+	}
+
+	hashes, err := s.list()
+	require.NoError(t, err)
+	assert.Len(t, hashes, 30)
+
+	for i := 0; i < 30; i++ {
+		b := []byte(fmt.Sprintf("blob %d", i))
+		blob, err := s.Get(BlobHash(b))
+		require.NoError(t, err)
+		assert.EqualValues(t, b, blob)
+	}
+}
+
+func TestShardedDiskStore_FailedDir(t *testing.T) {
+	tmpDir, dirs := shardDirs(t, 2)
+	defer os.RemoveAll(tmpDir)
+	s := NewShardedDiskStore(dirs, 2)
+
+	// replace the first dir with a file, so every write to it fails
+	require.NoError(t, ioutil.WriteFile(dirs[0], []byte("not a dir"), 0644))
+
+	for i := 0; i < 10; i++ {
+		b := []byte(fmt.Sprintf("blob %d", i))
+		require.NoError(t, s.Put(BlobHash(b), b))
+		blob, err := s.Get(BlobHash(b))
+		require.NoError(t, err)
+		assert.EqualValues(t, b, blob)
+	}
+
+	assert.False(t, s.shards[0].online())
+	assert.True(t, s.shards[1].online())
+	hashes, err := NewDiskStore(dirs[1], 2).list()
+	require.NoError(t, err)
+	assert.Len(t, hashes, 10, "all blobs should go to the working dir")
+}
+
+func TestShardedDiskStore_DeleteError(t *testing.T) {
+	tmpDir, dirs := shardDirs(t, 2)
+	defer os.RemoveAll(tmpDir)
+	s := NewShardedDiskStore(dirs, 2)
+
+	b := []byte("this is a blob of stuff")
+	hash := BlobHash(b)
+	require.NoError(t, s.Put(hash, b))
+
+	// a dir where the blob should be can't be removed like a file
+	shard := s.ranked(hash)[0]
+	blobPath := shard.disk.path(hash)
+	require.NoError(t, os.Remove(blobPath))
+	require.NoError(t, os.MkdirAll(path.Join(blobPath, "child"), 0755))
+
+	assert.Error(t, s.Delete(hash))
+	assert.True(t, shard.online(), "a failed delete should not take a working dir offline")
+
+	assert.True(t, isDeviceError(errors.Err(&os.PathError{Op: "remove", Path: blobPath, Err: syscall.EIO})))
+	assert.False(t, isDeviceError(errors.Err(&os.PathError{Op: "remove", Path: blobPath, Err: syscall.ENOTEMPTY})))
+}
+
+func TestShardedDiskStore_RequestErrors(t *testing.T) {
+	tmpDir, dirs := shardDirs(t, 2)
+	defer os.RemoveAll(tmpDir)
+	s := NewShardedDiskStore(dirs, 2)
+
+	// a client that goes away in the middle of an upload
+	r := io.MultiReader(bytes.NewReader([]byte("the start of a blob")), iotest.ErrReader(errors.Err("connection reset")))
+	assert.Error(t, s.PutReader(BlobHash([]byte("a blob")), r))
+
+	_, err := s.Get(BlobHash([]byte("missing")))
+	assert.True(t, errors.Is(err, ErrBlobNotFound))
+
+	for _, shard := range s.shards {
+		assert.True(t, shard.online(), "errors that are not about the disk should not take a dir offline")
+	}
+}
+
+func TestShardedDiskStore_Rebalance(t *testing.T) {
+	tmpDir, dirs := shardDirs(t, 3)
+	defer os.RemoveAll(tmpDir)
+
+	s := NewShardedDiskStore(dirs[:2], 2)
+	for i := 0; i < 30; i++ {
+		b := []byte(fmt.Sprintf("blob %d", i))
+		require.NoError(t, s.Put(BlobHash(b), b))
+	}
+
+	s = NewShardedDiskStore(dirs, 2)
+	moved, err := s.Rebalance()
+	require.NoError(t, err)
+	assert.True(t, moved > 0 && moved < 30, "only the blobs that belong in the new dir should move, moved %d", moved)
+
+	hashes, err := NewDiskStore(dirs[2], 2).list()
+	require.NoError(t, err)
+	assert.Len(t, hashes, moved)
+
+	for i := 0; i < 30; i++ {
+		b := []byte(fmt.Sprintf("blob %d", i))
+		hash := BlobHash(b)
+		has, err := s.ranked(hash)[0].disk.Has(hash)
+		require.NoError(t, err)
+		assert.True(t, has, "blob should be in its dir")
+		blob, err := s.Get(hash)
+		require.NoError(t, err)
+		assert.EqualValues(t, b, blob)
+	}
+
+	moved, err = s.Rebalance()
+	require.NoError(t, err)
+	assert.Equal(t, 0, moved)
+}
+
+func TestShardedDiskStore_LRU(t *testing.T) {
+	tmpDir, dirs := shardDirs(t, 2)
+	defer os.RemoveAll(tmpDir)
+
+	s := NewShardedDiskStore(dirs, 2)
+	for i := 0; i < 10; i++ {
+		b := []byte(fmt.Sprintf("blob %d", i))
+		require.NoError(t, s.Put(BlobHash(b), b))
+	}
+
+	lru := NewLRUStore("test", NewShardedDiskStore(dirs, 2), 10)
+	assert.Equal(t, 10, lru.lru.Len(), "blobs from every dir should be loaded")
+
+	b := []byte("one more blob")
+	require.NoError(t, lru.Put(BlobHash(b), b))
+	hashes, err := s.list()
+	require.NoError(t, err)
+	assert.Len(t, hashes, 10, "the oldest blob should be evicted")
+}
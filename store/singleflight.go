@@ -1,10 +1,14 @@
 package store
 
 import (
+	"context"
+	"io"
+	"sync"
 	"time"
 
 	"github.com/irmf/reflector.go/internal/metrics"
 
+	"github.com/lbryio/lbry.go/v2/extras/errors"
 	"github.com/lbryio/lbry.go/v2/stream"
 
 	"golang.org/x/sync/singleflight"
@@ -15,6 +19,7 @@ func WithSingleFlight(component string, origin BlobStore) BlobStore {
 		BlobStore: origin,
 		component: component,
 		sf:        new(singleflight.Group),
+		flights:   make(map[string]*flight),
 	}
 }
 
@@ -23,6 +28,17 @@ type singleflightStore struct {
 
 	component string
 	sf        *singleflight.Group
+
+	flightsMu sync.Mutex
+	flights   map[string]*flight
+}
+
+// flight tracks how many callers are waiting on an origin request. The request is cancelled
+// once nobody is waiting for it anymore.
+type flight struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
 }
 
 func (s *singleflightStore) Name() string {
@@ -32,26 +48,83 @@ func (s *singleflightStore) Name() string {
 // Get ensures that only one request per hash is sent to the origin at a time,
 // thereby protecting against https://en.wikipedia.org/wiki/Thundering_herd_problem
 func (s *singleflightStore) Get(hash string) (stream.Blob, error) {
+	return s.GetContext(context.Background(), hash)
+}
+
+// GetContext is Get with a context. If ctx is done, the caller stops waiting. The origin request
+// is only cancelled when every caller waiting on it is done.
+func (s *singleflightStore) GetContext(ctx context.Context, hash string) (stream.Blob, error) {
 	metrics.CacheWaitingRequestsCount.With(metrics.CacheLabels(s.BlobStore.Name(), s.component)).Inc()
 	defer metrics.CacheWaitingRequestsCount.With(metrics.CacheLabels(s.BlobStore.Name(), s.component)).Dec()
 
-	blob, err, _ := s.sf.Do(hash, s.getter(hash))
-	if err != nil {
-		return nil, err
+	for {
+		f := s.join(hash)
+		select {
+		case res := <-s.sf.DoChan(hash, s.getter(f.ctx, hash)):
+			s.leave(hash, f)
+			if res.Err != nil {
+				if errors.Is(res.Err, context.Canceled) && ctx.Err() == nil {
+					// joined a request that was abandoned by all of its other callers. try again
+					continue
+				}
+				return nil, res.Err
+			}
+			return res.Val.(stream.Blob), nil
+		case <-ctx.Done():
+			s.leave(hash, f)
+			return nil, errors.Err(ctx.Err())
+		}
+	}
+}
+
+// HasContext is Has with a context
+func (s *singleflightStore) HasContext(ctx context.Context, hash string) (bool, error) {
+	return HasContext(ctx, s.BlobStore, hash)
+}
+
+// join registers the caller as waiting on the origin request for hash
+func (s *singleflightStore) join(hash string) *flight {
+	s.flightsMu.Lock()
+	defer s.flightsMu.Unlock()
+
+	f, ok := s.flights[hash]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		f = &flight{ctx: ctx, cancel: cancel}
+		s.flights[hash] = f
+	}
+	f.waiters++
+	return f
+}
+
+// leave unregisters the caller, cancelling the origin request if nobody else is waiting on it
+func (s *singleflightStore) leave(hash string, f *flight) {
+	s.flightsMu.Lock()
+	defer s.flightsMu.Unlock()
+
+	f.waiters--
+	if f.waiters == 0 {
+		f.cancel()
+		if s.flights[hash] == f {
+			delete(s.flights, hash)
+		}
 	}
-	return blob.(stream.Blob), nil
 }
 
 // getter returns a function that gets a blob from the origin
 // only one getter per hash will be executing at a time
-func (s *singleflightStore) getter(hash string) func() (interface{}, error) {
+func (s *singleflightStore) getter(ctx context.Context, hash string) func() (interface{}, error) {
 	return func() (interface{}, error) {
 		metrics.CacheOriginRequestsCount.With(metrics.CacheLabels(s.BlobStore.Name(), s.component)).Inc()
 		defer metrics.CacheOriginRequestsCount.With(metrics.CacheLabels(s.BlobStore.Name(), s.component)).Dec()
 
 		start := time.Now()
-		blob, err := s.BlobStore.Get(hash)
+		blob, err := GetContext(ctx, s.BlobStore, hash)
 		if err != nil {
+			if ctx.Err() != nil {
+				// origins report cancellation in different ways. make it consistent for GetContext
+				return nil, errors.Err(ctx.Err())
+			}
 			return nil, err
 		}
 
@@ -65,3 +138,8 @@ func (s *singleflightStore) getter(hash string) func() (interface{}, error) {
 		return blob, nil
 	}
 }
+
+// PutReader passes the write through to the origin, streaming it if the origin supports it
+func (s *singleflightStore) PutReader(hash string, r io.Reader) error {
+	return PutReader(s.BlobStore, hash, r)
+}
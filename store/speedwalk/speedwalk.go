@@ -2,6 +2,7 @@ package speedwalk
 
 import (
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"runtime"
 	"sync"
@@ -15,27 +16,61 @@ import (
 // AllFiles recursively lists every file in every subdirectory of a given directory
 // If basename is true, return the basename of each file. Otherwise return the full path starting at startDir.
 func AllFiles(startDir string, basename bool) ([]string, error) {
-	items, err := ioutil.ReadDir(startDir)
+	var mu sync.Mutex
+	paths := make([]string, 0, 1000)
+
+	err := walk(startDir, func(path, name string) {
+		if basename {
+			path = name
+		}
+		mu.Lock()
+		paths = append(paths, path)
+		mu.Unlock()
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	pathChan := make(chan string)
-	paths := make([]string, 0, 1000)
-	pathWG := &sync.WaitGroup{}
-	pathWG.Add(1)
-	go func() {
-		defer pathWG.Done()
-		for {
-			path, ok := <-pathChan
-			if !ok {
-				return
+	return paths, nil
+}
+
+// AllFileInfos recursively stats every file in every subdirectory of a given directory
+func AllFileInfos(startDir string) ([]os.FileInfo, error) {
+	var mu sync.Mutex
+	infos := make([]os.FileInfo, 0, 1000)
+
+	err := walk(startDir, func(path, _ string) {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			// the file may have been deleted since it was listed
+			if !os.IsNotExist(err) {
+				logrus.Errorf(errors.FullTrace(err))
 			}
-			paths = append(paths, path)
+			return
 		}
-	}()
+		mu.Lock()
+		infos = append(infos, fi)
+		mu.Unlock()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return infos, nil
+}
+
+// walk calls fn with the full path and the basename of every file under startDir.
+// fn is called concurrently from multiple goroutines.
+func walk(startDir string, fn func(path, name string)) error {
+	items, err := ioutil.ReadDir(startDir)
+	if err != nil {
+		return err
+	}
 
 	maxThreads := runtime.NumCPU() - 1
+	if maxThreads < 1 {
+		maxThreads = 1
+	}
 	goroutineLimiter := make(chan struct{}, maxThreads)
 	for i := 0; i < maxThreads; i++ {
 		goroutineLimiter <- struct{}{}
@@ -44,11 +79,7 @@ func AllFiles(startDir string, basename bool) ([]string, error) {
 	walkerWG := &sync.WaitGroup{}
 	for _, item := range items {
 		if !item.IsDir() {
-			if basename {
-				pathChan <- item.Name()
-			} else {
-				pathChan <- filepath.Join(startDir, item.Name())
-			}
+			fn(filepath.Join(startDir, item.Name()), item.Name())
 			continue
 		}
 
@@ -61,15 +92,11 @@ func AllFiles(startDir string, basename bool) ([]string, error) {
 				goroutineLimiter <- struct{}{}
 			}()
 
-			err = godirwalk.Walk(filepath.Join(startDir, dir), &godirwalk.Options{
+			err := godirwalk.Walk(filepath.Join(startDir, dir), &godirwalk.Options{
 				Unsorted: true, // faster this way
 				Callback: func(osPathname string, de *godirwalk.Dirent) error {
 					if de.IsRegular() {
-						if basename {
-							pathChan <- de.Name()
-						} else {
-							pathChan <- osPathname
-						}
+						fn(osPathname, de.Name())
 					}
 					return nil
 				},
@@ -82,8 +109,5 @@ func AllFiles(startDir string, basename bool) ([]string, error) {
 
 	walkerWG.Wait()
 
-	close(pathChan)
-	pathWG.Wait()
-
-	return paths, nil
+	return nil
 }
@@ -1,6 +1,12 @@
 package store
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"time"
+
 	"github.com/lbryio/lbry.go/v2/extras/errors"
 	"github.com/lbryio/lbry.go/v2/stream"
 )
@@ -29,11 +35,182 @@ type Blocklister interface {
 	Wants(hash string) (bool, error)
 }
 
+// ReadStreamer is a store that can read blobs without holding the whole blob in memory.
+type ReadStreamer interface {
+	// GetReader returns a reader for the blob and the blob size. Must return ErrBlobNotFound if blob is not in store.
+	// The caller must close the reader.
+	GetReader(hash string) (io.ReadCloser, int64, error)
+}
+
+// WriteStreamer is a store that can write blobs without holding the whole blob in memory.
+type WriteStreamer interface {
+	// PutReader stores the blob read from r.
+	PutReader(hash string, r io.Reader) error
+}
+
+// ContextStore is a store whose reads can be cancelled or given a deadline with a context. Reads that
+// go to a remote origin should stop as soon as the context is done and return the context's error.
+type ContextStore interface {
+	// HasContext is Has with a context
+	HasContext(ctx context.Context, hash string) (bool, error)
+	// GetContext is Get with a context
+	GetContext(ctx context.Context, hash string) (stream.Blob, error)
+}
+
+// ContextReadStreamer is a ReadStreamer that takes a context.
+type ContextReadStreamer interface {
+	// GetReaderContext is GetReader with a context
+	GetReaderContext(ctx context.Context, hash string) (io.ReadCloser, int64, error)
+}
+
+// RangeReader is a store that can read part of a blob without reading the rest of it.
+type RangeReader interface {
+	// GetRange returns a reader for length bytes of the blob starting at offset, or for the rest of the
+	// blob if length is negative. The reader is empty if offset is past the end of the blob. Must return
+	// ErrBlobNotFound if blob is not in store. The caller must close the reader.
+	GetRange(hash string, offset, length int64) (io.ReadCloser, error)
+}
+
 // lister is a store that can list cached blobs. This is helpful when an overlay
 // cache needs to track blob existence.
 type lister interface {
 	list() ([]string, error)
 }
 
+// prefixLister is a store that can list only the blobs whose hash starts with a prefix, so a big store can
+// be listed a part at a time
+type prefixLister interface {
+	listPrefix(prefix string) ([]string, error)
+}
+
+// infoLister is a lister that also knows the size and last access time of each blob. The LRU uses
+// the sizes to limit the cache by total size, and the access times to restore its order.
+type infoLister interface {
+	lister
+	listInfo() ([]blobInfo, error)
+}
+
+// blobInfo describes a blob in a store without its contents
+type blobInfo struct {
+	hash     string
+	size     int64
+	accessed time.Time
+}
+
 //ErrBlobNotFound is a standard error when a blob is not found in the store.
 var ErrBlobNotFound = errors.Base("blob not found")
+
+// GetReader returns a reader for the blob. If the store is not a ReadStreamer, the blob is read into memory first.
+func GetReader(s BlobStore, hash string) (io.ReadCloser, int64, error) {
+	if st, ok := s.(ReadStreamer); ok {
+		return st.GetReader(hash)
+	}
+
+	blob, err := s.Get(hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(blob)), int64(len(blob)), nil
+}
+
+// HasContext checks if the store has the blob. If the store is not a ContextStore, the context is only
+// checked before the request is made.
+func HasContext(ctx context.Context, s BlobStore, hash string) (bool, error) {
+	if cs, ok := s.(ContextStore); ok {
+		return cs.HasContext(ctx, hash)
+	}
+	if err := ctx.Err(); err != nil {
+		return false, errors.Err(err)
+	}
+	return s.Has(hash)
+}
+
+// GetContext gets the blob from the store. If the store is not a ContextStore, the context is only
+// checked before the request is made.
+func GetContext(ctx context.Context, s BlobStore, hash string) (stream.Blob, error) {
+	if cs, ok := s.(ContextStore); ok {
+		return cs.GetContext(ctx, hash)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Err(err)
+	}
+	return s.Get(hash)
+}
+
+// GetReaderContext is GetReader with a context. It uses the most capable method the store supports.
+func GetReaderContext(ctx context.Context, s BlobStore, hash string) (io.ReadCloser, int64, error) {
+	if st, ok := s.(ContextReadStreamer); ok {
+		return st.GetReaderContext(ctx, hash)
+	}
+	if _, ok := s.(ReadStreamer); !ok {
+		if _, ok := s.(ContextStore); ok {
+			blob, err := GetContext(ctx, s, hash)
+			if err != nil {
+				return nil, 0, err
+			}
+			return ioutil.NopCloser(bytes.NewReader(blob)), int64(len(blob)), nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, 0, errors.Err(err)
+	}
+	return GetReader(s, hash)
+}
+
+// PutReader stores the blob read from r. If the store is not a WriteStreamer, the blob is read into memory first.
+func PutReader(s BlobStore, hash string, r io.Reader) error {
+	if st, ok := s.(WriteStreamer); ok {
+		return st.PutReader(hash, r)
+	}
+
+	blob, err := ioutil.ReadAll(io.LimitReader(r, stream.MaxBlobSize+1))
+	if err != nil {
+		return errors.Err(err)
+	}
+	if len(blob) > stream.MaxBlobSize {
+		return errors.Err(stream.ErrBlobTooBig)
+	}
+	return s.Put(hash, blob)
+}
+
+// GetRange returns a reader for part of the blob. If the store is not a RangeReader, the start of the blob
+// is read and discarded.
+func GetRange(s BlobStore, hash string, offset, length int64) (io.ReadCloser, error) {
+	if st, ok := s.(RangeReader); ok {
+		return st.GetRange(hash, offset, length)
+	}
+
+	rc, _, err := GetReader(s, hash)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.CopyN(ioutil.Discard, rc, offset)
+	if err != nil && err != io.EOF {
+		_ = rc.Close()
+		return nil, errors.Err(err)
+	}
+	return limitReadCloser(rc, length), nil
+}
+
+// limitReadCloser limits rc to n bytes. n < 0 means no limit.
+func limitReadCloser(rc io.ReadCloser, n int64) io.ReadCloser {
+	if n < 0 {
+		return rc
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rc, n), rc}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
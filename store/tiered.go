@@ -0,0 +1,222 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/irmf/reflector.go/db"
+	"github.com/irmf/reflector.go/internal/metrics"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StaleBlobLister lists blobs whose streams were not accessed recently. Every db.DB implements it.
+type StaleBlobLister interface {
+	StaleBlobs(before time.Time, after db.AccessCursor, limit int) ([]string, db.AccessCursor, error)
+}
+
+// TieredStore keeps recently accessed blobs in a fast hot tier and the rest in a cheaper cold tier.
+// New blobs go to the hot tier. Blobs of streams that were not accessed for DemoteAfter are moved to the
+// cold tier in the background, and are copied back to the hot tier when they are read again. The cold
+// copy is kept after a promotion, so demoting the blob again is only a delete.
+type TieredStore struct {
+	hot, cold BlobStore
+	stale     StaleBlobLister
+	opts      TieredOpts
+
+	grp *stop.Group
+}
+
+// TieredOpts allows to set options for a new TieredStore.
+type TieredOpts struct {
+	// blobs of streams that were not accessed for this long are moved to the cold tier
+	DemoteAfter time.Duration
+	// how often to look for blobs to demote
+	Interval time.Duration
+	// how many streams to look at per db query
+	BatchSize int
+	// used as the component label in metrics
+	Component string
+}
+
+// NewTieredStore returns a tiered store. Call Start to begin demoting blobs.
+func NewTieredStore(hot, cold BlobStore, stale StaleBlobLister, opts TieredOpts) *TieredStore {
+	if opts.DemoteAfter <= 0 {
+		opts.DemoteAfter = 30 * 24 * time.Hour
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Hour
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+	return &TieredStore{
+		hot:   hot,
+		cold:  cold,
+		stale: stale,
+		opts:  opts,
+		grp:   stop.New(),
+	}
+}
+
+const nameTiered = "tiered"
+
+// Name is the cache type name
+func (t *TieredStore) Name() string { return nameTiered }
+
+// Start starts the background demotion
+func (t *TieredStore) Start() {
+	t.grp.Add(1)
+	go func() {
+		defer t.grp.Done()
+		// streams before the cursor were already checked. it's not saved, so all stale streams are
+		// checked again after a restart
+		var cursor db.AccessCursor
+		for {
+			var err error
+			cursor, err = t.demote(cursor)
+			if err != nil {
+				log.Errorf("demoting blobs: %s", errors.FullTrace(err))
+			}
+
+			select {
+			case <-t.grp.Ch():
+				return
+			case <-time.After(t.opts.Interval):
+			}
+		}
+	}()
+}
+
+// Shutdown stops the background demotion
+func (t *TieredStore) Shutdown() {
+	t.grp.StopAndWait()
+}
+
+// Has returns true if either tier has the blob
+func (t *TieredStore) Has(hash string) (bool, error) {
+	return t.HasContext(context.Background(), hash)
+}
+
+// HasContext is Has with a context
+func (t *TieredStore) HasContext(ctx context.Context, hash string) (bool, error) {
+	has, err := HasContext(ctx, t.hot, hash)
+	if has || err != nil {
+		return has, err
+	}
+	return HasContext(ctx, t.cold, hash)
+}
+
+// Get gets the blob from the hot tier. If it's only in the cold tier, it's copied to the hot tier.
+func (t *TieredStore) Get(hash string) (stream.Blob, error) {
+	return t.GetContext(context.Background(), hash)
+}
+
+// GetContext is Get with a context
+func (t *TieredStore) GetContext(ctx context.Context, hash string) (stream.Blob, error) {
+	blob, err := GetContext(ctx, t.hot, hash)
+	if err == nil || !errors.Is(err, ErrBlobNotFound) {
+		return blob, err
+	}
+
+	blob, err = GetContext(ctx, t.cold, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.hot.Put(hash, blob)
+	if err != nil {
+		log.Errorf("promoting %s to the hot tier: %s", hash, errors.FullTrace(err))
+	} else {
+		metrics.TierMoveCount.With(t.labels(metrics.MovePromote)).Inc()
+	}
+	return blob, nil
+}
+
+// Put stores the blob in the hot tier
+func (t *TieredStore) Put(hash string, blob stream.Blob) error {
+	return t.hot.Put(hash, blob)
+}
+
+// PutSD stores the sd blob in the hot tier
+func (t *TieredStore) PutSD(hash string, blob stream.Blob) error {
+	return t.hot.PutSD(hash, blob)
+}
+
+// Delete deletes the blob from both tiers
+func (t *TieredStore) Delete(hash string) error {
+	err := t.hot.Delete(hash)
+	if err != nil {
+		return err
+	}
+	return t.cold.Delete(hash)
+}
+
+// demote moves the blobs of all streams that became stale since the cursor to the cold tier, and
+// returns the cursor to start from next time.
+func (t *TieredStore) demote(cursor db.AccessCursor) (db.AccessCursor, error) {
+	before := time.Now().Add(-t.opts.DemoteAfter)
+	for {
+		hashes, next, err := t.stale.StaleBlobs(before, cursor, t.opts.BatchSize)
+		if err != nil {
+			return cursor, err
+		}
+		if next == cursor {
+			return cursor, nil
+		}
+
+		for _, hash := range hashes {
+			select {
+			case <-t.grp.Ch():
+				return cursor, nil // the batch is checked again after a restart
+			default:
+			}
+
+			err = t.demoteBlob(hash)
+			if err != nil {
+				log.Errorf("demoting %s: %s", hash, errors.FullTrace(err))
+			}
+		}
+		cursor = next
+	}
+}
+
+func (t *TieredStore) demoteBlob(hash string) error {
+	has, err := t.hot.Has(hash)
+	if err != nil || !has {
+		return err
+	}
+
+	has, err = t.cold.Has(hash)
+	if err != nil {
+		return err
+	}
+	if !has {
+		blob, err := t.hot.Get(hash)
+		if err != nil {
+			return err
+		}
+		err = t.cold.Put(hash, blob)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = t.hot.Delete(hash)
+	if err != nil {
+		return err
+	}
+	metrics.TierMoveCount.With(t.labels(metrics.MoveDemote)).Inc()
+	return nil
+}
+
+func (t *TieredStore) labels(move string) map[string]string {
+	return map[string]string{
+		metrics.LabelComponent: t.opts.Component,
+		metrics.LabelMove:      move,
+	}
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/irmf/reflector.go/db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// staleList returns one hash per stream, using the index in hashes as the stream id
+type staleList struct {
+	hashes []string
+	calls  int
+}
+
+func (s *staleList) StaleBlobs(before time.Time, after db.AccessCursor, limit int) ([]string, db.AccessCursor, error) {
+	s.calls++
+	start := int(after.StreamID)
+	end := start + limit
+	if end > len(s.hashes) {
+		end = len(s.hashes)
+	}
+	if start >= end {
+		return nil, after, nil
+	}
+	return s.hashes[start:end], db.AccessCursor{LastAccessedAt: before, StreamID: uint64(end)}, nil
+}
+
+func TestTieredStore_Demote(t *testing.T) {
+	hot, cold := NewMemStore(), NewMemStore()
+	stale := &staleList{}
+	s := NewTieredStore(hot, cold, stale, TieredOpts{BatchSize: 2})
+
+	for _, b := range []string{"blob 1", "blob 2", "blob 3"} {
+		blob := []byte(b)
+		require.NoError(t, s.Put(BlobHash(blob), blob))
+		stale.hashes = append(stale.hashes, BlobHash(blob))
+	}
+
+	cursor, err := s.demote(db.AccessCursor{})
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, cursor.StreamID)
+	assert.Equal(t, 3, stale.calls, "should page through the stale streams")
+
+	for _, hash := range stale.hashes {
+		has, err := hot.Has(hash)
+		require.NoError(t, err)
+		assert.False(t, has)
+		has, err = cold.Has(hash)
+		require.NoError(t, err)
+		assert.True(t, has)
+	}
+
+	// nothing new is stale, so nothing is moved
+	cursor, err = s.demote(cursor)
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, cursor.StreamID)
+}
+
+func TestTieredStore_Promote(t *testing.T) {
+	hot, cold := NewMemStore(), NewMemStore()
+	s := NewTieredStore(hot, cold, &staleList{}, TieredOpts{})
+
+	blob := []byte("this is a blob of stuff")
+	hash := BlobHash(blob)
+	require.NoError(t, cold.Put(hash, blob))
+
+	has, err := s.Has(hash)
+	require.NoError(t, err)
+	assert.True(t, has)
+
+	read, err := s.Get(hash)
+	require.NoError(t, err)
+	assert.EqualValues(t, blob, read)
+
+	has, err = hot.Has(hash)
+	require.NoError(t, err)
+	assert.True(t, has, "the blob should be promoted to the hot tier")
+	has, err = cold.Has(hash)
+	require.NoError(t, err)
+	assert.True(t, has, "the cold copy should be kept")
+
+	// demoting it again only deletes the hot copy
+	require.NoError(t, s.demoteBlob(hash))
+	has, err = hot.Has(hash)
+	require.NoError(t, err)
+	assert.False(t, has)
+
+	_, err = s.Get("nonexistent")
+	assert.Error(t, err)
+}
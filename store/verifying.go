@@ -0,0 +1,159 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/irmf/reflector.go/internal/metrics"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrBlobCorrupt is returned when the contents of a blob don't match its hash.
+var ErrBlobCorrupt = errors.Base("blob is corrupt")
+
+// VerifyingStore checks the SHA-384 hash of every blob read from the underlying store.
+//
+// When wrapping a cache, set deleteCorrupt so corrupt blobs are removed and reported as not found.
+// A CachingStore then re-fetches them from the origin. When wrapping an origin, leave it unset so
+// corrupt blobs are reported with ErrBlobCorrupt and never get cached.
+type VerifyingStore struct {
+	BlobStore
+
+	component     string
+	deleteCorrupt bool
+	// if set, a copy of each corrupt blob is saved here before it's deleted
+	quarantineDir string
+}
+
+// NewVerifyingStore returns a store that verifies the hash of every blob read from s.
+func NewVerifyingStore(component string, s BlobStore, deleteCorrupt bool, quarantineDir string) *VerifyingStore {
+	return &VerifyingStore{
+		BlobStore:     s,
+		component:     component,
+		deleteCorrupt: deleteCorrupt,
+		quarantineDir: quarantineDir,
+	}
+}
+
+// Name is the cache type name
+func (v *VerifyingStore) Name() string { return "verify_" + v.BlobStore.Name() }
+
+// HasContext is Has with a context
+func (v *VerifyingStore) HasContext(ctx context.Context, hash string) (bool, error) {
+	return HasContext(ctx, v.BlobStore, hash)
+}
+
+// Get gets the blob and checks that it matches the hash
+func (v *VerifyingStore) Get(hash string) (stream.Blob, error) {
+	return v.GetContext(context.Background(), hash)
+}
+
+// GetContext is Get with a context
+func (v *VerifyingStore) GetContext(ctx context.Context, hash string) (stream.Blob, error) {
+	blob, err := GetContext(ctx, v.BlobStore, hash)
+	if errors.Is(err, ErrBlobCorrupt) {
+		// e.g. a compressed blob that can't be decompressed
+		return nil, v.corrupt(hash, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if BlobHash(blob) != hash {
+		return nil, v.corrupt(hash, blob)
+	}
+	return blob, nil
+}
+
+// GetReader reads the whole blob and checks its hash before returning a reader for it. Blobs are small,
+// and a server that streamed a blob before checking it would have sent the corrupt bytes by the time it
+// found out.
+func (v *VerifyingStore) GetReader(hash string) (io.ReadCloser, int64, error) {
+	return v.GetReaderContext(context.Background(), hash)
+}
+
+// GetReaderContext is GetReader with a context
+func (v *VerifyingStore) GetReaderContext(ctx context.Context, hash string) (io.ReadCloser, int64, error) {
+	rc, size, err := GetReaderContext(ctx, v.BlobStore, hash)
+	if errors.Is(err, ErrBlobCorrupt) {
+		return nil, 0, v.corrupt(hash, nil)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rc.Close()
+
+	blob, err := ioutil.ReadAll(io.LimitReader(rc, stream.MaxBlobSize+1))
+	if err != nil {
+		return nil, 0, errors.Err(err)
+	}
+	if len(blob) > stream.MaxBlobSize || int64(len(blob)) != size {
+		return nil, 0, v.corrupt(hash, nil)
+	}
+	if BlobHash(blob) != hash {
+		return nil, 0, v.corrupt(hash, blob)
+	}
+	return ioutil.NopCloser(bytes.NewReader(blob)), size, nil
+}
+
+// PutReader stores the blob read from r
+func (v *VerifyingStore) PutReader(hash string, r io.Reader) error {
+	return PutReader(v.BlobStore, hash, r)
+}
+
+// corrupt records a corrupt blob and returns the error that should be reported for it. blob may be nil
+// if the contents were streamed.
+func (v *VerifyingStore) corrupt(hash string, blob stream.Blob) error {
+	metrics.BlobCorruptionCount.With(metrics.CacheLabels(v.BlobStore.Name(), v.component)).Inc()
+	log.Warnf("blob %s in %s store is corrupt", hash, v.BlobStore.Name())
+
+	if !v.deleteCorrupt {
+		return errors.Err(ErrBlobCorrupt)
+	}
+
+	if v.quarantineDir != "" {
+		err := v.quarantine(hash, blob)
+		if err != nil {
+			log.Errorf("quarantining corrupt blob %s: %s", hash, errors.FullTrace(err))
+		}
+	}
+
+	err := v.BlobStore.Delete(hash)
+	if err != nil {
+		log.Errorf("deleting corrupt blob %s: %s", hash, errors.FullTrace(err))
+		return errors.Err(ErrBlobCorrupt)
+	}
+
+	return errors.Err(ErrBlobNotFound)
+}
+
+func (v *VerifyingStore) quarantine(hash string, blob stream.Blob) error {
+	if blob == nil {
+		var err error
+		blob, err = v.BlobStore.Get(hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := os.MkdirAll(v.quarantineDir, 0755)
+	if err != nil {
+		return errors.Err(err)
+	}
+	return errors.Err(ioutil.WriteFile(path.Join(v.quarantineDir, hash), blob, 0644))
+}
+
+// BlobHash returns the hex-encoded SHA-384 hash of the blob, which is how blobs are addressed
+func BlobHash(blob []byte) string {
+	hashBytes := sha512.Sum384(blob)
+	return hex.EncodeToString(hashBytes[:])
+}
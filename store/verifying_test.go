@@ -0,0 +1,107 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyingStore_CorruptCacheIsRefetched(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	b := []byte("this is a blob of stuff")
+	hash := BlobHash(b)
+
+	origin := NewMemStore()
+	require.NoError(t, origin.Put(hash, b))
+	cache := NewMemStore()
+	require.NoError(t, cache.Put(hash, []byte("this is a blob of junk")))
+
+	s := NewCachingStore("test", NewVerifyingStore("test", origin, false, ""), NewVerifyingStore("test", cache, true, tmpDir))
+
+	blob, err := s.Get(hash)
+	require.NoError(t, err)
+	assert.EqualValues(t, b, blob)
+
+	cached, err := cache.Get(hash)
+	require.NoError(t, err)
+	assert.EqualValues(t, b, cached, "corrupt copy should be replaced")
+
+	quarantined, err := ioutil.ReadFile(path.Join(tmpDir, hash))
+	require.NoError(t, err)
+	assert.EqualValues(t, "this is a blob of junk", quarantined)
+}
+
+func TestVerifyingStore_CorruptOrigin(t *testing.T) {
+	b := []byte("this is a blob of stuff")
+	hash := BlobHash(b)
+
+	origin := NewMemStore()
+	require.NoError(t, origin.Put(hash, b[:10]))
+	cache := NewMemStore()
+
+	s := NewCachingStore("test", NewVerifyingStore("test", origin, false, ""), cache)
+
+	_, err := s.Get(hash)
+	assert.True(t, errors.Is(err, ErrBlobCorrupt))
+	has, err := cache.Has(hash)
+	require.NoError(t, err)
+	assert.False(t, has, "corrupt blob should not be cached")
+}
+
+func TestVerifyingStore_GetReader(t *testing.T) {
+	b := []byte("this is a blob of stuff")
+	hash := BlobHash(b)
+
+	mem := NewMemStore()
+	require.NoError(t, mem.Put(hash, b))
+	s := NewVerifyingStore("test", mem, true, "")
+
+	rc, _, err := s.GetReader(hash)
+	require.NoError(t, err)
+	read, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.EqualValues(t, b, read)
+	rc.Close()
+
+	// the blob is checked before the reader is returned, so nothing corrupt is read
+	require.NoError(t, mem.Put(hash, b[:10]))
+	_, _, err = s.GetReader(hash)
+	assert.True(t, errors.Is(err, ErrBlobNotFound))
+
+	has, err := mem.Has(hash)
+	require.NoError(t, err)
+	assert.False(t, has, "corrupt blob should be deleted")
+}
+
+func TestVerifyingStore_CorruptCacheIsRefetchedForReaders(t *testing.T) {
+	b := []byte("this is a blob of stuff")
+	hash := BlobHash(b)
+
+	origin := NewMemStore()
+	require.NoError(t, origin.Put(hash, b))
+	cache := NewMemStore()
+	require.NoError(t, cache.Put(hash, []byte("this is a blob of junk")))
+
+	s := NewCachingStore("test", origin, NewVerifyingStore("test", cache, true, ""))
+
+	rc, size, err := s.GetReader(hash)
+	require.NoError(t, err)
+	defer rc.Close()
+	read, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.EqualValues(t, b, read)
+	assert.EqualValues(t, len(b), size)
+
+	cached, err := cache.Get(hash)
+	require.NoError(t, err)
+	assert.EqualValues(t, b, cached, "corrupt copy should be replaced")
+}
@@ -0,0 +1,521 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/irmf/reflector.go/db"
+	"github.com/irmf/reflector.go/internal/metrics"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// WriteBackStore acknowledges puts as soon as the blob is persisted in a local queue directory, and
+// uploads the blob to the origin in the background. Queued blobs survive restarts and are uploaded
+// when the store is started again. Until a blob is uploaded, reads for it are served from the queue.
+//
+// A failed upload goes back to the end of the queue to be retried after a backoff. A blob that fails
+// MaxAttempts times is parked: it stays on disk and readable, but is not retried until the next start.
+//
+// Put a DBBackedStore under the write-back store rather than over it, so the db only records blobs once
+// they reach the origin. Blocklisting and stream checks are passed through to it.
+type WriteBackStore struct {
+	origin BlobStore
+	opts   WriteBackOpts
+
+	// pending uploads. sd blobs are kept separately so they are uploaded with PutSD
+	blobs, sdBlobs *DiskStore
+
+	mu      sync.Mutex
+	queue   []pendingUpload // queue[head:] are waiting to be uploaded
+	head    int
+	pending map[string]time.Time // hash -> when it was queued
+	parked  map[string]bool
+	// uploads in progress. the channel is closed when the upload is over
+	uploading map[string]chan struct{}
+	wake      chan struct{}
+
+	grp *stop.Group
+}
+
+// WriteBackOpts allows to set options for a new WriteBackStore.
+type WriteBackOpts struct {
+	// directory where queued blobs are persisted until they are uploaded
+	Dir string
+	// number of concurrent uploads to the origin
+	Workers int
+	// the delay between retries doubles after each failed upload, up to this limit
+	MaxBackoff time.Duration
+	// how many times to try uploading a blob before parking it
+	MaxAttempts int
+	// used as the component label in metrics
+	Component string
+}
+
+type pendingUpload struct {
+	hash     string
+	isSD     bool
+	queued   time.Time
+	attempts int
+	retryAt  time.Time
+}
+
+// NewWriteBackStore returns a write-back store for the origin. Call Start to begin uploading.
+func NewWriteBackStore(origin BlobStore, opts WriteBackOpts) *WriteBackStore {
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 5 * time.Minute
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 20
+	}
+	// puts are acknowledged once the blob is queued, so the queue must survive a power loss
+	blobs := NewDiskStore(path.Join(opts.Dir, "blobs"), 0)
+	blobs.SetFsync(true)
+	sdBlobs := NewDiskStore(path.Join(opts.Dir, "sd"), 0)
+	sdBlobs.SetFsync(true)
+
+	return &WriteBackStore{
+		origin:    origin,
+		opts:      opts,
+		blobs:     blobs,
+		sdBlobs:   sdBlobs,
+		pending:   make(map[string]time.Time),
+		parked:    make(map[string]bool),
+		uploading: make(map[string]chan struct{}),
+		wake:      make(chan struct{}, opts.Workers), // one wakeup per worker
+		grp:       stop.New(),
+	}
+}
+
+// missingBlobsChecker is a store that knows which blobs of a stream it does not have
+type missingBlobsChecker interface {
+	MissingBlobsForKnownStream(sdHash string) ([]string, error)
+}
+
+const nameWriteBack = "write-back"
+
+// Name is the cache type name
+func (w *WriteBackStore) Name() string { return nameWriteBack }
+
+// Start loads the blobs that were queued before a restart and starts the upload workers.
+func (w *WriteBackStore) Start() error {
+	for _, ds := range []*DiskStore{w.blobs, w.sdBlobs} {
+		existing, err := ds.listInfo()
+		if err != nil {
+			return err
+		}
+		// upload the oldest first
+		sort.Slice(existing, func(i, j int) bool { return existing[i].accessed.Before(existing[j].accessed) })
+		for _, b := range existing {
+			w.enqueue(pendingUpload{hash: b.hash, isSD: ds == w.sdBlobs, queued: b.accessed})
+		}
+	}
+	if depth := w.depth(); depth > 0 {
+		log.Infof("write-back queue has %d blobs to upload", depth)
+	}
+
+	for i := 0; i < w.opts.Workers; i++ {
+		w.grp.Add(1)
+		go func() {
+			defer w.grp.Done()
+			w.worker()
+		}()
+	}
+
+	w.grp.Add(1)
+	go func() {
+		defer w.grp.Done()
+		w.reportAge()
+	}()
+
+	return nil
+}
+
+// Shutdown stops the upload workers. Blobs that were not uploaded stay queued on disk.
+func (w *WriteBackStore) Shutdown() {
+	w.grp.StopAndWait()
+}
+
+// Has returns true if the blob is queued or in the origin
+func (w *WriteBackStore) Has(hash string) (bool, error) {
+	return w.HasContext(context.Background(), hash)
+}
+
+// HasContext is Has with a context
+func (w *WriteBackStore) HasContext(ctx context.Context, hash string) (bool, error) {
+	if w.isPending(hash) {
+		return true, nil
+	}
+	return HasContext(ctx, w.origin, hash)
+}
+
+// Get returns the queued blob if it has not been uploaded yet, or gets it from the origin
+func (w *WriteBackStore) Get(hash string) (stream.Blob, error) {
+	return w.GetContext(context.Background(), hash)
+}
+
+// GetContext is Get with a context
+func (w *WriteBackStore) GetContext(ctx context.Context, hash string) (stream.Blob, error) {
+	if w.isPending(hash) {
+		blob, err := w.getQueued(hash)
+		if err == nil || !errors.Is(err, ErrBlobNotFound) {
+			return blob, err
+		}
+		// uploaded while we were looking
+	}
+	return GetContext(ctx, w.origin, hash)
+}
+
+// Put queues the blob for upload to the origin
+func (w *WriteBackStore) Put(hash string, blob stream.Blob) error {
+	err := w.blobs.Put(hash, blob)
+	if err != nil {
+		return err
+	}
+	w.enqueue(pendingUpload{hash: hash, queued: time.Now()})
+	return nil
+}
+
+// PutSD queues the sd blob for upload to the origin
+func (w *WriteBackStore) PutSD(hash string, blob stream.Blob) error {
+	err := w.sdBlobs.Put(hash, blob)
+	if err != nil {
+		return err
+	}
+	w.enqueue(pendingUpload{hash: hash, isSD: true, queued: time.Now()})
+	return nil
+}
+
+// Delete removes the blob from the queue and from the origin
+func (w *WriteBackStore) Delete(hash string) error {
+	err := w.dequeue(hash)
+	if err != nil {
+		return err
+	}
+	return w.origin.Delete(hash)
+}
+
+// Block removes the blob from the queue and blocks it in the origin
+func (w *WriteBackStore) Block(hash string) error {
+	bl, ok := w.origin.(Blocklister)
+	if !ok {
+		return errors.Err("%s does not support blocklisting", w.origin.Name())
+	}
+	err := w.dequeue(hash)
+	if err != nil {
+		return err
+	}
+	return bl.Block(hash)
+}
+
+// Wants returns false if the blob is queued, or if the origin has it or blocks it
+func (w *WriteBackStore) Wants(hash string) (bool, error) {
+	if w.isPending(hash) {
+		return false, nil
+	}
+	if bl, ok := w.origin.(Blocklister); ok {
+		return bl.Wants(hash)
+	}
+	has, err := w.origin.Has(hash)
+	return !has, err
+}
+
+// MissingBlobsForKnownStream returns the content blobs of the stream that are neither queued nor in the origin
+func (w *WriteBackStore) MissingBlobsForKnownStream(sdHash string) ([]string, error) {
+	var missing []string
+	if mc, ok := w.origin.(missingBlobsChecker); ok && !w.isPending(sdHash) {
+		var err error
+		missing, err = mc.MissingBlobsForKnownStream(sdHash)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// the origin does not know about the stream yet, so check every blob in it
+		blob, err := w.Get(sdHash)
+		if errors.Is(err, ErrBlobNotFound) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		var sd db.SdBlob
+		err = json.Unmarshal(blob, &sd)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		for _, b := range sd.Blobs {
+			if b.BlobHash == "" {
+				continue
+			}
+			has, err := w.origin.Has(b.BlobHash)
+			if err != nil {
+				return nil, err
+			}
+			if !has {
+				missing = append(missing, b.BlobHash)
+			}
+		}
+	}
+
+	var notQueued []string
+	for _, hash := range missing {
+		if !w.isPending(hash) {
+			notQueued = append(notQueued, hash)
+		}
+	}
+	return notQueued, nil
+}
+
+// dequeue removes the blob from the queue. If the blob is being uploaded, it waits for the upload to be
+// over, so that the upload does not put the blob back in the origin after the caller deletes it.
+func (w *WriteBackStore) dequeue(hash string) error {
+	uploading := w.done(hash) // a failed upload is not retried
+	if uploading != nil {
+		<-uploading
+	}
+
+	err := w.blobs.Delete(hash)
+	if err != nil {
+		return err
+	}
+	return w.sdBlobs.Delete(hash)
+}
+
+func (w *WriteBackStore) enqueue(p pendingUpload) {
+	w.mu.Lock()
+	_, alreadyQueued := w.pending[p.hash]
+	if !alreadyQueued {
+		w.pending[p.hash] = p.queued
+		w.queue = append(w.queue, p)
+	}
+	depth := len(w.pending)
+	w.mu.Unlock()
+
+	metrics.WriteBackQueueDepth.With(metrics.CacheLabels(w.origin.Name(), w.opts.Component)).Set(float64(depth))
+	w.wakeWorker()
+}
+
+func (w *WriteBackStore) wakeWorker() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next pops the next blob that is ready to be uploaded. If none is, it returns false and how long until
+// a retry is due, or 0 if nothing is waiting for a retry.
+func (w *WriteBackStore) next() (pendingUpload, bool, time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for n := len(w.queue) - w.head; n > 0; n-- {
+		p := w.popFront()
+		if _, ok := w.pending[p.hash]; !ok { // skip blobs deleted while queued
+			continue
+		}
+		if !p.retryAt.After(now) {
+			w.uploading[p.hash] = make(chan struct{})
+			return p, true, 0
+		}
+		w.queue = append(w.queue, p) // not due yet, look at the next one
+		if untilRetry := p.retryAt.Sub(now); wait == 0 || untilRetry < wait {
+			wait = untilRetry
+		}
+	}
+	return pendingUpload{}, false, wait
+}
+
+// popFront removes the first blob in the queue. The caller must hold the lock.
+func (w *WriteBackStore) popFront() pendingUpload {
+	p := w.queue[w.head]
+	w.queue[w.head] = pendingUpload{}
+	w.head++
+
+	// move the waiting blobs to the front once half the slice is used up, so the slice does not grow forever
+	if w.head == len(w.queue) {
+		w.queue, w.head = w.queue[:0], 0
+	} else if w.head > len(w.queue)/2 {
+		n := copy(w.queue, w.queue[w.head:])
+		for i := n; i < len(w.queue); i++ {
+			w.queue[i] = pendingUpload{}
+		}
+		w.queue, w.head = w.queue[:n], 0
+	}
+	return p
+}
+
+// retry puts the blob back at the end of the queue, or parks it if it failed too many times
+func (w *WriteBackStore) retry(p pendingUpload) {
+	p.attempts++
+	backoff := time.Second << uint(p.attempts-1)
+	if backoff > w.opts.MaxBackoff || backoff <= 0 {
+		backoff = w.opts.MaxBackoff
+	}
+	p.retryAt = time.Now().Add(backoff)
+
+	w.mu.Lock()
+	_, ok := w.pending[p.hash]
+	park := ok && p.attempts >= w.opts.MaxAttempts
+	if park {
+		w.parked[p.hash] = true
+	} else if ok {
+		w.queue = append(w.queue, p)
+	}
+	parked := len(w.parked)
+	w.mu.Unlock()
+
+	if park {
+		log.Errorf("write-back: parking %s after %d failed uploads. it will be retried after a restart", p.hash, p.attempts)
+		metrics.WriteBackParked.With(metrics.CacheLabels(w.origin.Name(), w.opts.Component)).Set(float64(parked))
+		return
+	}
+	log.Errorf("write-back: uploading %s failed, retrying in %s", p.hash, backoff)
+}
+
+// done removes the blob from the queue, and returns the channel of its upload if one is in progress. Both
+// happen under the same lock, so no upload of the blob can start after done returns.
+func (w *WriteBackStore) done(hash string) chan struct{} {
+	w.mu.Lock()
+	delete(w.pending, hash)
+	delete(w.parked, hash)
+	uploading := w.uploading[hash]
+	depth, parked := len(w.pending), len(w.parked)
+	w.mu.Unlock()
+
+	metrics.WriteBackQueueDepth.With(metrics.CacheLabels(w.origin.Name(), w.opts.Component)).Set(float64(depth))
+	metrics.WriteBackParked.With(metrics.CacheLabels(w.origin.Name(), w.opts.Component)).Set(float64(parked))
+	return uploading
+}
+
+func (w *WriteBackStore) isPending(hash string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.pending[hash]
+	return ok
+}
+
+func (w *WriteBackStore) depth() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.pending)
+}
+
+func (w *WriteBackStore) getQueued(hash string) (stream.Blob, error) {
+	blob, err := w.blobs.Get(hash)
+	if errors.Is(err, ErrBlobNotFound) {
+		return w.sdBlobs.Get(hash)
+	}
+	return blob, err
+}
+
+func (w *WriteBackStore) worker() {
+	for {
+		select {
+		case <-w.grp.Ch():
+			return // the blobs that were not uploaded stay on disk and get queued again on start
+		default:
+		}
+
+		p, ok, wait := w.next()
+		if ok {
+			w.upload(p)
+			continue
+		}
+
+		var retry <-chan time.Time
+		var timer *time.Timer
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			retry = timer.C
+		}
+		select {
+		case <-w.grp.Ch():
+		case <-w.wake:
+		case <-retry:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// upload tries once to upload the blob to the origin. If that fails, the blob is queued to be retried.
+func (w *WriteBackStore) upload(p pendingUpload) {
+	defer func() {
+		w.mu.Lock()
+		close(w.uploading[p.hash])
+		delete(w.uploading, p.hash)
+		w.mu.Unlock()
+	}()
+
+	queue := w.blobs
+	if p.isSD {
+		queue = w.sdBlobs
+	}
+
+	blob, err := queue.Get(p.hash)
+	if errors.Is(err, ErrBlobNotFound) {
+		w.done(p.hash) // deleted while queued
+		return
+	}
+	if err == nil {
+		if p.isSD {
+			err = w.origin.PutSD(p.hash, blob)
+		} else {
+			err = w.origin.Put(p.hash, blob)
+		}
+	}
+	if err == nil {
+		err = queue.Delete(p.hash)
+		if err != nil {
+			log.Errorf("write-back: removing uploaded blob %s from queue: %s", p.hash, errors.FullTrace(err))
+		}
+		w.done(p.hash)
+		return
+	}
+
+	metrics.WriteBackErrorCount.With(metrics.CacheLabels(w.origin.Name(), w.opts.Component)).Inc()
+	log.Errorf("write-back: uploading %s: %s", p.hash, errors.FullTrace(err))
+	w.retry(p)
+}
+
+// reportAge periodically updates the age of the oldest queued blob
+func (w *WriteBackStore) reportAge() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		var oldest time.Time
+		w.mu.Lock()
+		for _, queued := range w.pending {
+			if oldest.IsZero() || queued.Before(oldest) {
+				oldest = queued
+			}
+		}
+		w.mu.Unlock()
+
+		age := 0.0
+		if !oldest.IsZero() {
+			age = time.Since(oldest).Seconds()
+		}
+		metrics.WriteBackOldestAge.With(metrics.CacheLabels(w.origin.Name(), w.opts.Component)).Set(age)
+
+		select {
+		case <-w.grp.Ch():
+			return
+		case <-ticker.C:
+		}
+	}
+}
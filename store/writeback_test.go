@@ -0,0 +1,253 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBackStore_UploadsInBackground(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	origin := NewSlowBlobStore(100 * time.Millisecond)
+	w := NewWriteBackStore(origin, WriteBackOpts{Dir: tmpDir})
+	require.NoError(t, w.Start())
+	defer w.Shutdown()
+
+	b := []byte("this is a blob of stuff")
+	start := time.Now()
+	require.NoError(t, w.Put("hash", b))
+	assert.True(t, time.Since(start) < 100*time.Millisecond, "Put should not wait for the origin")
+
+	blob, err := w.Get("hash")
+	require.NoError(t, err)
+	assert.EqualValues(t, b, blob)
+
+	require.Eventually(t, func() bool {
+		has, _ := origin.mem.Has("hash")
+		return has && w.depth() == 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	files, err := ioutil.ReadDir(w.blobs.blobDir)
+	require.NoError(t, err)
+	assert.Empty(t, files, "uploaded blob should be removed from the queue")
+}
+
+func TestWriteBackStore_SurvivesRestart(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	origin := NewMemStore()
+	b := []byte("this is a blob of stuff")
+
+	// queue without starting the workers, like a crash right after the put was acknowledged
+	w := NewWriteBackStore(origin, WriteBackOpts{Dir: tmpDir})
+	require.NoError(t, w.Put("hash", b))
+	require.NoError(t, w.PutSD("sdhash", b))
+
+	w = NewWriteBackStore(origin, WriteBackOpts{Dir: tmpDir})
+	require.NoError(t, w.Start())
+	defer w.Shutdown()
+
+	require.Eventually(t, func() bool { return w.depth() == 0 }, 2*time.Second, 10*time.Millisecond)
+	for _, hash := range []string{"hash", "sdhash"} {
+		blob, err := origin.Get(hash)
+		require.NoError(t, err)
+		assert.EqualValues(t, b, blob)
+	}
+}
+
+func TestWriteBackStore_Retries(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	origin := &flakyStore{MemStore: NewMemStore(), failures: 1}
+	w := NewWriteBackStore(origin, WriteBackOpts{Dir: tmpDir})
+	require.NoError(t, w.Start())
+	defer w.Shutdown()
+
+	require.NoError(t, w.Put("hash", []byte("this is a blob of stuff")))
+	require.Eventually(t, func() bool {
+		has, _ := origin.Has("hash")
+		return has
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestWriteBackStore_ParksBlobsThatKeepFailing(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	origin := &rejectingStore{MemStore: NewMemStore(), reject: "bad"}
+	w := NewWriteBackStore(origin, WriteBackOpts{Dir: tmpDir, MaxAttempts: 2, MaxBackoff: 10 * time.Millisecond})
+	require.NoError(t, w.Start())
+	defer w.Shutdown()
+
+	b := []byte("this is a blob of stuff")
+	require.NoError(t, w.Put("bad", b))
+	require.NoError(t, w.Put("good", b))
+
+	// the failing blob does not hold up the rest of the queue
+	require.Eventually(t, func() bool {
+		has, _ := origin.Has("good")
+		return has
+	}, 2*time.Second, 10*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return w.parked["bad"]
+	}, 2*time.Second, 10*time.Millisecond)
+	w.mu.Lock()
+	assert.Empty(t, w.queue[w.head:], "parked blobs are not retried")
+	w.mu.Unlock()
+
+	blob, err := w.Get("bad")
+	require.NoError(t, err, "parked blobs can still be read")
+	assert.EqualValues(t, b, blob)
+}
+
+func TestWriteBackStore_QueueIsCompacted(t *testing.T) {
+	w := NewWriteBackStore(NewMemStore(), WriteBackOpts{Dir: "unused"})
+	for i := 0; i < 10; i++ {
+		w.enqueue(pendingUpload{hash: string(rune('a' + i)), queued: time.Now()})
+	}
+
+	for i := 0; i < 6; i++ {
+		p, ok, _ := w.next()
+		require.True(t, ok)
+		assert.Equal(t, string(rune('a'+i)), p.hash)
+	}
+	assert.Equal(t, 0, w.head)
+	assert.Len(t, w.queue, 4)
+
+	for i := 6; i < 10; i++ {
+		_, ok, _ := w.next()
+		require.True(t, ok)
+	}
+	_, ok, wait := w.next()
+	assert.False(t, ok)
+	assert.Zero(t, wait)
+	assert.Empty(t, w.queue)
+}
+
+func TestWriteBackStore_DeleteWaitsForUpload(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	origin := &blockingStore{MemStore: NewMemStore(), started: make(chan struct{}), release: make(chan struct{})}
+	w := NewWriteBackStore(origin, WriteBackOpts{Dir: tmpDir})
+	require.NoError(t, w.Start())
+	defer w.Shutdown()
+
+	require.NoError(t, w.Put("hash", []byte("this is a blob of stuff")))
+	<-origin.started
+
+	deleted := make(chan error)
+	go func() { deleted <- w.Delete("hash") }()
+	select {
+	case <-deleted:
+		t.Fatal("Delete should wait for the upload that is in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(origin.release)
+	require.NoError(t, <-deleted)
+	has, err := origin.Has("hash")
+	require.NoError(t, err)
+	assert.False(t, has, "the upload should not put the blob back after it was deleted")
+}
+
+func TestWriteBackStore_NoUploadStartsDuringDelete(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	origin := &blockingStore{MemStore: NewMemStore(), started: make(chan struct{}), release: make(chan struct{})}
+	close(origin.release)
+	w := NewWriteBackStore(origin, WriteBackOpts{Dir: tmpDir}) // not started, the test plays the worker
+	require.NoError(t, w.Put("hash", []byte("this is a blob of stuff")))
+
+	// a worker that looks for the next blob right after Delete took it off the queue must not upload it
+	assert.Nil(t, w.done("hash"), "no upload was in progress")
+	p, ok, _ := w.next()
+	if ok {
+		w.upload(p)
+	}
+	assert.False(t, ok, "the blob should not be uploaded once Delete took it off the queue")
+	has, err := origin.Has("hash")
+	require.NoError(t, err)
+	assert.False(t, has)
+}
+
+func TestWriteBackStore_MissingBlobsForKnownStream(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "reflector_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	origin := NewMemStore()
+	w := NewWriteBackStore(origin, WriteBackOpts{Dir: tmpDir}) // not started, so everything stays queued
+	sdHash, hashes := testStream(t, w, 3)
+
+	missing, err := w.MissingBlobsForKnownStream(sdHash)
+	require.NoError(t, err)
+	assert.Empty(t, missing)
+
+	require.NoError(t, w.dequeue(hashes[0]))
+	require.NoError(t, w.dequeue(hashes[1]))
+	require.NoError(t, origin.Put(hashes[1], []byte("content blob 1")))
+	missing, err = w.MissingBlobsForKnownStream(sdHash)
+	require.NoError(t, err)
+	assert.Equal(t, []string{hashes[0]}, missing)
+}
+
+// blockingStore blocks puts until it is released
+type blockingStore struct {
+	*MemStore
+	started, release chan struct{}
+}
+
+func (b *blockingStore) Put(hash string, blob stream.Blob) error {
+	close(b.started)
+	<-b.release
+	return b.MemStore.Put(hash, blob)
+}
+
+// rejectingStore fails every put of one blob
+type rejectingStore struct {
+	*MemStore
+	reject string
+}
+
+func (r *rejectingStore) Put(hash string, blob stream.Blob) error {
+	if hash == r.reject {
+		return errors.Err("origin rejected the blob")
+	}
+	return r.MemStore.Put(hash, blob)
+}
+
+// flakyStore fails the first few puts
+type flakyStore struct {
+	*MemStore
+	failures int
+}
+
+func (f *flakyStore) Put(hash string, blob stream.Blob) error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.Err("origin is down")
+	}
+	return f.MemStore.Put(hash, blob)
+}